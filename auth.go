@@ -0,0 +1,170 @@
+package outline
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+
+	"github.com/imgk/caddy-outline-manager/outline"
+)
+
+// managerFile is the default name of the state file, which keeps the
+// admins, tokens and servers changed from the panel.
+const managerFile = "outline-manager.json"
+
+// Admin is an account allowed to log in to the manager.
+type Admin struct {
+	Username string `json:"username"`
+	// Password is the bcrypt hash of the password,
+	// as printed by `caddy hash-password`.
+	Password string       `json:"password"`
+	Role     outline.Role `json:"role"`
+}
+
+// managerConfig is the content of the state file.
+type managerConfig struct {
+	Admins  []Admin          `json:"admins,omitempty"`
+	Servers []outline.Config `json:"servers,omitempty"`
+	Tokens  []Token          `json:"tokens,omitempty"`
+
+	// Username, Password and RawPass hold the single admin of older
+	// versions. They are only read to migrate such files; a plaintext
+	// RawPass is hashed and never written back.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	RawPass  string `json:"rawpass,omitempty"`
+}
+
+// loadManagerFile reads the state file name. Files written by older versions
+// are migrated to a single owner and rewritten.
+func loadManagerFile(name string) (*managerConfig, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	config := &managerConfig{}
+	if err := json.Unmarshal(b, config); err != nil {
+		return nil, err
+	}
+	if config.Username == "" && config.RawPass == "" {
+		return config, nil
+	}
+	if config.Password == "" {
+		config.Password, err = hashPassword(config.RawPass)
+		if err != nil {
+			return nil, err
+		}
+	}
+	config.Admins = append(config.Admins, Admin{Username: config.Username, Password: config.Password, Role: outline.RoleOwner})
+	config.Username, config.Password, config.RawPass = "", "", ""
+	if err := saveManagerFile(name, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// saveManagerFile writes config to the state file name.
+func saveManagerFile(name string, config *managerConfig) error {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(name, b, 0600)
+}
+
+// updateManagerFile applies fn to the content of the state file name,
+// starting from an empty config when the file does not exist yet.
+func updateManagerFile(name string, fn func(*managerConfig)) error {
+	config, err := loadManagerFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		config, err = &managerConfig{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	fn(config)
+	return saveManagerFile(name, config)
+}
+
+// mergeServers adds the saved servers to the configured ones, but for
+// those with the API URL or the ID of one already there.
+func mergeServers(configured, saved []outline.Config) []outline.Config {
+	merged := append([]outline.Config(nil), configured...)
+	for _, config := range saved {
+		if !slices.ContainsFunc(merged, func(c outline.Config) bool {
+			return c.APIURL == config.APIURL || (c.ID != "" && c.ID == config.ID)
+		}) {
+			merged = append(merged, config)
+		}
+	}
+	return merged
+}
+
+// hashPassword hashes pass the same way as `caddy hash-password`.
+func hashPassword(pass string) (string, error) {
+	b, err := caddyauth.BcryptHash{}.Hash([]byte(pass))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// decodeHash accepts a bcrypt hash either as printed by `caddy hash-password`
+// or base64 encoded like older Caddy versions did.
+func decodeHash(hash string) ([]byte, error) {
+	if strings.HasPrefix(hash, "$2") {
+		return []byte(hash), nil
+	}
+	b, err := base64.StdEncoding.DecodeString(hash)
+	if err == nil && strings.HasPrefix(string(b), "$2") {
+		return b, nil
+	}
+	return nil, errors.New("password is not a bcrypt hash, generate one with `caddy hash-password`")
+}
+
+// checkPassword reports whether pass matches hash. A nil hash is compared
+// against a fake one so that unknown usernames take as long as known ones.
+func checkPassword(hash []byte, pass string) bool {
+	if hash == nil {
+		caddyauth.BcryptHash{}.Compare(caddyauth.BcryptHash{}.FakeHash(), []byte(pass))
+		return false
+	}
+	ok, err := caddyauth.BcryptHash{}.Compare(hash, []byte(pass))
+	return err == nil && ok
+}
+
+// account is an admin account held in memory by the handler.
+type account struct {
+	hash []byte
+	role outline.Role
+}
+
+// accounts converts admin config to accounts keyed by username.
+func accounts(admins []Admin) (map[string]account, error) {
+	m := make(map[string]account, len(admins))
+	for _, admin := range admins {
+		if admin.Username == "" {
+			return nil, errors.New("admin without username")
+		}
+		if admin.Role == outline.RoleNone {
+			return nil, fmt.Errorf("admin %v has no role", admin.Username)
+		}
+		hash, err := decodeHash(admin.Password)
+		if err != nil {
+			return nil, fmt.Errorf("admin %v: %w", admin.Username, err)
+		}
+		m[admin.Username] = account{hash: hash, role: admin.Role}
+	}
+	return m, nil
+}
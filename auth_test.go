@@ -0,0 +1,79 @@
+package outline
+
+import (
+	"encoding/base64"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/imgk/caddy-outline-manager/outline"
+)
+
+func TestLegacyManagerFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), managerFile)
+	if err := os.WriteFile(name, []byte(`{"username":"admin","rawpass":"s3cret-pass"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadManagerFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Admins) != 1 || config.Admins[0].Username != "admin" || config.Admins[0].Role != outline.RoleOwner {
+		t.Fatalf("admins %+v, want the owner admin", config.Admins)
+	}
+	hash, err := decodeHash(config.Admins[0].Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword(hash, "s3cret-pass") {
+		t.Error("migrated hash does not match the password")
+	}
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "s3cret-pass") || strings.Contains(string(b), "rawpass") {
+		t.Errorf("file keeps the plaintext password: %s", b)
+	}
+	// the rewritten file loads as is
+	again, err := loadManagerFile(name)
+	if err != nil || len(again.Admins) != 1 || again.Admins[0].Password != config.Admins[0].Password {
+		t.Errorf("reloaded admins %+v, %v", again.Admins, err)
+	}
+}
+
+func TestDecodeHash(t *testing.T) {
+	hash := "$2a$04$7GUb4dN1KGdCBqUhJ7K6AuZfoB/6NqSRCzxEYJ.zv3/KzvHNcxLXe"
+	for _, encoded := range []string{hash, base64.StdEncoding.EncodeToString([]byte(hash))} {
+		if b, err := decodeHash(encoded); err != nil || string(b) != hash {
+			t.Errorf("decodeHash(%q) = %q, %v", encoded, b, err)
+		}
+	}
+	if _, err := decodeHash("plaintext"); err == nil {
+		t.Error("plaintext accepted as a hash")
+	}
+}
+
+func TestLogin(t *testing.T) {
+	m := newTestHandler(t)
+	for _, c := range []struct {
+		form string
+		code int
+	}{
+		{"user=operator&pass=operator", http.StatusOK},
+		{"user=operator&pass=owner", http.StatusUnauthorized},
+		{"user=operator&pass=", http.StatusUnauthorized},
+		{"user=nobody&pass=nobody", http.StatusUnauthorized},
+	} {
+		w := send(m, http.MethodPost, "/login", c.form, nil)
+		if w.Code != c.code {
+			t.Errorf("%v: got %v, want %v", c.form, w.Code, c.code)
+		}
+		if cookies := w.Result().Cookies(); (len(cookies) > 0) != (c.code == http.StatusOK) {
+			t.Errorf("%v: cookies %v", c.form, cookies)
+		}
+	}
+}
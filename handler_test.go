@@ -0,0 +1,99 @@
+package outline
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/imgk/caddy-outline-manager/outline"
+)
+
+// newTestHandler returns a Handler as provisioned with the admins owner,
+// operator and viewer, whose password is their name, managing the
+// servers a and b, which are never connected.
+func newTestHandler(t *testing.T) *Handler {
+	t.Helper()
+	logger := zap.NewNop()
+	m := &Handler{
+		StateFile: filepath.Join(t.TempDir(), managerFile),
+		logger:    logger,
+		mu:        &sync.RWMutex{},
+		accounts:  map[string]account{},
+		tokens:    map[string]*Token{},
+		tokenUse:  newTokenUse(),
+		// no saving of token uses in the background of the tests
+		tokensSaved: time.Now(),
+	}
+	for _, role := range []outline.Role{outline.RoleOwner, outline.RoleOperator, outline.RoleViewer} {
+		// the cost of `caddy hash-password` takes a second per check
+		hash, err := bcrypt.GenerateFromPassword([]byte(role.String()), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.accounts[role.String()] = account{hash: hash, role: role}
+	}
+	var err error
+	if m.sessions, err = newSessions(nil, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	servers := []*outline.OutlineServer{}
+	for _, id := range []string{"a", "b"} {
+		server, err := outline.NewOutlineServer(outline.Config{ID: id, APIURL: "https://192.0.2.1:1234/" + id, DisableSidecar: true}, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, server)
+	}
+	m.server = outline.NewServer(servers, logger)
+	m.server.SessionCookie = sessionCookie
+	t.Cleanup(m.server.Close)
+	m.setRouter()
+	return m
+}
+
+// send serves a request with a form body to m. auth is a session
+// cookie, an API token or empty.
+func send(m *Handler, method, path, form string, auth any) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(form))
+	if form != "" {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	switch auth := auth.(type) {
+	case *http.Cookie:
+		r.AddCookie(auth)
+	case string:
+		if auth != "" {
+			r.Header.Set("Authorization", "Bearer "+auth)
+		}
+	}
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		http.NotFound(w, r)
+		return nil
+	}))
+	return w
+}
+
+// loginAs logs user in with the password of newTestHandler and returns
+// the session cookie.
+func loginAs(t *testing.T, m *Handler, user string) *http.Cookie {
+	t.Helper()
+	w := send(m, http.MethodPost, "/login", "user="+user+"&pass="+user, nil)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			return c
+		}
+	}
+	t.Fatalf("login %v: got %v, no session cookie", user, w.Code)
+	return nil
+}
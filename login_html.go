@@ -77,7 +77,7 @@ var login = `<!DOCTYPE html>
   </style>
 </head>
 
-<body onload = "JavaScript:on_load();">
+<body>
   <div id="login">
     <h1>Outline Manager</h1>
     <input type="text" id="username" required="required" placeholder="Username" name="u"></input>
@@ -86,52 +86,24 @@ var login = `<!DOCTYPE html>
   </div>
 
   <script>
-    function getCookie(cname) {
-      var name = cname + "=";
-      var decodedCookie = decodeURIComponent(document.cookie);
-      var ca = decodedCookie.split(';');
-      for(var i = 0; i < ca.length; i++) {
-        var c = ca[i];
-        while (c.charAt(0) == ' ') {
-          c = c.substring(1);
-        }
-        if (c.indexOf(name) == 0) {
-          return c.substring(name.length, c.length);
-        }
-      }
-      return "";
-    }
-
-    function setCookie(cname, cvalue, exdays) {
-      var d = new Date();
-      d.setTime(d.getTime() + (exdays*24*60*60*1000));
-      var expires = "expires="+ d.toUTCString();
-      document.cookie = cname + "=" + cvalue + ";" + expires + ";path=/;SameSite=Lax";
-    }
-
-    function on_load() {
-      var outline = getCookie("outline");
-      if (outline != "") {
-        console.log(outline);
-        location.replace("/outline/manager");
-      }
-    }
-
     function login() {
       var user = document.getElementById("username").value;
       var pass = document.getElementById("password").value;
 
       var xmlHttp = new XMLHttpRequest();
       xmlHttp.onreadystatechange = function () {
-        if (this.readyState == 4 && this.status == 200) {
-          setCookie("outline", "manager", 30);
+        if (this.readyState != 4) {
+          return;
+        }
+        if (this.status == 200) {
           location.replace("/outline/manager");
         } else {
+          alert("Wrong username or password");
         }
       }
-      var url = document.URL + "/login?user=" + user + "&pass=" + pass
-      xmlHttp.open("POST", url, false);
-      xmlHttp.send(null);
+      xmlHttp.open("POST", "/login", false);
+      xmlHttp.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+      xmlHttp.send("user=" + encodeURIComponent(user) + "&pass=" + encodeURIComponent(pass));
     }
   </script>
 
@@ -7,18 +7,20 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"math/rand"
+	"io/fs"
 	"net/http"
-	"os"
-	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	caddycmd "github.com/caddyserver/caddy/v2/cmd"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 
+	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 
 	"github.com/imgk/caddy-outline-manager/outline"
@@ -29,17 +31,21 @@ func init() {
 
 	caddycmd.RegisterCommand(caddycmd.Command{
 		Name:  "outline",
-		Func:  cmdOutlineManager,
 		Usage: "<command> server",
 		Short: "Start Outline manager",
 		Long:  "",
-		Flags: func() *flag.FlagSet {
+		CobraFunc: func(cmd *cobra.Command) {
 			fs := flag.NewFlagSet("outline", flag.ExitOnError)
-			fs.String("server", "", "server url")
+			fs.String("server", "", "server url or access config")
+			fs.String("cert-sha256", "", "sha256 fingerprint of the server certificate")
+			fs.Bool("insecure", false, "skip verifying the server certificate")
+			fs.String("sidecar", "", "url of the go/manager sidecar, none to disable")
 			fs.String("username", "", "username")
 			fs.String("password", "", "password")
-			return fs
-		}(),
+			cmd.Flags().AddGoFlagSet(fs)
+			cmd.RunE = caddycmd.WrapCommandFuncForCobra(cmdOutlineManager)
+			cmd.AddCommand(sidecarCommand())
+		},
 	})
 }
 
@@ -54,9 +60,8 @@ var configTemplate = template.Must(template.New("").Parse(`{
                     "handle": [
                         {
                             "handler": "outline_manager",
-                            "servers": ["{{ .Servers }}"],
-                            "username": "{{ .Username }}",
-                            "password": "{{ .RawPass }}"
+                            "servers": {{ .Servers }},
+                            "state_file": {{ .StateFile }}
                         }
                     ]
                 }
@@ -71,58 +76,54 @@ func cmdOutlineManager(fl caddycmd.Flags) (int, error) {
 
 	user := fl.String("username")
 	pass := fl.String("password")
-	server := fl.String("server")
-
-	type UserPass struct {
-		Username string `json:"username"`
-		RawPass  string `json:"rawpass"`
-		Password string `json:"password"`
-		Servers  string `json:"_,omitempty"`
+	server, err := outline.ParseConfig(fl.String("server"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if cert := fl.String("cert-sha256"); cert != "" {
+		server.CertSHA256 = cert
 	}
-	userpass := UserPass{}
-	if user == "" || pass == "" {
-		b, err := ioutil.ReadFile("outline-manager.json")
+	server.InsecureSkipVerify = fl.Bool("insecure")
+	server.SetSidecar(fl.String("sidecar"))
+
+	// the admins, tokens and servers saved from the panel are read
+	// by Provision from managerFile in the working directory
+	if user != "" && pass != "" {
+		hash, err := hashPassword(pass)
 		if err != nil {
 			return caddy.ExitCodeFailedStartup, err
 		}
-		if err := json.Unmarshal(b, &userpass); err != nil {
-			return caddy.ExitCodeFailedStartup, err
-		}
-	} else {
-		userpass.Username = user
-		userpass.RawPass = pass
-
-		cmd := exec.Command(os.Args[0], "hash-password", "-plaintext", pass)
-		stdout, err := cmd.StdoutPipe()
+		// the flags replace the saved admins
+		err = updateManagerFile(managerFile, func(saved *managerConfig) {
+			saved.Admins = []Admin{{Username: user, Password: hash, Role: outline.RoleOwner}}
+		})
 		if err != nil {
 			return caddy.ExitCodeFailedStartup, err
 		}
-		defer stdout.Close()
-
-		sigCh := make(chan struct{})
-		errCh := make(chan error)
-		go func() {
-			sigCh <- struct{}{}
-			b, err := ioutil.ReadAll(stdout)
-			if err != nil {
-				errCh <- err
-			}
-			userpass.Password = string(b[:len(b)-1])
-			errCh <- nil
-		}()
+	} else if _, err := loadManagerFile(managerFile); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
 
-		<-sigCh
-		if err := cmd.Run(); err != nil {
-			return caddy.ExitCodeFailedStartup, err
-		}
-		if err := <-errCh; err != nil {
-			return caddy.ExitCodeFailedStartup, err
-		}
+	list := []outline.Config{}
+	if server.APIURL != "" {
+		list = append(list, server)
+	}
+	servers, err := json.Marshal(list)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	stateFile, err := json.Marshal(managerFile)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
 	}
 
+	type Config struct {
+		Servers   string
+		StateFile string
+	}
 	buffer := bytes.NewBuffer(nil)
-	userpass.Servers = server
-	if err := configTemplate.Execute(buffer, userpass); err != nil {
+	config := Config{Servers: string(servers), StateFile: string(stateFile)}
+	if err := configTemplate.Execute(buffer, config); err != nil {
 		return caddy.ExitCodeFailedStartup, err
 	}
 
@@ -146,12 +147,58 @@ func cmdOutlineManager(fl caddycmd.Flags) (int, error) {
 
 // Handler implements an HTTP handler that ...
 type Handler struct {
-	Servers  []string `json:"servers"`
-	Username string   `json:"username,omitempty"`
-	Password string   `json:"password,omitempty"`
-
-	logger *zap.Logger
-	server *outline.Server
+	Servers []outline.Config `json:"servers"`
+	// Admins are the accounts allowed to log in.
+	Admins []Admin `json:"admins,omitempty"`
+
+	// Username and Password configure a single owner account,
+	// kept for configs written before Admins existed.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// SessionKey signs session cookies. A random key is generated
+	// when empty, which logs everybody out on every config reload.
+	SessionKey string `json:"session_key,omitempty"`
+	// SessionTTL is how long a login stays valid. Default is 7 days.
+	SessionTTL caddy.Duration `json:"session_ttl,omitempty"`
+
+	// RefreshInterval is how often the keys of every server are fetched
+	// in the background. Default is 30s.
+	RefreshInterval caddy.Duration `json:"refresh_interval,omitempty"`
+
+	// TimeZone is the IANA name of the time zone of expiry dates,
+	// like Asia/Tokyo. Default is the local time zone.
+	TimeZone string `json:"time_zone,omitempty"`
+
+	// Tokens are the API tokens minted by admins.
+	Tokens []Token `json:"tokens,omitempty"`
+
+	// StorePath is the file keeping the expiries of keys. Default is
+	// outline-manager.db in the Caddy data directory.
+	StorePath string `json:"store_path,omitempty"`
+
+	// StateFile keeps the admins, tokens and servers changed from the
+	// panel. Saved admins replace those of the config, saved tokens and
+	// servers are added to them. Default is outline-manager.json in the
+	// Caddy data directory.
+	StateFile string `json:"state_file,omitempty"`
+
+	// Webhooks receive the events of keys.
+	Webhooks []outline.Webhook `json:"webhooks,omitempty"`
+	// ExpiringDays is how many days before its expiry a key is
+	// reported to webhooks as expiring. Default is 7.
+	ExpiringDays int `json:"expiring_days,omitempty"`
+
+	logger   *zap.Logger
+	server   *outline.Server
+	sessions *sessions
+	store    *outline.Store
+
+	mu          *sync.RWMutex
+	accounts    map[string]account
+	tokens      map[string]*Token
+	tokensSaved time.Time
+	tokenUse    *tokenUse
 }
 
 // CaddyModule returns the Caddy module information.
@@ -165,137 +212,481 @@ func (Handler) CaddyModule() caddy.ModuleInfo {
 // Provision implements caddy.Provisioner.
 func (m *Handler) Provision(ctx caddy.Context) (err error) {
 	m.logger = ctx.Logger(m)
+	m.mu = &sync.RWMutex{}
+	m.tokenUse = newTokenUse()
 
-	if len(m.Servers) == 0 {
-		err = errors.New("no server for outline manager")
-	}
-	m.logger.Info(fmt.Sprintf("set up username: %v, password: %v", m.Username, m.Password))
-
-	// Parse all server url
-	servers := map[uint32]*outline.OutlineServer{}
-	for _, url := range m.Servers {
-		id := rand.Uint32()
-		server := outline.NewOutlineServer(id, url, m.logger)
-		if err := server.GetServerInfo(); err != nil {
-			m.logger.Error(fmt.Sprintf("failed to get server info from server: %v, error: %v", url, err))
-			continue
-		}
-		if err := server.GetAllUser(); err != nil {
-			m.logger.Error(fmt.Sprintf("failed to get user from server: %v, error: %v", url, err))
-			continue
-		}
-		servers[id] = server
+	if m.StateFile == "" {
+		m.StateFile = filepath.Join(caddy.AppDataDir(), managerFile)
+	}
+	saved, err := loadManagerFile(m.StateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		saved, err = &managerConfig{}, nil
+	}
+	if err != nil {
+		return fmt.Errorf("state_file: %w", err)
+	}
 
-		m.logger.Info("http://127.0.0.1:80/outline/manager")
-		break
+	m.Servers = mergeServers(m.Servers, saved.Servers)
+	if len(m.Servers) == 0 {
+		return errors.New("no server for outline manager")
+	}
+	admins := m.Admins
+	if m.Username != "" {
+		admins = append(admins, Admin{Username: m.Username, Password: m.Password, Role: outline.RoleOwner})
+	}
+	if len(saved.Admins) > 0 {
+		admins = saved.Admins
+	}
+	if len(admins) == 0 {
+		return errors.New("no admin for outline manager")
+	}
+	m.accounts, err = accounts(admins)
+	if err != nil {
+		return
+	}
+	for _, admin := range admins {
+		m.logger.Info(fmt.Sprintf("set up admin: %v, role: %v", admin.Username, admin.Role))
+	}
+	m.tokens, err = tokens(append(m.Tokens, saved.Tokens...))
+	if err != nil {
+		return
 	}
 
-	if len(servers) == 0 {
-		err = errors.New("no available outline server")
+	m.sessions, err = newSessions([]byte(m.SessionKey), time.Duration(m.SessionTTL))
+	if err != nil {
 		return
 	}
+
+	// Parse all server config
+	ids := map[string]bool{}
+	servers := make([]*outline.OutlineServer, 0, len(m.Servers))
+	for _, config := range m.Servers {
+		if err := config.Validate(); err != nil {
+			return err
+		}
+		if config.ID != "" {
+			if ids[config.ID] {
+				return fmt.Errorf("duplicate server id: %v", config.ID)
+			}
+			ids[config.ID] = true
+		}
+		server, err := outline.NewOutlineServer(config, m.logger)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, server)
+	}
+	hooks := map[string]bool{}
+	for _, hook := range m.Webhooks {
+		if err := hook.Validate(); err != nil {
+			return err
+		}
+		if hooks[hook.ID] {
+			return fmt.Errorf("duplicate webhook id: %v", hook.ID)
+		}
+		hooks[hook.ID] = true
+	}
+	if m.ExpiringDays < 0 {
+		return fmt.Errorf("invalid expiring_days: %v", m.ExpiringDays)
+	}
+	if m.StorePath == "" {
+		m.StorePath = filepath.Join(caddy.AppDataDir(), storeFile)
+	}
+	m.store, err = openStore(m.StorePath)
+	if err != nil {
+		return fmt.Errorf("open store: %w", err)
+	}
+
 	m.server = outline.NewServer(servers, m.logger)
+	m.server.Store = m.store
+	m.server.SessionCookie = sessionCookie
+	m.server.Interval = time.Duration(m.RefreshInterval)
+	m.server.Webhooks = m.Webhooks
+	m.server.ExpiringDays = m.ExpiringDays
+	if m.TimeZone != "" {
+		if m.server.Location, err = time.LoadLocation(m.TimeZone); err != nil {
+			return fmt.Errorf("time_zone: %w", err)
+		}
+	}
+	m.server.OnAdd = func(config outline.Config) error {
+		return updateManagerFile(m.StateFile, func(saved *managerConfig) {
+			saved.Servers = append(saved.Servers, config)
+		})
+	}
+	if err := m.server.RegisterMetrics(ctx.GetMetricsRegistry()); err != nil {
+		// as with a second manager in the same config
+		m.logger.Warn(fmt.Sprintf("register metrics error: %v", err))
+	}
+	m.setRouter()
+	m.server.Connect(ctx)
+
+	m.logger.Info("http://127.0.0.1:80/outline/manager")
 	return
 }
 
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (m *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	if strings.HasPrefix(r.URL.Path, "/login") {
-		return m.Login(w, r)
+	switch r.URL.Path {
+	case "/login", "/logout", outline.SpecPath:
+		// public routes
+		m.server.ServeHTTP(w, r)
+		return nil
+	}
+	if strings.HasPrefix(r.URL.Path, outline.APIPath+"/") {
+		return m.ServeAPI(w, r)
+	}
+	if r.URL.Path != "/outline/manager" && !strings.HasPrefix(r.URL.Path, "/outline/manager/") {
+		return next.ServeHTTP(w, r)
 	}
-	if strings.HasPrefix(r.URL.Path, "/outline/manager/set/admin") {
-		return m.ChangeUserPass(w, r)
+
+	// every manager route requires a valid session or token of a known admin
+	c, ok := m.caller(r)
+	if !ok {
+		m.unauthorized(w, r)
+		return nil
 	}
-	if handler, ok := m.server.Handler(r); ok {
-		handler.ServeHTTP(w, r)
+	if c.token != nil && (strings.HasPrefix(r.URL.Path, outline.BasePath+"/set/admin") || strings.HasPrefix(r.URL.Path, outline.BasePath+"/tokens")) {
+		// tokens cannot mint more tokens nor change admins
+		http.Error(w, "not allowed for api tokens", http.StatusForbidden)
+		return nil
+	}
+	r = r.WithContext(c.context(r.Context()))
+
+	if _, ok := m.server.Handler(r); ok {
+		m.server.ServeHTTP(w, r)
 		return nil
 	}
 	return next.ServeHTTP(w, r)
 }
 
+// setRouter registers the routes served by m itself.
+func (m *Handler) setRouter() {
+	m.server.Handle(outline.Operation{
+		ID:      "showLogin",
+		Method:  http.MethodGet,
+		Path:    "/login",
+		Summary: "Show the login page",
+		HTML:    true,
+	}, m.handle(m.Login))
+	m.server.Handle(outline.Operation{
+		ID:      "login",
+		Method:  http.MethodPost,
+		Path:    "/login",
+		Summary: "Log in and set the session cookie",
+		Form:    []string{"user", "pass"},
+	}, m.handle(m.Login))
+	m.server.Handle(outline.Operation{
+		ID:      "logout",
+		Method:  http.MethodPost,
+		Path:    "/logout",
+		Summary: "Log out and drop the session cookie",
+	}, m.handle(m.Logout))
+	m.server.Handle(outline.Operation{
+		ID:       "listAdmins",
+		Method:   http.MethodGet,
+		Path:     outline.BasePath + "/set/admin",
+		Role:     outline.RoleOwner,
+		Summary:  "List the admins",
+		Response: []AdminEntry{},
+	}, m.handle(m.ListAdmins))
+	m.server.Handle(outline.Operation{
+		ID:      "changeAdmin",
+		Method:  http.MethodPost,
+		Path:    outline.BasePath + "/set/admin",
+		Role:    outline.RoleOwner,
+		Summary: "Create an admin or change the password and role of one",
+		Form:    []string{"user", "pass", "role"},
+	}, m.handle(m.ChangeUserPass))
+	m.server.Handle(outline.Operation{
+		ID:      "deleteAdmin",
+		Method:  http.MethodDelete,
+		Path:    outline.BasePath + "/set/admin",
+		Role:    outline.RoleOwner,
+		Summary: "Delete an admin",
+		Query:   []string{"user"},
+	}, m.handle(m.DeleteAdmin))
+	m.server.Handle(outline.Operation{
+		ID:       "listTokens",
+		Method:   http.MethodGet,
+		Path:     outline.BasePath + "/tokens",
+		Role:     outline.RoleViewer,
+		Summary:  "List the API tokens of the admin, of all admins for owners",
+		Response: []Token{},
+	}, m.handle(m.ListTokens))
+	m.server.Handle(outline.Operation{
+		ID:       "mintToken",
+		Method:   http.MethodPost,
+		Path:     outline.BasePath + "/tokens",
+		Role:     outline.RoleViewer,
+		Summary:  "Mint an API token, scope is read or write",
+		Form:     []string{"label", "scope", "server"},
+		Response: NewToken{},
+		Status:   http.StatusCreated,
+	}, m.handle(m.MintToken))
+	m.server.Handle(outline.Operation{
+		ID:      "labelToken",
+		Method:  http.MethodPut,
+		Path:    outline.BasePath + "/tokens/{id}",
+		Role:    outline.RoleViewer,
+		Summary: "Change the label of an API token",
+		Form:    []string{"label"},
+	}, m.handle(m.LabelToken))
+	m.server.Handle(outline.Operation{
+		ID:      "revokeToken",
+		Method:  http.MethodDelete,
+		Path:    outline.BasePath + "/tokens/{id}",
+		Role:    outline.RoleViewer,
+		Summary: "Revoke an API token",
+	}, m.handle(m.RevokeToken))
+	m.server.Handle(outline.Operation{
+		ID:      "addServerConfig",
+		Method:  http.MethodPost,
+		Path:    outline.BasePath + "/servers",
+		Role:    outline.RoleOwner,
+		Summary: "Add a server from its access config",
+		Form:    []string{"config", "id", "label", "sidecar"},
+		Status:  http.StatusCreated,
+	}, m.handle(m.AddServer))
+}
+
+// handle adapts a handler of m to the router of m.server.
+func (m *Handler) handle(h func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := h(w, r); err != nil {
+			m.logger.Error(fmt.Sprintf("handle %v %v error: %v", r.Method, r.URL.Path, err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	}
+}
+
+// ServeAPI serves the JSON API to logged in admins.
+func (m *Handler) ServeAPI(w http.ResponseWriter, r *http.Request) error {
+	c, ok := m.caller(r)
+	if !ok {
+		outline.WriteError(w, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		return nil
+	}
+	r = r.WithContext(c.context(r.Context()))
+
+	if _, ok := m.server.Handler(r); !ok {
+		outline.WriteError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return nil
+	}
+	m.server.ServeHTTP(w, r)
+	return nil
+}
+
+// unauthorized sends page loads to the login page and rejects api calls.
+func (m *Handler) unauthorized(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// Cleanup implements caddy.CleanerUpper. It stops refreshing servers.
+func (m *Handler) Cleanup() error {
+	if m.server != nil {
+		m.server.Close()
+	}
+	if m.store != nil {
+		if _, err := stores.Delete(m.StorePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Interface guards
 var (
+	_ caddy.Provisioner           = (*Handler)(nil)
+	_ caddy.CleanerUpper          = (*Handler)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Handler)(nil)
 )
 
 func (m *Handler) Login(w http.ResponseWriter, r *http.Request) error {
 	switch r.Method {
 	case http.MethodGet:
+		if _, err := m.sessions.user(r); err == nil {
+			http.Redirect(w, r, "/outline/manager", http.StatusSeeOther)
+			return nil
+		}
 		io.WriteString(w, login)
 		return nil
 	case http.MethodPost:
-		user := r.URL.Query().Get("user")
-		pass := r.URL.Query().Get("pass")
+		user := r.FormValue("user")
+		pass := r.FormValue("pass")
 		if user != "" && pass != "" {
-			m.logger.Info(fmt.Sprintf("try with %v: %v", user, pass))
-			if user == m.Username && pass == m.Password {
+			m.logger.Info(fmt.Sprintf("try login with %v", user))
+			m.mu.RLock()
+			acc := m.accounts[user]
+			m.mu.RUnlock()
+			if checkPassword(acc.hash, pass) {
+				m.sessions.issue(w, r, user)
 				w.WriteHeader(http.StatusOK)
 				return nil
 			}
 		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil
 	default:
 	}
 	http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
 	return nil
 }
 
-func (m *Handler) ChangeUserPass(w http.ResponseWriter, r *http.Request) error {
+// Logout drops the session cookie of the client.
+func (m *Handler) Logout(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != http.MethodPost {
+		http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
 		return nil
 	}
+	m.sessions.clear(w, r)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
 
-	user := r.URL.Query().Get("user")
-	pass := r.URL.Query().Get("pass")
-	if user == "" || pass == "" {
-		m.logger.Info("no user password for change")
+// AddServer starts managing the server of an Outline access config
+// and saves it to the state file.
+func (m *Handler) AddServer(w http.ResponseWriter, r *http.Request) error {
+	config, err := outline.ParseConfig(r.FormValue("config"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return nil
 	}
-	m.Username = user
-	m.Password = pass
+	config.ID = r.FormValue("id")
+	config.Label = r.FormValue("label")
+	config.SetSidecar(r.FormValue("sidecar"))
 
-	m.logger.Info(fmt.Sprintf("change user pass to %v: %v", user, pass))
-
-	type UserPass struct {
-		Username string `json:"username"`
-		RawPass  string `json:"rawpass"`
-		Password string `json:"password"`
+	server, err := m.server.Add(r.Context(), config)
+	if err != nil {
+		m.logger.Error(fmt.Sprintf("add server %v error: %v", config.APIURL, err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
 	}
-	userpass := &UserPass{Username: user, RawPass: pass, Password: ""}
+	w.Header().Set("Location", server.Prefix())
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
 
-	cmd := exec.Command(os.Args[0], "hash-password", "-plaintext", pass)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
+// AdminEntry is an admin listed by ListAdmins.
+type AdminEntry struct {
+	Username string       `json:"username"`
+	Role     outline.Role `json:"role"`
+}
+
+// ListAdmins writes the usernames and roles of all admins as JSON.
+func (m *Handler) ListAdmins(w http.ResponseWriter, r *http.Request) error {
+	m.mu.RLock()
+	entries := make([]AdminEntry, 0, len(m.accounts))
+	for user, acc := range m.accounts {
+		entries = append(entries, AdminEntry{Username: user, Role: acc.role})
 	}
-	defer stdout.Close()
+	m.mu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Username < entries[j].Username })
 
-	sigCh := make(chan struct{})
-	errCh := make(chan error)
-	go func() {
-		sigCh <- struct{}{}
-		b, err := ioutil.ReadAll(stdout)
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(entries)
+}
+
+// ChangeUserPass creates an admin or updates the password and role of one.
+// An empty password keeps the current one, an empty role keeps the current
+// role and defaults to viewer for new admins.
+func (m *Handler) ChangeUserPass(w http.ResponseWriter, r *http.Request) error {
+	user := r.FormValue("user")
+	pass := r.FormValue("pass")
+	if user == "" {
+		m.logger.Info("no user for change")
+		http.Error(w, "missing user", http.StatusBadRequest)
+		return nil
+	}
+	role := outline.RoleNone
+	if name := r.FormValue("role"); name != "" {
+		var err error
+		if role, err = outline.ParseRole(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+	}
+	var hash []byte
+	if pass != "" {
+		str, err := hashPassword(pass)
 		if err != nil {
-			errCh <- err
+			return err
 		}
-		userpass.Password = string(b[:len(b)-1])
-		errCh <- nil
-	}()
+		hash = []byte(str)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	<-sigCh
-	if err := cmd.Run(); err != nil {
-		return err
+	acc, ok := m.accounts[user]
+	if !ok && hash == nil {
+		http.Error(w, "missing password", http.StatusBadRequest)
+		return nil
 	}
-	if err := <-errCh; err != nil {
-		return err
+	if !ok {
+		acc.role = outline.RoleViewer
 	}
+	if hash != nil {
+		acc.hash = hash
+	}
+	if role != outline.RoleNone {
+		if acc.role == outline.RoleOwner && role != outline.RoleOwner && m.owners() == 1 {
+			http.Error(w, "cannot demote the last owner", http.StatusBadRequest)
+			return nil
+		}
+		acc.role = role
+	}
+	m.accounts[user] = acc
 
-	b, err := json.Marshal(&userpass)
-	if err != nil {
-		return err
+	m.logger.Info(fmt.Sprintf("change admin %v with role %v", user, acc.role))
+
+	return m.saveAccounts()
+}
+
+// DeleteAdmin removes an admin. The last owner cannot be removed.
+func (m *Handler) DeleteAdmin(w http.ResponseWriter, r *http.Request) error {
+	user := r.URL.Query().Get("user")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	acc, ok := m.accounts[user]
+	if !ok {
+		http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
+		return nil
 	}
-	if err := ioutil.WriteFile("outline-manager.json", b, 0644); err != nil {
-		return err
+	if acc.role == outline.RoleOwner && m.owners() == 1 {
+		http.Error(w, "cannot delete the last owner", http.StatusBadRequest)
+		return nil
 	}
+	delete(m.accounts, user)
 
-	return nil
+	m.logger.Info(fmt.Sprintf("delete admin %v", user))
+
+	return m.saveAccounts()
+}
+
+// owners counts the admins with the owner role. m.mu must be held.
+func (m *Handler) owners() (n int) {
+	for _, acc := range m.accounts {
+		if acc.role == outline.RoleOwner {
+			n++
+		}
+	}
+	return
+}
+
+// saveAccounts writes all admins to the state file. m.mu must be held.
+func (m *Handler) saveAccounts() error {
+	admins := make([]Admin, 0, len(m.accounts))
+	for user, acc := range m.accounts {
+		admins = append(admins, Admin{Username: user, Password: string(acc.hash), Role: acc.role})
+	}
+	sort.Slice(admins, func(i, j int) bool { return admins[i].Username < admins[j].Username })
+	return updateManagerFile(m.StateFile, func(config *managerConfig) {
+		config.Admins = admins
+	})
 }
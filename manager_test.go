@@ -0,0 +1,60 @@
+package outline
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/imgk/caddy-outline-manager/outline"
+)
+
+func TestAdminRoutes(t *testing.T) {
+	m := newTestHandler(t)
+	owner := loginAs(t, m, "owner")
+	admin := outline.BasePath + "/set/admin"
+
+	for _, c := range []struct {
+		user   string
+		method string
+		path   string
+		form   string
+		code   int
+	}{
+		// only owners change admins
+		{"viewer", http.MethodGet, admin, "", http.StatusForbidden},
+		{"viewer", http.MethodPost, admin, "user=viewer&role=owner", http.StatusForbidden},
+		{"operator", http.MethodPost, admin, "user=operator&role=owner", http.StatusForbidden},
+		{"viewer", http.MethodDelete, admin + "?user=owner", "", http.StatusForbidden},
+		// roles are checked
+		{"owner", http.MethodPost, admin, "user=viewer&role=root", http.StatusBadRequest},
+		{"owner", http.MethodPost, admin, "user=new", http.StatusBadRequest},
+		// the last owner stays
+		{"owner", http.MethodPost, admin, "user=owner&role=operator", http.StatusBadRequest},
+		{"owner", http.MethodDelete, admin + "?user=owner", "", http.StatusBadRequest},
+		{"owner", http.MethodDelete, admin + "?user=nobody", "", http.StatusNotFound},
+		// with a second owner it may go
+		{"owner", http.MethodPost, admin, "user=operator&role=owner", http.StatusOK},
+		{"owner", http.MethodPost, admin, "user=owner&role=viewer", http.StatusOK},
+	} {
+		cookie := owner
+		if c.user != "owner" {
+			cookie = loginAs(t, m, c.user)
+		}
+		if w := send(m, c.method, c.path, c.form, cookie); w.Code != c.code {
+			t.Errorf("%v %v %v as %v: got %v, want %v: %v", c.method, c.path, c.form, c.user, w.Code, c.code, w.Body)
+		}
+	}
+
+	want := map[string]outline.Role{"owner": outline.RoleViewer, "operator": outline.RoleOwner, "viewer": outline.RoleViewer}
+	config, err := loadManagerFile(m.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Admins) != len(want) {
+		t.Fatalf("saved admins %+v", config.Admins)
+	}
+	for _, admin := range config.Admins {
+		if want[admin.Username] != admin.Role {
+			t.Errorf("saved admin %v with role %v, want %v", admin.Username, admin.Role, want[admin.Username])
+		}
+	}
+}
@@ -0,0 +1,395 @@
+// Package api is a client of the Outline server management API
+// and of the go/manager sidecar of customized Outline servers.
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrKeyNotFound is returned when the access key does not exist.
+	ErrKeyNotFound = errors.New("access key inexistent")
+	// ErrInvalidLimit is returned when a data limit is rejected.
+	ErrInvalidLimit = errors.New("invalid data limit")
+	// ErrUnauthorized is returned when the secret of the API URL is wrong.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrInvalidArgument is returned when a name, hostname or port is rejected.
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrPortInUse is returned when the port for new keys is already used.
+	ErrPortInUse = errors.New("port already in use")
+	// ErrKeyExists is returned when creating a key with an id already used.
+	ErrKeyExists = errors.New("access key already exists")
+	// ErrNoSidecar is returned for sidecar calls on a server without one.
+	ErrNoSidecar = errors.New("no go/manager sidecar for this server")
+)
+
+// StatusError is returned when the server answers an unexpected status code.
+type StatusError struct {
+	Method string
+	Path   string
+	Code   int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%v %v: status code error, code: %v", e.Method, e.Path, e.Code)
+}
+
+const (
+	// DefaultTimeout bounds a single request, retries excluded.
+	DefaultTimeout = 10 * time.Second
+	// DefaultRetries is how many times idempotent calls are retried.
+	DefaultRetries = 2
+)
+
+// requester sends JSON requests, shared by Client and SidecarClient.
+type requester struct {
+	base    string
+	client  *http.Client
+	timeout time.Duration
+	retries int
+}
+
+// statusErrors maps status codes to the typed error of a call.
+type statusErrors map[int]error
+
+// do sends a request with body encoded as JSON, expects the status code
+// want and decodes the response into out when it is not nil.
+// GET, PUT and DELETE requests are retried with backoff on network errors
+// and server errors.
+func (c *requester) do(ctx context.Context, method, path string, body, out any, want int, errs statusErrors) error {
+	retries := 0
+	switch method {
+	case http.MethodGet, http.MethodPut, http.MethodDelete:
+		retries = c.retries
+	}
+	return c.retry(ctx, retries, method, path, body, out, want, errs)
+}
+
+// doOnce is do without retries, for calls which must not be repeated
+// after the server may have applied them, like creating a key.
+func (c *requester) doOnce(ctx context.Context, method, path string, body, out any, want int, errs statusErrors) error {
+	return c.retry(ctx, 0, method, path, body, out, want, errs)
+}
+
+func (c *requester) retry(ctx context.Context, retries int, method, path string, body, out any, want int, errs statusErrors) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	delay := 200 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := c.once(ctx, method, path, b, out, want, errs)
+		if err == nil || attempt >= retries || !temporary(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (c *requester) once(ctx context.Context, method, path string, body []byte, out any, want int, errs statusErrors) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	r, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != want {
+		io.Copy(io.Discard, r.Body)
+		if err, ok := errs[r.StatusCode]; ok {
+			return err
+		}
+		err := &StatusError{Method: method, Path: path, Code: r.StatusCode}
+		if r.StatusCode == http.StatusUnauthorized || r.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+		}
+		return err
+	}
+	if out == nil {
+		io.Copy(io.Discard, r.Body)
+		return nil
+	}
+	return json.NewDecoder(r.Body).Decode(out)
+}
+
+// temporary reports whether a failed call is worth retrying: only
+// transport errors and server errors are, not typed errors of the API
+// nor responses that fail to decode.
+func temporary(err error) bool {
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.Code >= http.StatusInternalServerError
+	}
+	var transport *url.Error
+	return errors.As(err, &transport) && !errors.Is(err, context.Canceled)
+}
+
+// Management is the Outline server management API.
+type Management interface {
+	GetServer(ctx context.Context) (*ServerInfo, error)
+	RenameServer(ctx context.Context, name string) error
+	SetHostname(ctx context.Context, hostname string) error
+	SetPortForNewAccessKeys(ctx context.Context, port int) error
+	SetDefaultDataLimit(ctx context.Context, bytes uint64) error
+	RemoveDefaultDataLimit(ctx context.Context) error
+	SetMetricsEnabled(ctx context.Context, enabled bool) error
+
+	ListAccessKeys(ctx context.Context) ([]*AccessKey, error)
+	GetAccessKey(ctx context.Context, id string) (*AccessKey, error)
+	CreateAccessKey(ctx context.Context, key NewAccessKey) (*AccessKey, error)
+	DeleteAccessKey(ctx context.Context, id string) error
+	RenameAccessKey(ctx context.Context, id, name string) error
+	SetDataLimit(ctx context.Context, id string, bytes uint64) error
+	RemoveDataLimit(ctx context.Context, id string) error
+
+	GetTransfer(ctx context.Context) (map[string]uint64, error)
+}
+
+// Client talks to the management API at an Outline apiUrl like
+// https://127.0.0.1:56298/QQR9pcgCRP_g5OLX3n-w-g
+type Client struct {
+	requester
+}
+
+// NewClient returns a client of the API at baseURL. The http client
+// carries the TLS settings, see the certificate pinning of the config.
+func NewClient(baseURL string, client *http.Client) *Client {
+	return &Client{requester{
+		base:    strings.TrimSuffix(baseURL, "/"),
+		client:  client,
+		timeout: DefaultTimeout,
+		retries: DefaultRetries,
+	}}
+}
+
+// {
+// "name":"Outline Server",
+// "serverId":"7fda0079-5317-4e5a-bb41-5a431dddae21",
+// "metricsEnabled":true,
+// "createdTimestampMs":1536613192052,
+// "version":"1.7.0",
+// "accessKeyDataLimit":{"bytes":8589934592},
+// "portForNewAccessKeys":1234,
+// "hostnameForAccessKeys":"example.com"
+// }
+type ServerInfo struct {
+	Name                  string     `json:"name"`
+	ServerID              string     `json:"serverId"`
+	MetricsEnabled        bool       `json:"metricsEnabled"`
+	CreatedTimestampMs    uint64     `json:"createdTimestampMs"`
+	Version               string     `json:"version,omitempty"`
+	AccessKeyDataLimit    *DataLimit `json:"accessKeyDataLimit,omitempty"`
+	PortForNewAccessKeys  int        `json:"portForNewAccessKeys"`
+	HostnameForAccessKeys string     `json:"hostnameForAccessKeys,omitempty"`
+}
+
+// {
+// "id":"3",
+// "name":"",
+// "password":"5PgTilMvdrhK",
+// "port":61081,
+// "method":"chacha20-ietf-poly1305",
+// "accessUrl":"ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTo1UGdUaWxNdmRyaEs=@18.182.68.185:61081/?outline=1"
+// }
+type AccessKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Password  string     `json:"password"`
+	Port      int        `json:"port"`
+	Method    string     `json:"method"`
+	AccessURL string     `json:"accessUrl"`
+	DataLimit *DataLimit `json:"dataLimit,omitempty"`
+}
+
+// DataLimit is a data transfer limit in bytes.
+type DataLimit struct {
+	Bytes uint64 `json:"bytes"`
+}
+
+var keyErrors = statusErrors{http.StatusNotFound: ErrKeyNotFound}
+
+// GetServer: curl -X GET baseurl/server
+func (c *Client) GetServer(ctx context.Context) (*ServerInfo, error) {
+	info := &ServerInfo{}
+	if err := c.do(ctx, http.MethodGet, "/server", nil, info, http.StatusOK, nil); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+var argumentErrors = statusErrors{http.StatusBadRequest: ErrInvalidArgument}
+
+// RenameServer: curl -X PUT baseurl/name -d '{"name":"..."}'
+func (c *Client) RenameServer(ctx context.Context, name string) error {
+	type Name struct {
+		Name string `json:"name"`
+	}
+	return c.do(ctx, http.MethodPut, "/name", Name{Name: name}, nil, http.StatusNoContent, argumentErrors)
+}
+
+// SetHostname: curl -X PUT baseurl/server/hostname-for-access-keys -d '{"hostname":"..."}'
+func (c *Client) SetHostname(ctx context.Context, hostname string) error {
+	type Hostname struct {
+		Hostname string `json:"hostname"`
+	}
+	return c.do(ctx, http.MethodPut, "/server/hostname-for-access-keys", Hostname{Hostname: hostname}, nil, http.StatusNoContent, argumentErrors)
+}
+
+// SetPortForNewAccessKeys: curl -X PUT baseurl/server/port-for-new-access-keys -d '{"port":...}'
+func (c *Client) SetPortForNewAccessKeys(ctx context.Context, port int) error {
+	type Port struct {
+		Port int `json:"port"`
+	}
+	errs := statusErrors{http.StatusBadRequest: ErrInvalidArgument, http.StatusConflict: ErrPortInUse}
+	return c.do(ctx, http.MethodPut, "/server/port-for-new-access-keys", Port{Port: port}, nil, http.StatusNoContent, errs)
+}
+
+// SetDefaultDataLimit: curl -X PUT baseurl/server/access-key-data-limit -d '{"limit":{"bytes":...}}'
+func (c *Client) SetDefaultDataLimit(ctx context.Context, bytes uint64) error {
+	type Limit struct {
+		Limit DataLimit `json:"limit"`
+	}
+	errs := statusErrors{http.StatusBadRequest: ErrInvalidLimit}
+	return c.do(ctx, http.MethodPut, "/server/access-key-data-limit", Limit{Limit: DataLimit{Bytes: bytes}}, nil, http.StatusNoContent, errs)
+}
+
+// RemoveDefaultDataLimit: curl -X DELETE baseurl/server/access-key-data-limit
+func (c *Client) RemoveDefaultDataLimit(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, "/server/access-key-data-limit", nil, nil, http.StatusNoContent, nil)
+}
+
+// SetMetricsEnabled: curl -X PUT baseurl/metrics/enabled -d '{"metricsEnabled":true}'
+func (c *Client) SetMetricsEnabled(ctx context.Context, enabled bool) error {
+	type Metrics struct {
+		MetricsEnabled bool `json:"metricsEnabled"`
+	}
+	return c.do(ctx, http.MethodPut, "/metrics/enabled", Metrics{MetricsEnabled: enabled}, nil, http.StatusNoContent, argumentErrors)
+}
+
+// ListAccessKeys: curl -X GET baseurl/access-keys
+func (c *Client) ListAccessKeys(ctx context.Context) ([]*AccessKey, error) {
+	type Keys struct {
+		AccessKeys []*AccessKey `json:"accessKeys"`
+	}
+	keys := Keys{}
+	if err := c.do(ctx, http.MethodGet, "/access-keys", nil, &keys, http.StatusOK, nil); err != nil {
+		return nil, err
+	}
+	return keys.AccessKeys, nil
+}
+
+// GetAccessKey: curl -X GET baseurl/access-keys/{id}
+func (c *Client) GetAccessKey(ctx context.Context, id string) (*AccessKey, error) {
+	key := &AccessKey{}
+	if err := c.do(ctx, http.MethodGet, "/access-keys/"+url.PathEscape(id), nil, key, http.StatusOK, keyErrors); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// NewAccessKey are the optional settings of a new access key.
+// Zero values let the server choose.
+type NewAccessKey struct {
+	// ID creates the key with PUT /access-keys/{id} instead of POST.
+	ID       string     `json:"-"`
+	Name     string     `json:"name,omitempty"`
+	Method   string     `json:"method,omitempty"`
+	Password string     `json:"password,omitempty"`
+	Port     int        `json:"port,omitempty"`
+	Limit    *DataLimit `json:"limit,omitempty"`
+}
+
+// CreateAccessKey: curl -X POST baseurl/access-keys -d '{"name":"...","method":"aes-192-gcm"}'
+// or with an id: curl -X PUT baseurl/access-keys/{id} -d '{...}'
+func (c *Client) CreateAccessKey(ctx context.Context, opts NewAccessKey) (*AccessKey, error) {
+	method, path := http.MethodPost, "/access-keys"
+	if opts.ID != "" {
+		method, path = http.MethodPut, "/access-keys/"+url.PathEscape(opts.ID)
+	}
+	errs := statusErrors{http.StatusBadRequest: ErrInvalidArgument, http.StatusConflict: ErrKeyExists}
+	key := &AccessKey{}
+	// never retried: a key created by a lost response would be
+	// created twice, or fail with ErrKeyExists.
+	if err := c.doOnce(ctx, method, path, opts, key, http.StatusCreated, errs); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DeleteAccessKey: curl -X DELETE baseurl/access-keys/{id}
+func (c *Client) DeleteAccessKey(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/access-keys/"+url.PathEscape(id), nil, nil, http.StatusNoContent, keyErrors)
+}
+
+// RenameAccessKey: curl -X PUT baseurl/access-keys/{id}/name -d '{"name":"..."}'
+func (c *Client) RenameAccessKey(ctx context.Context, id, name string) error {
+	type Name struct {
+		Name string `json:"name"`
+	}
+	return c.do(ctx, http.MethodPut, "/access-keys/"+url.PathEscape(id)+"/name", Name{Name: name}, nil, http.StatusNoContent, keyErrors)
+}
+
+// SetDataLimit: curl -X PUT baseurl/access-keys/{id}/data-limit -d '{"limit":{"bytes":...}}'
+func (c *Client) SetDataLimit(ctx context.Context, id string, bytes uint64) error {
+	type Limit struct {
+		Limit DataLimit `json:"limit"`
+	}
+	errs := statusErrors{http.StatusNotFound: ErrKeyNotFound, http.StatusBadRequest: ErrInvalidLimit}
+	return c.do(ctx, http.MethodPut, "/access-keys/"+url.PathEscape(id)+"/data-limit", Limit{Limit: DataLimit{Bytes: bytes}}, nil, http.StatusNoContent, errs)
+}
+
+// RemoveDataLimit: curl -X DELETE baseurl/access-keys/{id}/data-limit
+func (c *Client) RemoveDataLimit(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/access-keys/"+url.PathEscape(id)+"/data-limit", nil, nil, http.StatusNoContent, keyErrors)
+}
+
+// GetTransfer: curl -X GET baseurl/metrics/transfer
+// returns the bytes transferred by each access key.
+func (c *Client) GetTransfer(ctx context.Context) (map[string]uint64, error) {
+	type BytesTransferred struct {
+		ByUserID map[string]uint64 `json:"bytesTransferredByUserId"`
+	}
+	used := BytesTransferred{}
+	if err := c.do(ctx, http.MethodGet, "/metrics/transfer", nil, &used, http.StatusOK, nil); err != nil {
+		return nil, err
+	}
+	if used.ByUserID == nil {
+		used.ByUserID = make(map[string]uint64)
+	}
+	return used.ByUserID, nil
+}
+
+// Interface guards
+var (
+	_ Management = (*Client)(nil)
+)
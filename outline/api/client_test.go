@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// counting serves every request with handler and counts them.
+func counting(t *testing.T, handler http.HandlerFunc) (*Client, *atomic.Int32) {
+	t.Helper()
+	n := &atomic.Int32{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return NewClient(srv.URL, srv.Client()), n
+}
+
+func TestRetryServerError(t *testing.T) {
+	c, n := counting(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	if _, err := c.ListAccessKeys(context.Background()); err == nil {
+		t.Fatal("ListAccessKeys: want error")
+	}
+	if got, want := n.Load(), int32(DefaultRetries+1); got != want {
+		t.Errorf("GET sent %v times, want %v", got, want)
+	}
+}
+
+func TestNoRetryDecodeError(t *testing.T) {
+	c, n := counting(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{not json"))
+	})
+	if _, err := c.ListAccessKeys(context.Background()); err == nil {
+		t.Fatal("ListAccessKeys: want error")
+	}
+	if got := n.Load(); got != 1 {
+		t.Errorf("GET sent %v times, want 1", got)
+	}
+}
+
+func TestNoRetryTypedError(t *testing.T) {
+	c, n := counting(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	if err := c.RenameAccessKey(context.Background(), "1", "x"); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("RenameAccessKey: %v, want ErrKeyNotFound", err)
+	}
+	if got := n.Load(); got != 1 {
+		t.Errorf("PUT sent %v times, want 1", got)
+	}
+}
+
+func TestNoRetryCreate(t *testing.T) {
+	c, n := counting(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	for _, opts := range []NewAccessKey{{}, {ID: "7"}} {
+		n.Store(0)
+		if _, err := c.CreateAccessKey(context.Background(), opts); err == nil {
+			t.Fatalf("CreateAccessKey(%+v): want error", opts)
+		}
+		if got := n.Load(); got != 1 {
+			t.Errorf("CreateAccessKey(%+v) sent %v times, want 1", opts, got)
+		}
+	}
+}
+
+func TestRetryTransportError(t *testing.T) {
+	c, n := counting(t, func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+	if _, err := c.GetTransfer(context.Background()); err == nil {
+		t.Fatal("GetTransfer: want error")
+	}
+	if got, want := n.Load(), int32(DefaultRetries+1); got != want {
+		t.Errorf("GET sent %v times, want %v", got, want)
+	}
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Sidecar is the go/manager API of customized Outline servers,
+// which changes key status and sets the deadline of keys.
+// Package sidecar is an implementation of it.
+type Sidecar interface {
+	ListUsers(ctx context.Context) ([]*GoUser, error)
+	ToggleUser(ctx context.Context, id string) error
+	SetDeadline(ctx context.Context, id string, days int) error
+	SetLimit(ctx context.Context, id string, gb int) error
+}
+
+// GoUser is the state of an access key in the go/manager API,
+// listed by GET baseurl/go/manager as
+//
+//	{"status": [{"id": "1", "ip": "203.0.113.7", "enabled": true, "online": true, "days_left": 30, "limit": 50}]}
+type GoUser struct {
+	// ID is the id of the access key in the Outline server.
+	ID string `json:"id"`
+	// IP is the address of the last client of the key, null when unknown.
+	IP net.IP `json:"ip"`
+	// Enabled is false while the key is turned off, by PATCH or by its deadline.
+	Enabled bool `json:"enabled"`
+	// Online is true while the key carries traffic.
+	Online bool `json:"online"`
+	// DaysLeft is the number of days until the deadline, rounded up,
+	// 0 when there is none.
+	DaysLeft int `json:"days_left"`
+	// Limit is the data limit in GB, 0 when there is none.
+	Limit int `json:"limit"`
+}
+
+// SidecarClient talks to the go/manager API at baseURL.
+type SidecarClient struct {
+	requester
+}
+
+func NewSidecarClient(baseURL string, client *http.Client) *SidecarClient {
+	return &SidecarClient{requester{
+		base:    strings.TrimSuffix(baseURL, "/") + "/go/manager",
+		client:  client,
+		timeout: DefaultTimeout,
+		retries: DefaultRetries,
+	}}
+}
+
+// ListUsers: curl -X GET baseurl/go/manager
+func (c *SidecarClient) ListUsers(ctx context.Context) ([]*GoUser, error) {
+	type Status struct {
+		Status []*GoUser `json:"status"`
+	}
+	status := Status{}
+	if err := c.do(ctx, http.MethodGet, "", nil, &status, http.StatusOK, nil); err != nil {
+		return nil, err
+	}
+	return status.Status, nil
+}
+
+// ToggleUser: curl -X PATCH baseurl/go/manager?id={id}
+func (c *SidecarClient) ToggleUser(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPatch, "?id="+url.QueryEscape(id), nil, nil, http.StatusOK, statusErrors{
+		http.StatusNotFound: ErrKeyNotFound,
+	})
+}
+
+// SetDeadline: curl -X PUT baseurl/go/manager?id={id}&deadline={days}
+func (c *SidecarClient) SetDeadline(ctx context.Context, id string, days int) error {
+	return c.do(ctx, http.MethodPut, "?id="+url.QueryEscape(id)+"&deadline="+strconv.Itoa(days), nil, nil, http.StatusOK, statusErrors{
+		http.StatusBadRequest: ErrInvalidArgument,
+		http.StatusNotFound:   ErrKeyNotFound,
+	})
+}
+
+// SetLimit: curl -X POST baseurl/go/manager?id={id}&limit={gb}
+func (c *SidecarClient) SetLimit(ctx context.Context, id string, gb int) error {
+	return c.do(ctx, http.MethodPost, "?id="+url.QueryEscape(id)+"&limit="+strconv.Itoa(gb), nil, nil, http.StatusOK, statusErrors{
+		http.StatusBadRequest: ErrInvalidLimit,
+		http.StatusNotFound:   ErrKeyNotFound,
+	})
+}
+
+// Interface guards
+var (
+	_ Sidecar = (*SidecarClient)(nil)
+)
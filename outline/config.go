@@ -0,0 +1,205 @@
+package outline
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Config declares an Outline server to manage. It is written either as
+// an object, as the plain API URL string like in older configs, or as the
+// access config printed by the Outline installer, itself or in a string.
+//
+//	{"id": "tokyo-1", "api_url": "https://1.2.3.4:56298/QQR9pcgCRP_g5OLX3n-w-g", "label": "Tokyo"}
+//	{"apiUrl": "https://1.2.3.4:56298/QQR9pcgCRP_g5OLX3n-w-g", "certSha256": "68A5..."}
+type Config struct {
+	// ID names the server in routes and logs. When empty the serverId
+	// reported by the Outline server is used once it is reachable.
+	ID string `json:"id,omitempty"`
+	// APIURL is the apiUrl of the Outline management API.
+	APIURL string `json:"api_url"`
+	// Label is shown in the panel. Defaults to the Outline server name.
+	Label string `json:"label,omitempty"`
+
+	// CertSHA256 is the certSha256 of the Outline access config, the hex
+	// SHA-256 fingerprint of the self-signed certificate of the API.
+	// The connection fails when the certificate does not match.
+	CertSHA256 string `json:"cert_sha256,omitempty"`
+	// InsecureSkipVerify disables certificate verification altogether.
+	// It is ignored when CertSHA256 is set.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+
+	// SidecarURL is the base URL of the go/manager sidecar. It defaults
+	// to plain http on the port of the API plus one. While the sidecar
+	// does not answer, the server is shown as one without a sidecar.
+	SidecarURL string `json:"sidecar_url,omitempty"`
+	// DisableSidecar manages a stock Outline server, without online,
+	// client IP and enabled state of keys.
+	DisableSidecar bool `json:"disable_sidecar,omitempty"`
+}
+
+// accessConfig is the manager access config printed by the Outline installer.
+type accessConfig struct {
+	APIURL     string `json:"apiUrl"`
+	CertSHA256 string `json:"certSha256"`
+}
+
+func (c *Config) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err == nil {
+		config, err := ParseConfig(str)
+		if err != nil {
+			return err
+		}
+		*c = config
+		return nil
+	}
+	type config Config
+	if err := json.Unmarshal(b, (*config)(c)); err != nil {
+		return err
+	}
+	access := accessConfig{}
+	if err := json.Unmarshal(b, &access); err != nil {
+		return err
+	}
+	if c.APIURL == "" {
+		c.APIURL = access.APIURL
+	}
+	if c.CertSHA256 == "" {
+		c.CertSHA256 = access.CertSHA256
+	}
+	return nil
+}
+
+// ParseConfig parses either a plain API URL or an Outline access config
+// like {"apiUrl":"https://...","certSha256":"..."}.
+func ParseConfig(str string) (Config, error) {
+	str = strings.TrimSpace(str)
+	if !strings.HasPrefix(str, "{") {
+		return Config{APIURL: str}, nil
+	}
+	access := accessConfig{}
+	if err := json.Unmarshal([]byte(str), &access); err != nil {
+		return Config{}, fmt.Errorf("invalid access config: %w", err)
+	}
+	if access.APIURL == "" {
+		return Config{}, errors.New("invalid access config: no apiUrl")
+	}
+	return Config{APIURL: access.APIURL, CertSHA256: access.CertSHA256}, nil
+}
+
+// Validate checks the API URL and the ID.
+func (c *Config) Validate() error {
+	uri, err := url.Parse(c.APIURL)
+	if err != nil {
+		return fmt.Errorf("invalid api_url %q: %w", c.APIURL, err)
+	}
+	if (uri.Scheme != "https" && uri.Scheme != "http") || uri.Host == "" {
+		return fmt.Errorf("invalid api_url %q: not an http url", c.APIURL)
+	}
+	if _, err := c.fingerprint(); err != nil {
+		return err
+	}
+	if c.SidecarURL != "" && !c.DisableSidecar {
+		uri, err := url.Parse(c.SidecarURL)
+		if err != nil || (uri.Scheme != "https" && uri.Scheme != "http") || uri.Host == "" {
+			return fmt.Errorf("invalid sidecar_url %q: not an http url", c.SidecarURL)
+		}
+	}
+	return validID(c.ID)
+}
+
+// SetSidecar sets the sidecar from a flag or form value,
+// "none" to disable it and empty to keep the default.
+func (c *Config) SetSidecar(value string) {
+	switch value {
+	case "":
+	case "none":
+		c.DisableSidecar = true
+	default:
+		c.SidecarURL = value
+	}
+}
+
+// sidecarURL returns the base URL of the sidecar, empty when disabled.
+func (c *Config) sidecarURL() string {
+	switch {
+	case c.DisableSidecar:
+		return ""
+	case c.SidecarURL != "":
+		return strings.TrimSuffix(c.SidecarURL, "/")
+	}
+	uri, _ := url.Parse(c.APIURL)
+	n, _ := strconv.Atoi(uri.Port())
+	uri.Host = uri.Hostname() + ":" + strconv.Itoa(n+1)
+	uri.Scheme = "http"
+	return uri.String()
+}
+
+// fingerprint decodes CertSHA256, accepting upper or lower case hex
+// optionally separated by colons. It returns nil when none is set.
+func (c *Config) fingerprint() ([]byte, error) {
+	if c.CertSHA256 == "" {
+		return nil, nil
+	}
+	b, err := hex.DecodeString(strings.ReplaceAll(c.CertSHA256, ":", ""))
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid cert_sha256 %q: not a hex sha256 fingerprint", c.CertSHA256)
+	}
+	return b, nil
+}
+
+// httpClient returns the client used to talk to the management API.
+// With a fingerprint the certificate chain is not verified, the leaf
+// certificate must match the fingerprint instead.
+func (c *Config) httpClient() (*http.Client, error) {
+	fingerprint, err := c.fingerprint()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	switch {
+	case fingerprint != nil:
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				if len(cs.PeerCertificates) == 0 {
+					return errors.New("no certificate from outline server")
+				}
+				sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+				if subtle.ConstantTimeCompare(sum[:], fingerprint) != 1 {
+					return fmt.Errorf("certificate fingerprint mismatch, got %X", sum[:])
+				}
+				return nil
+			},
+		}
+	case c.InsecureSkipVerify:
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// validID accepts ids that can be used as a single path segment.
+func validID(id string) error {
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.':
+		default:
+			return fmt.Errorf("invalid server id %q: only letters, digits, '-', '_' and '.' are allowed", id)
+		}
+	}
+	if id == "." || id == ".." {
+		return errors.New("invalid server id " + id)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package outline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/imgk/caddy-outline-manager/outline/api"
+)
+
+// The manager expires keys itself on servers without a sidecar: a key
+// past its expiry gets a zero data limit, and the limit it had is kept
+// in the store and given back when the key is renewed.
+//
+// Expiries are absolute times. Dates entered without a zone and months
+// added by ExtendExpiry are in the time zone of the Server.
+
+// timeLayouts are the accepted forms of expiries and other times
+// entered in the panel, the last two in the time zone of the Server.
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"}
+
+// parseTime parses a time in one of timeLayouts.
+func parseTime(value string, loc *time.Location) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, api.ErrInvalidArgument
+}
+
+// expiryIn returns the expiry days from now, zero for zero days.
+func expiryIn(days int) (time.Time, error) {
+	if days < 0 {
+		return time.Time{}, api.ErrInvalidArgument
+	}
+	if days == 0 {
+		return time.Time{}, nil
+	}
+	return time.Now().AddDate(0, 0, days), nil
+}
+
+// daysLeft returns the days from now to expiry rounded up,
+// 0 for no expiry or a past one.
+func daysLeft(expiry, now time.Time) int {
+	left := expiry.Sub(now)
+	if expiry.IsZero() || left <= 0 {
+		return 0
+	}
+	return int((left + 24*time.Hour - 1) / (24 * time.Hour))
+}
+
+// location returns the time zone of the Server of s.
+func (s *OutlineServer) location() *time.Location {
+	if s.group != nil && s.group.Location != nil {
+		return s.group.Location
+	}
+	return time.Local
+}
+
+// SetExpiry sets when a key expires, zero for never. The expiry must not
+// be past, and renews an expired key. The sidecar of the server, if any,
+// gets the deadline as well, in whole days.
+func (s *OutlineServer) SetExpiry(ctx context.Context, id string, expiry time.Time) error {
+	s.logger.Info(fmt.Sprintf("set user %v expiry to %v", id, expiry))
+	if s.store == nil && s.Sidecar == nil {
+		return api.ErrNoSidecar
+	}
+	if !expiry.IsZero() && !time.Now().Before(expiry) {
+		return api.ErrInvalidArgument
+	}
+	if s.Sidecar != nil {
+		if err := s.Sidecar.SetDeadline(ctx, id, daysLeft(expiry, time.Now())); err != nil {
+			return err
+		}
+	} else if _, err := s.API.GetAccessKey(ctx, id); err != nil {
+		return err
+	}
+	if s.store == nil {
+		return nil
+	}
+
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+
+	rec, err := s.store.Key(s.ID, id)
+	if err != nil {
+		return err
+	}
+	renew := rec.Expired
+	if renew {
+		s.logger.Info(fmt.Sprintf("renew user %v, restore its data limit", id))
+		if err := s.applyDataLimit(ctx, id, rec.SavedLimit); err != nil {
+			return err
+		}
+	}
+	err = s.store.UpdateKey(s.ID, id, func(rec *KeyRecord) error {
+		rec.Expiry = expiry
+		if renew {
+			rec.Expired = false
+			rec.SavedLimit = nil
+		}
+		return nil
+	})
+	if err == nil && renew {
+		event := Event{Type: EventKeyEnabled, KeyID: id}
+		if user := s.Snapshot().User(id); user != nil {
+			event.KeyName = user.Name
+		}
+		s.notify(ctx, event)
+	}
+	return err
+}
+
+// ExtendExpiry moves the expiry of a key by days and months, counted
+// from now when the key has no expiry or is past it, and returns it.
+func (s *OutlineServer) ExtendExpiry(ctx context.Context, id string, days, months int) (time.Time, error) {
+	if days < 0 || months < 0 || days+months == 0 {
+		return time.Time{}, api.ErrInvalidArgument
+	}
+	current := time.Time{}
+	if s.store != nil {
+		rec, err := s.store.Key(s.ID, id)
+		if err != nil {
+			return time.Time{}, err
+		}
+		current = rec.Expiry
+	} else if user := s.Snapshot().User(id); user != nil {
+		current = user.ExpiresAt
+	}
+	base := time.Now()
+	if current.After(base) {
+		base = current
+	}
+	expiry := addMonths(base.In(s.location()), months).AddDate(0, 0, days)
+	return expiry, s.SetExpiry(ctx, id, expiry)
+}
+
+// addMonths adds months to t, keeping the day of month but for the
+// last days of longer months: a month after January 31 is February 28.
+func addMonths(t time.Time, months int) time.Time {
+	year, month, day := t.Date()
+	first := time.Date(year, month+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// setDataLimit sets the data limit of a key in bytes, nil to remove it.
+// The limit of an expired key is kept for when it is renewed.
+func (s *OutlineServer) setDataLimit(ctx context.Context, id string, limit *uint64) error {
+	if s.store == nil {
+		return s.applyDataLimit(ctx, id, limit)
+	}
+
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+
+	rec, err := s.store.Key(s.ID, id)
+	if err != nil {
+		return err
+	}
+	if !rec.Expired {
+		return s.applyDataLimit(ctx, id, limit)
+	}
+	return s.store.UpdateKey(s.ID, id, func(rec *KeyRecord) error {
+		rec.SavedLimit = limit
+		return nil
+	})
+}
+
+func (s *OutlineServer) applyDataLimit(ctx context.Context, id string, limit *uint64) error {
+	if limit == nil {
+		return s.API.RemoveDataLimit(ctx, id)
+	}
+	return s.API.SetDataLimit(ctx, id, *limit)
+}
+
+// ExpireKeys gives a zero data limit to the keys past their expiry.
+// Expired keys whose limit was changed behind the manager get it again.
+// Servers with a sidecar are left to it, but the deadlines it knows
+// are kept as expiries.
+func (s *OutlineServer) ExpireKeys(ctx context.Context) error {
+	if s.store == nil {
+		return nil
+	}
+	if s.Sidecar != nil {
+		return s.adoptDeadlines()
+	}
+
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+
+	records, err := s.store.Keys(s.ID)
+	if err != nil {
+		return err
+	}
+	snap := s.Snapshot()
+	now := time.Now()
+	changed := false
+	errs := []error{}
+	for id, rec := range records {
+		user := snap.User(id)
+		if user == nil {
+			continue
+		}
+		switch {
+		case rec.Expired:
+			if user.DataLimit != nil && user.DataLimit.Bytes == 0 {
+				continue
+			}
+			err = s.API.SetDataLimit(ctx, id, 0)
+		case !rec.Expiry.IsZero() && !now.Before(rec.Expiry):
+			if err = s.expireKey(ctx, id, user.DataLimit); err == nil {
+				s.notify(ctx, Event{Type: EventKeyDisabled, KeyID: id, KeyName: user.Name})
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("expire user %v: %w", id, err))
+			continue
+		}
+		changed = true
+	}
+	if changed {
+		s.refreshAfter(ctx)
+	}
+	return errors.Join(errs...)
+}
+
+// adoptDeadlines keeps the deadlines set on the sidecar behind the
+// manager as expiries, so that they stop moving with every refresh.
+func (s *OutlineServer) adoptDeadlines() error {
+	s.expiryMu.Lock()
+	defer s.expiryMu.Unlock()
+
+	records, err := s.store.Keys(s.ID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, user := range s.Snapshot().Users {
+		if user.DaysLeft == 0 || !records[user.ID].Expiry.IsZero() {
+			continue
+		}
+		err := s.store.UpdateKey(s.ID, user.ID, func(rec *KeyRecord) error {
+			rec.Expiry = now.AddDate(0, 0, user.DaysLeft)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expireKey keeps the limit of a key, then sets it to zero. Should the
+// second step fail, the next run of ExpireKeys does it again.
+func (s *OutlineServer) expireKey(ctx context.Context, id string, limit *api.DataLimit) error {
+	s.logger.Info(fmt.Sprintf("user %v expired, set its data limit to zero", id))
+	err := s.store.UpdateKey(s.ID, id, func(rec *KeyRecord) error {
+		rec.Expired = true
+		rec.SavedLimit = nil
+		if limit != nil {
+			bytes := limit.Bytes
+			rec.SavedLimit = &bytes
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.API.SetDataLimit(ctx, id, 0)
+}
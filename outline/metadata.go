@@ -0,0 +1,98 @@
+package outline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/imgk/caddy-outline-manager/outline/api"
+)
+
+// ErrNoStore is returned for metadata changes when the manager has no store.
+var ErrNoStore = errors.New("no store for key metadata")
+
+// MetadataPatch changes the metadata of a key. Unset fields are kept,
+// empty ones are cleared.
+type MetadataPatch struct {
+	Contact *string    `json:"contact,omitempty"`
+	Plan    *string    `json:"plan,omitempty"`
+	Notes   *string    `json:"notes,omitempty"`
+	Created *time.Time `json:"created,omitempty"`
+	// Fields sets the custom fields it names, those set to "" are
+	// removed.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// maxFieldName limits the length of the names of custom fields.
+const maxFieldName = 64
+
+// empty reports whether p changes nothing.
+func (p MetadataPatch) empty() bool {
+	return p.Contact == nil && p.Plan == nil && p.Notes == nil && p.Created == nil && len(p.Fields) == 0
+}
+
+// validate checks the names of the custom fields of p.
+func (p MetadataPatch) validate() error {
+	for name := range p.Fields {
+		if name == "" || len(name) > maxFieldName {
+			return fmt.Errorf("%w: custom field name %q", api.ErrInvalidArgument, name)
+		}
+	}
+	return nil
+}
+
+func (p MetadataPatch) apply(m *Metadata) {
+	if p.Contact != nil {
+		m.Contact = *p.Contact
+	}
+	if p.Plan != nil {
+		m.Plan = *p.Plan
+	}
+	if p.Notes != nil {
+		m.Notes = *p.Notes
+	}
+	if p.Created != nil {
+		m.Created = *p.Created
+	}
+	for name, value := range p.Fields {
+		if value == "" {
+			delete(m.Fields, name)
+			continue
+		}
+		if m.Fields == nil {
+			m.Fields = make(map[string]string)
+		}
+		m.Fields[name] = value
+	}
+}
+
+// SetMetadata changes the metadata of a key.
+func (s *OutlineServer) SetMetadata(ctx context.Context, id string, patch MetadataPatch) error {
+	s.logger.Info(fmt.Sprintf("set user %v metadata", id))
+	if s.store == nil {
+		return ErrNoStore
+	}
+	if err := patch.validate(); err != nil {
+		return err
+	}
+	if _, err := s.API.GetAccessKey(ctx, id); err != nil {
+		return err
+	}
+	return s.store.UpdateKey(s.ID, id, func(rec *KeyRecord) error {
+		patch.apply(&rec.Metadata)
+		return nil
+	})
+}
+
+// recordCreation keeps when and by which admin of ctx a key was created.
+func (s *OutlineServer) recordCreation(ctx context.Context, id string) error {
+	if s.store == nil {
+		return nil
+	}
+	return s.store.UpdateKey(s.ID, id, func(rec *KeyRecord) error {
+		rec.Metadata.Created = time.Now()
+		rec.Metadata.CreatedBy = AdminFromContext(ctx)
+		return nil
+	})
+}
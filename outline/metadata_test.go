@@ -0,0 +1,81 @@
+package outline
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetadataFields(t *testing.T) {
+	s, server, _ := newTestServer(t, true)
+	keys := APIPath + "/servers/mock/keys"
+
+	fields := func() map[string]string {
+		t.Helper()
+		rec, err := s.Store.Key(server.ID, "7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.Metadata.Fields
+	}
+
+	if w := serve(s, RoleOperator, http.MethodPost, keys, `{"id":"7","metadata":{"fields":{"region":"eu"}}}`); w.Code != http.StatusCreated {
+		t.Fatalf("create: got %v: %v", w.Code, w.Body)
+	}
+	if w := serve(s, RoleOperator, http.MethodPatch, keys+"/7", `{"metadata":{"fields":{"invoice":"42"}}}`); w.Code != http.StatusOK {
+		t.Fatalf("patch: got %v: %v", w.Code, w.Body)
+	}
+	if got, want := fields(), map[string]string{"region": "eu", "invoice": "42"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fields %v, want %v", got, want)
+	}
+	if w := serve(s, RoleOperator, http.MethodPatch, keys+"/7", `{"metadata":{"fields":{"":"x"}}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("empty field name: got %v, want 400", w.Code)
+	}
+
+	// the panel clears a field with an empty value
+	if w := serve(s, RoleOperator, http.MethodPut, server.Prefix()+"/metadata?id=7&field.region=&field.invoice=43", ""); w.Code != http.StatusOK {
+		t.Fatalf("panel: got %v: %v", w.Code, w.Body)
+	}
+	if got, want := fields(), map[string]string{"invoice": "43"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fields %v, want %v", got, want)
+	}
+	w := serve(s, RoleViewer, http.MethodGet, server.Prefix(), "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `data-name="invoice" value="43"`) {
+		t.Errorf("panel: got %v, want the invoice field: %v", w.Code, w.Body)
+	}
+}
+
+func TestMetadataCreated(t *testing.T) {
+	s, server, _ := newTestServer(t, true)
+	if w := serve(s, RoleOperator, http.MethodPost, APIPath+"/servers/mock/keys", `{"id":"7"}`); w.Code != http.StatusCreated {
+		t.Fatalf("create: got %v: %v", w.Code, w.Body)
+	}
+	created := func() time.Time {
+		t.Helper()
+		rec, err := s.Store.Key(server.ID, "7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.Metadata.Created
+	}
+	before := created()
+	if before.IsZero() {
+		t.Fatal("no creation date recorded")
+	}
+
+	if w := serve(s, RoleOperator, http.MethodPut, server.Prefix()+"/metadata?id=7&notes=x", ""); w.Code != http.StatusOK {
+		t.Fatalf("got %v: %v", w.Code, w.Body)
+	}
+	if after := created(); !after.Equal(before) {
+		t.Errorf("created %v without created in the query, want %v", after, before)
+	}
+
+	if w := serve(s, RoleOperator, http.MethodPut, server.Prefix()+"/metadata?id=7&created=", ""); w.Code != http.StatusOK {
+		t.Fatalf("got %v: %v", w.Code, w.Body)
+	}
+	if after := created(); !after.IsZero() {
+		t.Errorf("created %v, want it cleared", after)
+	}
+}
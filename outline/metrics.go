@@ -0,0 +1,294 @@
+package outline
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/imgk/caddy-outline-manager/outline/api"
+)
+
+// The gauges of servers and keys are read from the snapshots at each
+// scrape. The upstream metrics count the calls to the management API
+// and sidecars of all servers, across config reloads. Their series of
+// a server are deleted once no Server manages it anymore.
+
+const metricsNamespace = "outline_manager"
+
+var (
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Duration of calls to the management API and sidecars of Outline servers, retries included.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"server", "api", "method"})
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_errors_total",
+		Help:      "Failed calls to the management API and sidecars of Outline servers.",
+	}, []string{"server", "api", "method"})
+)
+
+var (
+	serverUpDesc = prometheus.NewDesc(metricsNamespace+"_server_up",
+		"Whether the last refresh of the server succeeded.", []string{"server"}, nil)
+	serverRefreshedDesc = prometheus.NewDesc(metricsNamespace+"_server_last_refresh_timestamp_seconds",
+		"When the keys of the server were last fetched.", []string{"server"}, nil)
+	serverBytesDesc = prometheus.NewDesc(metricsNamespace+"_server_transferred_bytes",
+		"Bytes transferred by all keys of the server, as reported by Outline.", []string{"server"}, nil)
+	keysDesc = prometheus.NewDesc(metricsNamespace+"_keys",
+		"Access keys of the server by state: total, enabled, online or expired.", []string{"server", "state"}, nil)
+	keyBytesDesc = prometheus.NewDesc(metricsNamespace+"_key_transferred_bytes",
+		"Bytes transferred by the key, as reported by Outline.", []string{"server", "key"}, nil)
+	keyLimitDesc = prometheus.NewDesc(metricsNamespace+"_key_data_limit_bytes",
+		"Data limit of the key, for keys with one.", []string{"server", "key"}, nil)
+)
+
+// RegisterMetrics registers the metrics of the servers of s with registry.
+func (s *Server) RegisterMetrics(registry prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{upstreamDuration, upstreamErrors, serverCollector{s}} {
+		err := registry.Register(c)
+		if already := (prometheus.AlreadyRegisteredError{}); errors.As(err, &already) && already.ExistingCollector == c {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serverCollector collects the gauges of the servers of a Server.
+type serverCollector struct {
+	s *Server
+}
+
+func (c serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{serverUpDesc, serverRefreshedDesc, serverBytesDesc, keysDesc, keyBytesDesc, keyLimitDesc} {
+		ch <- desc
+	}
+}
+
+func (c serverCollector) Collect(ch chan<- prometheus.Metric) {
+	type entry struct {
+		id     string
+		server *OutlineServer
+		ready  bool
+	}
+	c.s.mu.RLock()
+	entries := make([]entry, 0, len(c.s.servers))
+	for _, server := range c.s.servers {
+		// unnamed servers are left out until they are reached
+		if server.ID != "" {
+			entries = append(entries, entry{server.ID, server, c.s.ready[server]})
+		}
+	}
+	c.s.mu.RUnlock()
+
+	gauge := func(desc *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, labels...)
+	}
+	for _, e := range entries {
+		id := e.id
+		if !e.ready {
+			gauge(serverUpDesc, 0, id)
+			continue
+		}
+		up := 0.0
+		if !e.server.failing.Load() {
+			up = 1
+		}
+		gauge(serverUpDesc, up, id)
+
+		snap := e.server.Snapshot()
+		gauge(serverRefreshedDesc, float64(snap.Refreshed.UnixNano())/1e9, id)
+		gauge(serverBytesDesc, float64(snap.Total), id)
+		enabled, online, expired := 0, 0, 0
+		for _, user := range snap.Users {
+			if user.Enabled {
+				enabled++
+			}
+			if user.Online {
+				online++
+			}
+			if user.Expired {
+				expired++
+			}
+			gauge(keyBytesDesc, float64(user.TransferredBytes), id, user.ID)
+			if user.DataLimit != nil {
+				gauge(keyLimitDesc, float64(user.DataLimit.Bytes), id, user.ID)
+			}
+		}
+		gauge(keysDesc, float64(len(snap.Users)), id, "total")
+		gauge(keysDesc, float64(enabled), id, "enabled")
+		gauge(keysDesc, float64(online), id, "online")
+		gauge(keysDesc, float64(expired), id, "expired")
+	}
+}
+
+// observers counts the servers with series in the upstream metrics by
+// id. A server is counted by every Server managing it, as the old and
+// the new one during a config reload.
+var observers = struct {
+	sync.Mutex
+	n map[string]int
+}{n: map[string]int{}}
+
+// observe records a call to an upstream API of s that started at start.
+// Calls made before the id of s is known are not recorded.
+func (s *OutlineServer) observe(kind, method string, start time.Time, err *error) {
+	id := s.ID
+	if id == "" {
+		return
+	}
+	if s.observed.CompareAndSwap(false, true) {
+		observers.Lock()
+		observers.n[id]++
+		observers.Unlock()
+	}
+	upstreamDuration.WithLabelValues(id, kind, method).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		upstreamErrors.WithLabelValues(id, kind, method).Inc()
+	}
+}
+
+// forgetMetrics deletes the series of s from the upstream metrics,
+// unless another Server manages a server with its id.
+func (s *OutlineServer) forgetMetrics() {
+	if !s.observed.CompareAndSwap(true, false) {
+		return
+	}
+	observers.Lock()
+	defer observers.Unlock()
+	if observers.n[s.ID]--; observers.n[s.ID] > 0 {
+		return
+	}
+	delete(observers.n, s.ID)
+	upstreamDuration.DeletePartialMatch(prometheus.Labels{"server": s.ID})
+	upstreamErrors.DeletePartialMatch(prometheus.Labels{"server": s.ID})
+}
+
+// instrumentedAPI is the management API of a server with metrics.
+type instrumentedAPI struct {
+	next   api.Management
+	server *OutlineServer
+}
+
+func (m instrumentedAPI) observe(method string, start time.Time, err *error) {
+	m.server.observe("outline", method, start, err)
+}
+
+func (m instrumentedAPI) GetServer(ctx context.Context) (info *api.ServerInfo, err error) {
+	defer m.observe("GetServer", time.Now(), &err)
+	return m.next.GetServer(ctx)
+}
+
+func (m instrumentedAPI) RenameServer(ctx context.Context, name string) (err error) {
+	defer m.observe("RenameServer", time.Now(), &err)
+	return m.next.RenameServer(ctx, name)
+}
+
+func (m instrumentedAPI) SetHostname(ctx context.Context, hostname string) (err error) {
+	defer m.observe("SetHostname", time.Now(), &err)
+	return m.next.SetHostname(ctx, hostname)
+}
+
+func (m instrumentedAPI) SetPortForNewAccessKeys(ctx context.Context, port int) (err error) {
+	defer m.observe("SetPortForNewAccessKeys", time.Now(), &err)
+	return m.next.SetPortForNewAccessKeys(ctx, port)
+}
+
+func (m instrumentedAPI) SetDefaultDataLimit(ctx context.Context, bytes uint64) (err error) {
+	defer m.observe("SetDefaultDataLimit", time.Now(), &err)
+	return m.next.SetDefaultDataLimit(ctx, bytes)
+}
+
+func (m instrumentedAPI) RemoveDefaultDataLimit(ctx context.Context) (err error) {
+	defer m.observe("RemoveDefaultDataLimit", time.Now(), &err)
+	return m.next.RemoveDefaultDataLimit(ctx)
+}
+
+func (m instrumentedAPI) SetMetricsEnabled(ctx context.Context, enabled bool) (err error) {
+	defer m.observe("SetMetricsEnabled", time.Now(), &err)
+	return m.next.SetMetricsEnabled(ctx, enabled)
+}
+
+func (m instrumentedAPI) ListAccessKeys(ctx context.Context) (keys []*api.AccessKey, err error) {
+	defer m.observe("ListAccessKeys", time.Now(), &err)
+	return m.next.ListAccessKeys(ctx)
+}
+
+func (m instrumentedAPI) GetAccessKey(ctx context.Context, id string) (key *api.AccessKey, err error) {
+	defer m.observe("GetAccessKey", time.Now(), &err)
+	return m.next.GetAccessKey(ctx, id)
+}
+
+func (m instrumentedAPI) CreateAccessKey(ctx context.Context, opts api.NewAccessKey) (key *api.AccessKey, err error) {
+	defer m.observe("CreateAccessKey", time.Now(), &err)
+	return m.next.CreateAccessKey(ctx, opts)
+}
+
+func (m instrumentedAPI) DeleteAccessKey(ctx context.Context, id string) (err error) {
+	defer m.observe("DeleteAccessKey", time.Now(), &err)
+	return m.next.DeleteAccessKey(ctx, id)
+}
+
+func (m instrumentedAPI) RenameAccessKey(ctx context.Context, id, name string) (err error) {
+	defer m.observe("RenameAccessKey", time.Now(), &err)
+	return m.next.RenameAccessKey(ctx, id, name)
+}
+
+func (m instrumentedAPI) SetDataLimit(ctx context.Context, id string, bytes uint64) (err error) {
+	defer m.observe("SetDataLimit", time.Now(), &err)
+	return m.next.SetDataLimit(ctx, id, bytes)
+}
+
+func (m instrumentedAPI) RemoveDataLimit(ctx context.Context, id string) (err error) {
+	defer m.observe("RemoveDataLimit", time.Now(), &err)
+	return m.next.RemoveDataLimit(ctx, id)
+}
+
+func (m instrumentedAPI) GetTransfer(ctx context.Context) (used map[string]uint64, err error) {
+	defer m.observe("GetTransfer", time.Now(), &err)
+	return m.next.GetTransfer(ctx)
+}
+
+// instrumentedSidecar is the sidecar of a server with metrics.
+type instrumentedSidecar struct {
+	next   api.Sidecar
+	server *OutlineServer
+}
+
+func (m instrumentedSidecar) observe(method string, start time.Time, err *error) {
+	m.server.observe("sidecar", method, start, err)
+}
+
+func (m instrumentedSidecar) ListUsers(ctx context.Context) (users []*api.GoUser, err error) {
+	defer m.observe("ListUsers", time.Now(), &err)
+	return m.next.ListUsers(ctx)
+}
+
+func (m instrumentedSidecar) ToggleUser(ctx context.Context, id string) (err error) {
+	defer m.observe("ToggleUser", time.Now(), &err)
+	return m.next.ToggleUser(ctx, id)
+}
+
+func (m instrumentedSidecar) SetDeadline(ctx context.Context, id string, days int) (err error) {
+	defer m.observe("SetDeadline", time.Now(), &err)
+	return m.next.SetDeadline(ctx, id, days)
+}
+
+func (m instrumentedSidecar) SetLimit(ctx context.Context, id string, gb int) (err error) {
+	defer m.observe("SetLimit", time.Now(), &err)
+	return m.next.SetLimit(ctx, id, gb)
+}
+
+// Interface guards
+var (
+	_ api.Management       = instrumentedAPI{}
+	_ api.Sidecar          = instrumentedSidecar{}
+	_ prometheus.Collector = serverCollector{}
+)
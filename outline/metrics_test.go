@@ -0,0 +1,73 @@
+package outline
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+// series returns the number of series of the upstream metrics labeled
+// with server.
+func series(t *testing.T, server string) int {
+	t.Helper()
+	ch := make(chan prometheus.Metric, 100)
+	upstreamDuration.Collect(ch)
+	upstreamErrors.Collect(ch)
+	close(ch)
+	n := 0
+	for m := range ch {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err != nil {
+			t.Fatal(err)
+		}
+		for _, label := range pb.GetLabel() {
+			if label.GetName() == "server" && label.GetValue() == server {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestUpstreamMetrics(t *testing.T) {
+	config := Config{APIURL: "https://192.0.2.1:1234/secret", DisableSidecar: true}
+	unnamed, err := NewOutlineServer(config, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail := errors.New("refused")
+	unnamed.observe("outline", "GetServer", time.Now(), &fail)
+	if n := series(t, ""); n != 0 {
+		t.Errorf("%v series without a server id", n)
+	}
+
+	// the series of a server outlive the Server being replaced by a
+	// config reload, not its removal
+	config.ID = "metrics"
+	servers := make([]*Server, 2)
+	for i := range servers {
+		server, err := NewOutlineServer(config, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.API = instrumentedAPI{next: &mockAPI{}, server: server}
+		servers[i] = NewServer([]*OutlineServer{server}, zap.NewNop())
+		servers[i].Connect(context.Background())
+	}
+	if n := series(t, "metrics"); n == 0 {
+		t.Fatal("no series of the server")
+	}
+	servers[0].Close()
+	if n := series(t, "metrics"); n == 0 {
+		t.Error("series deleted while the server is managed")
+	}
+	servers[1].Close()
+	if n := series(t, "metrics"); n != 0 {
+		t.Errorf("%v series left after the server was removed", n)
+	}
+}
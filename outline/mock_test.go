@@ -0,0 +1,275 @@
+package outline
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-outline-manager/outline/api"
+)
+
+// mockAPI is an in-memory api.Management.
+type mockAPI struct {
+	mu    sync.Mutex
+	keys  map[string]*api.AccessKey
+	usage map[string]uint64
+	n     int
+	// fail is returned by every call when not nil
+	fail error
+	// onList is called by ListAccessKeys when not nil
+	onList func()
+}
+
+func (m *mockAPI) key(id string) (*api.AccessKey, error) {
+	if m.fail != nil {
+		return nil, m.fail
+	}
+	key, ok := m.keys[id]
+	if !ok {
+		return nil, api.ErrKeyNotFound
+	}
+	return key, nil
+}
+
+func (m *mockAPI) GetServer(ctx context.Context) (*api.ServerInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return nil, m.fail
+	}
+	return &api.ServerInfo{Name: "mock", ServerID: "mock"}, nil
+}
+
+func (m *mockAPI) RenameServer(ctx context.Context, name string) error         { return nil }
+func (m *mockAPI) SetHostname(ctx context.Context, hostname string) error      { return nil }
+func (m *mockAPI) SetPortForNewAccessKeys(ctx context.Context, port int) error { return nil }
+func (m *mockAPI) SetDefaultDataLimit(ctx context.Context, bytes uint64) error { return nil }
+func (m *mockAPI) RemoveDefaultDataLimit(ctx context.Context) error            { return nil }
+func (m *mockAPI) SetMetricsEnabled(ctx context.Context, enabled bool) error   { return nil }
+
+func (m *mockAPI) ListAccessKeys(ctx context.Context) ([]*api.AccessKey, error) {
+	if m.onList != nil {
+		m.onList()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return nil, m.fail
+	}
+	keys := make([]*api.AccessKey, 0, len(m.keys))
+	for _, key := range m.keys {
+		copied := *key
+		keys = append(keys, &copied)
+	}
+	return keys, nil
+}
+
+func (m *mockAPI) GetAccessKey(ctx context.Context, id string) (*api.AccessKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, err := m.key(id)
+	if err != nil {
+		return nil, err
+	}
+	copied := *key
+	return &copied, nil
+}
+
+func (m *mockAPI) CreateAccessKey(ctx context.Context, opts api.NewAccessKey) (*api.AccessKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return nil, m.fail
+	}
+	if m.keys == nil {
+		m.keys = make(map[string]*api.AccessKey)
+	}
+	id := opts.ID
+	if id == "" {
+		m.n++
+		id = strconv.Itoa(m.n)
+	}
+	if _, ok := m.keys[id]; ok {
+		return nil, api.ErrKeyExists
+	}
+	key := &api.AccessKey{
+		ID:        id,
+		Name:      opts.Name,
+		Method:    opts.Method,
+		Port:      opts.Port,
+		DataLimit: opts.Limit,
+		AccessURL: "ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTpwYXNz@192.0.2.1:1234/?outline=1",
+	}
+	m.keys[id] = key
+	copied := *key
+	return &copied, nil
+}
+
+func (m *mockAPI) DeleteAccessKey(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.key(id); err != nil {
+		return err
+	}
+	delete(m.keys, id)
+	return nil
+}
+
+func (m *mockAPI) RenameAccessKey(ctx context.Context, id, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, err := m.key(id)
+	if err != nil {
+		return err
+	}
+	key.Name = name
+	return nil
+}
+
+func (m *mockAPI) SetDataLimit(ctx context.Context, id string, bytes uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, err := m.key(id)
+	if err != nil {
+		return err
+	}
+	key.DataLimit = &api.DataLimit{Bytes: bytes}
+	return nil
+}
+
+func (m *mockAPI) RemoveDataLimit(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, err := m.key(id)
+	if err != nil {
+		return err
+	}
+	key.DataLimit = nil
+	return nil
+}
+
+func (m *mockAPI) GetTransfer(ctx context.Context) (map[string]uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return nil, m.fail
+	}
+	used := make(map[string]uint64, len(m.usage))
+	for id, bytes := range m.usage {
+		used[id] = bytes
+	}
+	return used, nil
+}
+
+// mockSidecar is an in-memory api.Sidecar.
+type mockSidecar struct {
+	mu    sync.Mutex
+	users map[string]*api.GoUser
+	// fail is returned by every call when not nil
+	fail error
+}
+
+func (m *mockSidecar) user(id string) (*api.GoUser, error) {
+	if m.fail != nil {
+		return nil, m.fail
+	}
+	if m.users == nil {
+		m.users = make(map[string]*api.GoUser)
+	}
+	user, ok := m.users[id]
+	if !ok {
+		user = &api.GoUser{ID: id, Enabled: true}
+		m.users[id] = user
+	}
+	return user, nil
+}
+
+func (m *mockSidecar) ListUsers(ctx context.Context) ([]*api.GoUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail != nil {
+		return nil, m.fail
+	}
+	users := make([]*api.GoUser, 0, len(m.users))
+	for _, user := range m.users {
+		copied := *user
+		users = append(users, &copied)
+	}
+	return users, nil
+}
+
+func (m *mockSidecar) ToggleUser(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, err := m.user(id)
+	if err != nil {
+		return err
+	}
+	user.Enabled = !user.Enabled
+	return nil
+}
+
+func (m *mockSidecar) SetDeadline(ctx context.Context, id string, days int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, err := m.user(id)
+	if err != nil {
+		return err
+	}
+	user.DaysLeft = days
+	return nil
+}
+
+func (m *mockSidecar) SetLimit(ctx context.Context, id string, gb int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, err := m.user(id)
+	if err != nil {
+		return err
+	}
+	user.Limit = gb
+	return nil
+}
+
+// newTestServer returns a Server managing one connected server with id
+// "mock" backed by a mockAPI, and a Store when store is true.
+func newTestServer(t *testing.T, store bool) (*Server, *OutlineServer, *mockAPI) {
+	t.Helper()
+	server, err := NewOutlineServer(Config{ID: "mock", APIURL: "https://192.0.2.1:1234/secret", DisableSidecar: true}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := &mockAPI{}
+	server.API = mock
+
+	s := NewServer([]*OutlineServer{server}, zap.NewNop())
+	if store {
+		if s.Store, err = OpenStore(filepath.Join(t.TempDir(), "outline.db")); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Store.Close() })
+	}
+	t.Cleanup(s.Close)
+	s.Connect(context.Background())
+	return s, server, mock
+}
+
+// serve sends a request with a JSON body to h as role and returns the
+// response.
+func serve(h http.Handler, role Role, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	r = r.WithContext(WithRole(r.Context(), role))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,307 @@
+package outline
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SpecPath serves the OpenAPI document of all manager routes.
+const SpecPath = APIPath + "/openapi.json"
+
+// Operation documents a route in the OpenAPI document.
+type Operation struct {
+	// ID is the unique operationId used by generated clients.
+	ID     string
+	Method string
+	// Path may hold {wildcards}, which are documented as path parameters.
+	Path string
+	// Role is the lowest role allowed, RoleNone for public routes.
+	Role    Role
+	Summary string
+
+	// Query and Form name the string parameters read from the query
+	// and from an urlencoded form body.
+	Query []string
+	Form  []string
+	// Request is a value of the type of the JSON request body.
+	Request any
+	// Response is a value of the type of the JSON response body.
+	Response any
+	// HTML marks routes answering a page.
+	HTML bool
+	// CSV marks routes answering Response as CSV as well.
+	CSV bool
+	// Status is the status of a successful response, 200 if zero.
+	Status int
+}
+
+// Router registers the routes of a server panel with the Operations
+// documenting them.
+type Router interface {
+	Handle(op Operation, h http.HandlerFunc)
+}
+
+// routeMux is a ServeMux remembering the patterns registered with it.
+type routeMux struct {
+	*http.ServeMux
+	patterns []string
+}
+
+func (m *routeMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.patterns = append(m.patterns, pattern)
+	m.ServeMux.HandleFunc(pattern, handler)
+}
+
+// panelPrefix is the Prefix of every server in the OpenAPI document.
+const panelPrefix = BasePath + "/servers/{sid}"
+
+// operationList is a Router recording the Operations of the routes.
+type operationList []Operation
+
+func (l *operationList) Handle(op Operation, h http.HandlerFunc) {
+	*l = append(*l, op)
+}
+
+// Operations returns every documented route.
+func (s *Server) Operations() []Operation {
+	s.mu.RLock()
+	ops := append([]Operation(nil), s.operations...)
+	s.mu.RUnlock()
+
+	// the panel routes of every server, as SetRouter registers them
+	panel := operationList{}
+	(&OutlineServer{}).SetRouter(panelPrefix, &panel)
+	return append(ops, panel...)
+}
+
+// OpenAPI returns the OpenAPI 3 document of Operations.
+func (s *Server) OpenAPI() map[string]any {
+	schemas := schemaSet{schemas: map[string]any{}, names: map[reflect.Type]string{}}
+	paths := map[string]map[string]any{}
+
+	for _, op := range s.Operations() {
+		path := op.Path
+		if path == "" {
+			path = "/"
+		}
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+
+		params := []any{}
+		for _, name := range pathParams(op.Path) {
+			params = append(params, map[string]any{"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+		}
+		for _, name := range op.Query {
+			params = append(params, map[string]any{"name": name, "in": "query", "schema": map[string]any{"type": "string"}})
+		}
+
+		item := map[string]any{
+			"operationId":     op.ID,
+			"summary":         op.Summary,
+			"x-required-role": op.Role.String(),
+		}
+		if len(params) > 0 {
+			item["parameters"] = params
+		}
+		if op.Role == RoleNone {
+			item["security"] = []any{}
+		}
+
+		switch {
+		case op.Request != nil:
+			item["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(op.Request), schemas)}},
+			}
+		case len(op.Form) > 0:
+			props := map[string]any{}
+			for _, name := range op.Form {
+				props[name] = map[string]any{"type": "string"}
+			}
+			item["requestBody"] = map[string]any{
+				"content": map[string]any{"application/x-www-form-urlencoded": map[string]any{
+					"schema": map[string]any{"type": "object", "properties": props},
+				}},
+			}
+		}
+
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		ok := map[string]any{"description": http.StatusText(status)}
+		switch {
+		case op.Response != nil:
+			content := map[string]any{"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(op.Response), schemas)}}
+			if op.CSV {
+				content["text/csv"] = map[string]any{"schema": map[string]any{"type": "string"}}
+			}
+			ok["content"] = content
+		case op.HTML:
+			ok["content"] = map[string]any{"text/html": map[string]any{"schema": map[string]any{"type": "string"}}}
+		}
+		failed := map[string]any{"description": "Error"}
+		if strings.HasPrefix(op.Path, APIPath+"/") {
+			failed["content"] = map[string]any{"application/json": map[string]any{"schema": schemaOf(reflect.TypeOf(ErrorResource{}), schemas)}}
+		} else {
+			failed["content"] = map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}}
+		}
+		item["responses"] = map[string]any{fmt.Sprint(status): ok, "default": failed}
+
+		paths[path][strings.ToLower(op.Method)] = item
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Outline Manager",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas.schemas,
+			"securitySchemes": map[string]any{
+				"session": map[string]any{"type": "apiKey", "in": "cookie", "name": s.SessionCookie},
+				"token":   map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []any{map[string]any{"session": []any{}}, map[string]any{"token": []any{}}},
+	}
+}
+
+// serveSpec answers the OpenAPI document.
+func (s *Server) serveSpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s.OpenAPI())
+}
+
+// pathParams returns the names of the {wildcards} of path.
+func pathParams(path string) (names []string) {
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			names = append(names, strings.TrimSuffix(segment[1:len(segment)-1], "..."))
+		}
+	}
+	return
+}
+
+var (
+	ipType   = reflect.TypeOf(net.IP{})
+	roleType = reflect.TypeOf(RoleNone)
+	timeType = reflect.TypeOf(time.Time{})
+)
+
+// schemaSet holds the named schemas of a document by their name,
+// and the name given to each struct type.
+type schemaSet struct {
+	schemas map[string]any
+	names   map[reflect.Type]string
+}
+
+// name returns a name for t unused by other types, qualified by the
+// package of t when another one has the same name.
+func (s schemaSet) name(t reflect.Type) string {
+	name := t.Name()
+	if _, ok := s.schemas[name]; ok {
+		name = path.Base(t.PkgPath()) + "." + name
+	}
+	return name
+}
+
+// schemaOf returns the JSON schema of t as encoded by encoding/json.
+// Named structs are added to schemas and referenced, anonymous ones
+// are inlined.
+func schemaOf(t reflect.Type, schemas schemaSet) map[string]any {
+	switch t {
+	case ipType:
+		return map[string]any{"type": "string"}
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case roleType:
+		names := []string{}
+		for _, name := range roleNames {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return map[string]any{"type": "string", "enum": names}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := schemaOf(t.Elem(), schemas)
+		if _, ok := schema["$ref"]; ok {
+			return map[string]any{"allOf": []any{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Struct:
+	default:
+		return map[string]any{}
+	}
+
+	// anonymous structs are inlined
+	if t.Name() == "" {
+		return objectSchema(t, schemas)
+	}
+	name, ok := schemas.names[t]
+	if !ok {
+		name = schemas.name(t)
+		schemas.names[t] = name
+		// reserve the name before recursing into self references
+		schemas.schemas[name] = nil
+		schemas.schemas[name] = objectSchema(t, schemas)
+	}
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+// objectSchema returns the schema of the fields of the struct t.
+func objectSchema(t reflect.Type, schemas schemaSet) map[string]any {
+	props := map[string]any{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		props[name] = schemaOf(field.Type, schemas)
+		if !strings.Contains(opts, "omit") && field.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,152 @@
+package outline
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/imgk/caddy-outline-manager/outline/api"
+)
+
+// TestSpecRoutes compares the routes registered by a connected server
+// with the OpenAPI document, by method, path and role.
+func TestSpecRoutes(t *testing.T) {
+	s, server, _ := newTestServer(t, true)
+
+	b, err := json.Marshal(s.OpenAPI())
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := struct {
+		Paths map[string]map[string]struct {
+			ID   string `json:"operationId"`
+			Role string `json:"x-required-role"`
+		} `json:"paths"`
+	}{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := map[string]bool{}
+	documented := map[string]Role{}
+	for path, items := range doc.Paths {
+		for method, item := range items {
+			if item.ID == "" || ids[item.ID] {
+				t.Errorf("%v %v: missing or duplicate operationId %q", method, path, item.ID)
+			}
+			ids[item.ID] = true
+			role := RoleNone
+			if item.Role != "none" {
+				if role, err = ParseRole(item.Role); err != nil {
+					t.Errorf("%v %v: %v", method, path, err)
+				}
+			}
+			documented[strings.ToUpper(method)+" "+path] = role
+		}
+	}
+
+	registered := map[string]bool{}
+	for _, pattern := range s.router.patterns {
+		method, path, ok := strings.Cut(pattern, " ")
+		if !ok {
+			t.Errorf("route %q is registered for every method", pattern)
+			continue
+		}
+		pattern = method + " " + strings.Replace(path, server.Prefix(), panelPrefix, 1)
+		registered[pattern] = true
+		if _, ok := documented[pattern]; !ok {
+			t.Errorf("route %q is not documented", pattern)
+		}
+	}
+	for pattern := range documented {
+		if !registered[pattern] {
+			t.Errorf("documented route %q is not registered", pattern)
+		}
+	}
+
+	// the role below the documented one is rejected, the documented one
+	// gets past the role check
+	values := strings.NewReplacer("{sid}", server.ID, "{kid}", "1", "{hid}", "hook")
+	for pattern, role := range documented {
+		method, path, _ := strings.Cut(pattern, " ")
+		path = values.Replace(path)
+		if role > RoleNone {
+			if w := serve(s, role-1, method, path, ""); w.Code != http.StatusForbidden {
+				t.Errorf("%v as %v: got %v, want 403", pattern, role-1, w.Code)
+			}
+		}
+		if w := serve(s, role, method, path, ""); w.Code == http.StatusForbidden || w.Code == http.StatusMethodNotAllowed {
+			t.Errorf("%v as %v: got %v", pattern, role, w.Code)
+		}
+	}
+}
+
+func TestSchemaNames(t *testing.T) {
+	schemas := schemaSet{schemas: map[string]any{}, names: map[reflect.Type]string{}}
+	type Anonymous struct {
+		Inner struct {
+			A int `json:"a"`
+		} `json:"inner"`
+	}
+
+	refs := []any{
+		schemaOf(reflect.TypeOf(ServerInfo{}), schemas)["$ref"],
+		schemaOf(reflect.TypeOf(api.ServerInfo{}), schemas)["$ref"],
+		schemaOf(reflect.TypeOf(Anonymous{}), schemas)["$ref"],
+	}
+	want := []any{
+		"#/components/schemas/ServerInfo",
+		"#/components/schemas/api.ServerInfo",
+		"#/components/schemas/Anonymous",
+	}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("refs %v, want %v", refs, want)
+	}
+	if refs := schemaOf(reflect.TypeOf(api.ServerInfo{}), schemas)["$ref"]; refs != want[1] {
+		t.Errorf("second ref %v, want %v", refs, want[1])
+	}
+
+	inner := schemas.schemas["Anonymous"].(map[string]any)["properties"].(map[string]any)["inner"].(map[string]any)
+	if inner["type"] != "object" || inner["$ref"] != nil {
+		t.Errorf("anonymous struct schema %v, want it inlined", inner)
+	}
+	props := schemas.schemas["api.ServerInfo"].(map[string]any)["properties"].(map[string]any)
+	if _, ok := props["serverId"]; !ok {
+		t.Errorf("api.ServerInfo schema %v, want the fields of api.ServerInfo", props)
+	}
+}
+
+// TestSpecDeadline checks that setDeadline documents every field of its
+// request.
+func TestSpecDeadline(t *testing.T) {
+	s, _, _ := newTestServer(t, true)
+
+	b, err := json.Marshal(s.OpenAPI())
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := struct {
+		Paths map[string]map[string]struct {
+			Summary string `json:"summary"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]any `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	summary := doc.Paths[APIPath+"/servers/{sid}/deadlines/{kid}"]["put"].Summary
+	for field := range doc.Components.Schemas["DeadlineRequest"].Properties {
+		if !strings.Contains(summary, field) {
+			t.Errorf("summary %q does not mention %v", summary, field)
+		}
+	}
+	if len(doc.Components.Schemas["DeadlineRequest"].Properties) != 4 {
+		t.Errorf("DeadlineRequest schema %+v", doc.Components.Schemas["DeadlineRequest"])
+	}
+}
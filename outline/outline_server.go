@@ -1,30 +1,24 @@
 package outline
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"net"
 	"net/http"
-	"net/url"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
-)
 
-var unsafeClient = &http.Client{
-	Transport: &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	},
-}
+	"github.com/imgk/caddy-outline-manager/outline/api"
+)
 
 // {
 // "id":"3",
@@ -35,399 +29,364 @@ var unsafeClient = &http.Client{
 // "accessUrl":"ss://Y2hhY2hhMjAtaWV0Zi1wb2x5MTMwNTo1UGdUaWxNdmRyaEs=@18.182.68.185:61081/?outline=1"
 // }
 type OutlineUser struct {
-	ID               string      `json:"id"`
-	JSID             template.JS `json:"_,omitempty"`
-	Name             string      `json:"name"`
-	Password         string      `json:"password"`
-	Port             int         `json:"port"`
-	Method           string      `json:"method"`
-	AccessURL        string      `json:"accessUrl"`
-	TransferredBytes ByteNum     `json:"byteNum,omitempty"`
+	ID               string         `json:"id"`
+	JSID             template.JS    `json:"-"`
+	Name             string         `json:"name"`
+	Password         string         `json:"password"`
+	Port             int            `json:"port"`
+	Method           string         `json:"method"`
+	AccessURL        string         `json:"accessUrl"`
+	TransferredBytes ByteNum        `json:"byteNum,omitempty"`
+	DataLimit        *api.DataLimit `json:"dataLimit,omitempty"`
 
 	// provided by go manager
-	IP       net.IP    `json:"_,omitempty"`
-	Enabled  bool      `json:"_,omitempty"`
-	EnColor  string    `json:"_,omitempty"`
-	Online   bool      `json:"_,omitempty"`
-	OnColor  string    `json:"_,omitempty"`
-	DaysLeft int       `json:"_,omitempty"`
-	Limit    int       `json:"_,omitempty"`
-	Expire   string    `json:"_,omitempty"`
-}
-
-// Provide by Go Program
-type GoUser struct {
-	ID       string `json:"id"`
-	IP       net.IP `json:"ip"`
-	Enabled  bool   `json:"enabled"`
-	Online   bool   `json:"online"`
-	DaysLeft int    `json:"days_left"`
-	Limit    int    `json:"limit"`
+	IP       net.IP `json:"-"`
+	Enabled  bool   `json:"-"`
+	EnColor  string `json:"-"`
+	Online   bool   `json:"-"`
+	OnColor  string `json:"-"`
+	DaysLeft int    `json:"-"`
+	Limit    int    `json:"-"`
+	Expire   string `json:"-"`
+
+	// Expired is set while the manager holds the key at a zero data
+	// limit because it is past its expiry.
+	Expired bool `json:"-"`
+	// ExpiresAt is when the key expires, zero for never. Expire is
+	// its date and ExpireTime its minute for the panel, both in the
+	// time zone of the Server.
+	ExpiresAt  time.Time `json:"-"`
+	ExpireTime string    `json:"-"`
+
+	// Metadata is kept by the manager, Created is its date in the
+	// time zone of the Server for the panel.
+	Metadata Metadata `json:"-"`
+	Created  string   `json:"-"`
+
+	// Spark draws the daily usage of the last days, whose sum is
+	// Recent, as the points of an svg polyline.
+	Spark  string  `json:"-"`
+	Recent ByteNum `json:"-"`
+
+	// Quota is the billing cycle of the key, nil for none. QuotaGB is
+	// its size for the panel, CycleUsed the data transferred in the
+	// cycle and CycleEnd when the quota renews.
+	Quota     *Quota    `json:"-"`
+	QuotaGB   int       `json:"-"`
+	CycleUsed ByteNum   `json:"-"`
+	CycleEnd  time.Time `json:"-"`
+}
+
+func newOutlineUser(key *api.AccessKey) *OutlineUser {
+	return &OutlineUser{
+		ID:        key.ID,
+		Name:      key.Name,
+		Password:  key.Password,
+		Port:      key.Port,
+		Method:    key.Method,
+		AccessURL: key.AccessURL,
+		DataLimit: key.DataLimit,
+	}
 }
 
 // Outline apiUrl
 // https://127.0.0.1:56298/QQR9pcgCRP_g5OLX3n-w-g
 type OutlineServer struct {
-	ID    uint32  `json:"_,omitempty"`
-	URL   string  `json:"_,omitempty"`
-	GoURL string  `json:"_,omitempty"`
-	Total ByteNum `json:"_,omitempty"`
-
-	Name                 string `json:"name"`
-	ServerID             string `json:"serverId"`
-	MetricsEnabled       bool   `json:"metricsEnabled"`
-	CreatedTimestampMs   uint64 `json:"createdTimestampMs"`
-	PortForNewAccessKeys int    `json:"portForNewAccessKeys"`
-
-	sync.Mutex `json:"_,omitempty"`
-	logger     *zap.Logger             `json:"_,omitempty"`
-	Users      map[string]*OutlineUser `json:"_,omitempty"`
-}
-
-func NewOutlineServer(id uint32, server string, l *zap.Logger) *OutlineServer {
-	uri, _ := url.Parse(server)
-	n, _ := strconv.Atoi(uri.Port())
-	uri.Host = uri.Hostname()+":"+strconv.Itoa(n+1)
-	uri.Scheme = "http"
+	ID    string `json:"-"`
+	Label string `json:"-"`
+	URL   string `json:"-"`
+	GoURL string `json:"-"`
+
+	// API and Sidecar are the clients used to manage the server,
+	// they can be replaced by mocks in tests. Sidecar is nil when
+	// the server has none. Calls through the clients made by
+	// NewOutlineServer are recorded in the upstream metrics.
+	API     api.Management `json:"-"`
+	Sidecar api.Sidecar    `json:"-"`
+
+	logger *zap.Logger
+	group  *Server
+	// store is set by the Server before the first refresh, nil when
+	// the manager has no store.
+	store *Store
+	// expiryMu serializes expiring, renewing and data limit changes.
+	expiryMu sync.Mutex
+	// quotaMu serializes quota changes and renewals.
+	quotaMu sync.Mutex
+
+	// snapshot is replaced as a whole by Refresh, readers never
+	// see a partly fetched state
+	refreshMu sync.Mutex
+	snapshot  atomic.Pointer[Snapshot]
+	// failing is set while refreshes fail
+	failing atomic.Bool
+	// sidecarDown is set while the sidecar does not answer, the keys
+	// are shown as on a server without one meanwhile
+	sidecarDown atomic.Bool
+	// observed is set once the upstream metrics have a series of the
+	// server, see forgetMetrics
+	observed atomic.Bool
+}
+
+func NewOutlineServer(config Config, l *zap.Logger) (*OutlineServer, error) {
+	client, err := config.httpClient()
+	if err != nil {
+		return nil, err
+	}
 	s := &OutlineServer{
-		ID:     id,
-		URL:    server,
-		GoURL:  uri.String(),
+		ID:     config.ID,
+		Label:  config.Label,
+		URL:    config.APIURL,
+		GoURL:  config.sidecarURL(),
 		logger: l,
-		Users:  make(map[string]*OutlineUser),
 	}
-	return s
+	s.API = instrumentedAPI{next: api.NewClient(config.APIURL, client), server: s}
+	if s.GoURL != "" {
+		s.Sidecar = instrumentedSidecar{next: api.NewSidecarClient(s.GoURL, client), server: s}
+	}
+	return s, nil
 }
 
-func (s *OutlineServer) GetServerInfo() error {
-	req, err := http.NewRequest(http.MethodGet, s.URL+"/server", nil)
-	if err != nil {
-		return err
-	}
-	req.Header.Add("Content-Type", "application/json")
+// Prefix is the root of the routes of this server.
+func (s *OutlineServer) Prefix() string {
+	return BasePath + "/servers/" + s.ID
+}
 
-	r, err := unsafeClient.Do(req)
+func (s *OutlineServer) GetServerInfo(ctx context.Context) (ServerInfo, error) {
+	info, err := s.API.GetServer(ctx)
 	if err != nil {
-		return err
-	}
-	if r.StatusCode != http.StatusOK {
-		return errors.New("status code error, code: " + strconv.Itoa(r.StatusCode))
+		return ServerInfo{}, err
 	}
+	return newServerInfo(info), nil
+}
 
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return err
+// RenameServer: curl -X PUT baseurl/server/name?name=test
+func (s *OutlineServer) RenameServer(ctx context.Context, name string) error {
+	s.logger.Info(fmt.Sprintf("rename server to %v", name))
+	if name == "" {
+		return api.ErrInvalidArgument
 	}
-	defer r.Body.Close()
+	return s.API.RenameServer(ctx, name)
+}
 
-	if err := json.Unmarshal(b, s); err != nil {
-		return err
+// SetHostname: curl -X PUT baseurl/server/hostname?hostname=example.com
+func (s *OutlineServer) SetHostname(ctx context.Context, hostname string) error {
+	s.logger.Info(fmt.Sprintf("set hostname for access keys to %v", hostname))
+	if hostname == "" {
+		return api.ErrInvalidArgument
 	}
+	return s.API.SetHostname(ctx, hostname)
+}
 
-	return nil
+// SetDefaultPort: curl -X PUT baseurl/server/port?port=443
+func (s *OutlineServer) SetDefaultPort(ctx context.Context, num string) error {
+	s.logger.Info(fmt.Sprintf("set port for new access keys to %v", num))
+	n, err := strconv.Atoi(num)
+	if err != nil || n <= 0 || n > 65535 {
+		return api.ErrInvalidArgument
+	}
+	return s.API.SetPortForNewAccessKeys(ctx, n)
 }
 
-// AddUser: curl -X POST baseurl
-func (s *OutlineServer) AddUser() (*OutlineUser, error) {
-	s.logger.Info("add new user")
-	req, err := http.NewRequest(http.MethodPost, s.URL+"/access-keys", nil)
-	if err != nil {
-		return nil, err
+// SetDefaultAllowance: curl -X PUT baseurl/server/data?allowance=50
+func (s *OutlineServer) SetDefaultAllowance(ctx context.Context, num string) error {
+	s.logger.Info(fmt.Sprintf("set default allowance to %v", num))
+	n, err := strconv.Atoi(num)
+	if err != nil || n < 0 {
+		return api.ErrInvalidLimit
 	}
-	req.Header.Add("Content-Type", "application/json")
+	return s.API.SetDefaultDataLimit(ctx, uint64(n)<<30)
+}
 
-	r, err := unsafeClient.Do(req)
+// RemoveDefaultAllowance: curl -X DELETE baseurl/server/data
+func (s *OutlineServer) RemoveDefaultAllowance(ctx context.Context) error {
+	s.logger.Info("remove default allowance")
+	return s.API.RemoveDefaultDataLimit(ctx)
+}
+
+// SetMetricsEnabled: curl -X PUT baseurl/server/metrics?enabled=true
+func (s *OutlineServer) SetMetricsEnabled(ctx context.Context, enabled string) error {
+	s.logger.Info(fmt.Sprintf("set metrics sharing to %v", enabled))
+	b, err := strconv.ParseBool(enabled)
 	if err != nil {
-		return nil, err
-	}
-	if r.StatusCode != http.StatusCreated {
-		return nil, errors.New("status code error, code: " + strconv.Itoa(r.StatusCode))
+		return api.ErrInvalidArgument
 	}
+	return s.API.SetMetricsEnabled(ctx, b)
+}
 
-	b, err := ioutil.ReadAll(r.Body)
+// AddUser: curl -X POST baseurl
+func (s *OutlineServer) AddUser(ctx context.Context, opts api.NewAccessKey) (*OutlineUser, error) {
+	s.logger.Info(fmt.Sprintf("add new user %v", opts.ID))
+	key, err := s.API.CreateAccessKey(ctx, opts)
 	if err != nil {
 		return nil, err
 	}
-	defer r.Body.Close()
-
-	user := &OutlineUser{}
-	if err := json.Unmarshal(b, user); err != nil {
-		return nil, err
+	if err := s.recordCreation(ctx, key.ID); err != nil {
+		s.logger.Error(fmt.Sprintf("record user %v creation error: %v", key.ID, err))
 	}
-
-	return user, nil
+	s.notify(ctx, Event{Type: EventKeyCreated, KeyID: key.ID, KeyName: key.Name})
+	return newOutlineUser(key), nil
 }
 
 // DeleteUser: curl -X DELETE baseurl?id=1
-func (s *OutlineServer) DeleteUser(id string) error {
+func (s *OutlineServer) DeleteUser(ctx context.Context, id string) error {
 	s.logger.Info(fmt.Sprintf("delete user %v", id))
-	req, err := http.NewRequest(http.MethodDelete, s.URL+"/access-keys/"+id, nil)
-	if err != nil {
+	if err := s.API.DeleteAccessKey(ctx, id); err != nil {
 		return err
 	}
-
-	r, err := unsafeClient.Do(req)
-	if err != nil {
-		return err
+	event := Event{Type: EventKeyDeleted, KeyID: id}
+	if user := s.Snapshot().User(id); user != nil {
+		event.KeyName = user.Name
 	}
-	if r.StatusCode != http.StatusNoContent {
-		return errors.New("status code error, code: " + strconv.Itoa(r.StatusCode))
+	s.notify(ctx, event)
+	if s.store == nil {
+		return nil
 	}
-
-	return nil
+	return s.store.DeleteKey(s.ID, id)
 }
 
 // SetAllowance: curl -X PUT baseurl?id=1&allowance=50
-func (s *OutlineServer) SetAllowance(id, num string) error {
+func (s *OutlineServer) SetAllowance(ctx context.Context, id, num string) error {
 	s.logger.Info(fmt.Sprintf("set user %v allowance to %v", id, num))
 	n, err := strconv.Atoi(num)
-	if err != nil {
-		return err
+	if err != nil || n < 0 {
+		return api.ErrInvalidLimit
 	}
-	type Limit struct {
-		Bytes uint64 `json:"bytes"`
-	}
-	type Limitor struct {
-		Limit `json:"limit"`
-	}
-	limit := Limitor{Limit: Limit{Bytes: uint64(n)<<30}}
-	b, err := json.Marshal(limit)
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest(http.MethodPut, s.URL+"/access-keys/"+id+"/data-limit", bytes.NewReader(b))
-	if err != nil {
-		return err
-	}
-	req.Header.Add("Content-Type", "application/json")
+	bytes := uint64(n) << 30
+	return s.setDataLimit(ctx, id, &bytes)
+}
 
-	r, err := unsafeClient.Do(req)
-	if err != nil {
-		return err
-	}
-	if r.StatusCode != http.StatusNoContent {
-		switch r.StatusCode {
-		case http.StatusBadRequest:
-			return errors.New("invalid data limit")
-		case http.StatusNotFound:
-			return errors.New("access key inexistent")
-		}
-		return errors.New("status code error, code: " + strconv.Itoa(r.StatusCode))
-	}
-	return nil
+// RemoveAllowance: curl -X DELETE baseurl?id=1
+func (s *OutlineServer) RemoveAllowance(ctx context.Context, id string) error {
+	s.logger.Info(fmt.Sprintf("remove user %v allowance", id))
+	return s.setDataLimit(ctx, id, nil)
 }
 
 // RenameUser: curl -X PUT baseurl?id=1&name=test1
-func (s *OutlineServer) RenameUser(id, n string) error {
+func (s *OutlineServer) RenameUser(ctx context.Context, id, n string) error {
 	s.logger.Info(fmt.Sprintf("rename user %v name to %v", id, n))
-	type Name struct {
-		Name string `json:"name"`
-	}
-
-	name := Name{Name: n}
-	b, err := json.Marshal(&name)
-	if err != nil {
+	if err := s.API.RenameAccessKey(ctx, id, n); err != nil {
 		return err
 	}
-
-	req, err := http.NewRequest(http.MethodPut, s.URL+"/access-keys/"+id+"/name", bytes.NewReader(b))
-	if err != nil {
-		return err
+	event := Event{Type: EventKeyRenamed, KeyID: id, KeyName: n}
+	if user := s.Snapshot().User(id); user != nil {
+		event.OldName = user.Name
 	}
-	req.Header.Add("Content-Type", "application/json")
+	s.notify(ctx, event)
+	return nil
+}
 
-	r, err := unsafeClient.Do(req)
-	if err != nil {
-		return err
-	}
-	if r.StatusCode != http.StatusNoContent {
-		return errors.New("status code error, code: " + strconv.Itoa(r.StatusCode))
-	}
+// HasSidecar reports whether the server has a go/manager sidecar
+// which answered the last refresh.
+func (s *OutlineServer) HasSidecar() bool {
+	return s.Sidecar != nil && !s.sidecarDown.Load()
+}
 
-	return nil
+// HasExpiry reports whether keys of the server can expire,
+// by the store of the manager or by the sidecar.
+func (s *OutlineServer) HasExpiry() bool {
+	return s.store != nil || s.Sidecar != nil
 }
 
 // api with customized outline vpn server
 // change key status and set deadline of key
-func (s *OutlineServer) ChangeGoUserStatus(id string) error {
+func (s *OutlineServer) ChangeGoUserStatus(ctx context.Context, id string) error {
 	s.logger.Info(fmt.Sprintf("change go user %v status", id))
-
-	req, err := http.NewRequest(http.MethodPatch, s.GoURL+"/go/manager?id="+id, nil)
-	if err != nil {
-		return err
+	if s.Sidecar == nil {
+		return api.ErrNoSidecar
 	}
-	req.Header.Add("Content-Type", "application/json")
-
-	r, err := unsafeClient.Do(req)
-	if err != nil {
+	if err := s.Sidecar.ToggleUser(ctx, id); err != nil {
 		return err
 	}
-	if r.StatusCode != http.StatusOK {
-		return errors.New("status code error, code: " + strconv.Itoa(r.StatusCode))
+	// the snapshot has the state before the toggle
+	if user := s.Snapshot().User(id); user != nil {
+		event := Event{Type: EventKeyDisabled, KeyID: id, KeyName: user.Name}
+		if !user.Enabled {
+			event.Type = EventKeyEnabled
+		}
+		s.notify(ctx, event)
 	}
-
 	return nil
 }
 
-func (s *OutlineServer) SetGoUserDeadline(id, days string) error {
-	s.logger.Info(fmt.Sprintf("set go user %v deadline to %v days", id, days))
-
-	req, err := http.NewRequest(http.MethodPut, s.GoURL+"/go/manager?id="+id+"&deadline="+days, nil)
-	if err != nil {
-		return err
-	}
-	req.Header.Add("Content-Type", "application/json")
-
-	r, err := unsafeClient.Do(req)
-	if err != nil {
-		return err
-	}
-	if r.StatusCode != http.StatusOK {
-		return errors.New("status code error, code: " + strconv.Itoa(r.StatusCode))
-	}
-
-	return nil
-}
-
-func (s *OutlineServer) SetGoDataLimit(id, num string) error {
+func (s *OutlineServer) SetGoDataLimit(ctx context.Context, id, num string) error {
 	s.logger.Info(fmt.Sprintf("set go user %v data limit to %v", id, num))
-
-	req, err := http.NewRequest(http.MethodPost, s.GoURL+"/go/manager?id="+id+"&limit="+num, nil)
-	if err != nil {
-		return err
-	}
-	req.Header.Add("Content-Type", "application/json")
-
-	r, err := unsafeClient.Do(req)
-	if err != nil {
-		return err
+	n, err := strconv.Atoi(num)
+	if err != nil || n < 0 {
+		return api.ErrInvalidLimit
 	}
-	if r.StatusCode != http.StatusOK {
-		return errors.New("status code error, code: " + strconv.Itoa(r.StatusCode))
+	if !s.HasSidecar() {
+		// the limit set through the Outline API is all there is
+		return nil
 	}
-
-	return nil
+	return s.Sidecar.SetLimit(ctx, id, n)
 }
 
-func (s *OutlineServer) GetGoUser() ([]*GoUser, error) {
-	req, err := http.NewRequest(http.MethodGet, s.GoURL+"/go/manager", nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("Content-Type", "application/json")
-
-	r, err := unsafeClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	if r.StatusCode != http.StatusOK {
-		return nil, errors.New("status code error, code: " + strconv.Itoa(r.StatusCode))
-	}
-
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return nil, err
-	}
-	defer r.Body.Close()
-
-	type Status struct {
-		Status []*GoUser `json:"status"`
+// gigabytes returns bytes in GB for SetGoDataLimit, rounded up so that
+// a limit below 1 GB is not listed as none.
+func gigabytes(bytes uint64) string {
+	gb := bytes >> 30
+	if bytes&(1<<30-1) != 0 {
+		gb++
 	}
-
-	status := Status{}
-	if err := json.Unmarshal(b, &status); err != nil {
-		return nil, err
-	}
-
-	return status.Status, nil
+	return strconv.FormatUint(gb, 10)
 }
 
-func (s *OutlineServer) GetUsage() (map[string]uint64, error) {
-	req, err := http.NewRequest(http.MethodGet, s.URL+"/metrics/transfer", nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("Content-Type", "application/json")
-
-	r, err := unsafeClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	if r.StatusCode != http.StatusOK {
-		return nil, errors.New("status code error, code: " + strconv.Itoa(r.StatusCode))
-	}
-
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return nil, err
-	}
-	defer r.Body.Close()
-
-	type BytesTransferred struct {
-		ByUserID map[string]uint64 `json:"bytesTransferredByUserId"`
-	}
-
-	used := BytesTransferred{ByUserID: make(map[string]uint64)}
-	if err := json.Unmarshal(b, &used); err != nil {
-		return nil, err
+func (s *OutlineServer) GetGoUser(ctx context.Context) ([]*api.GoUser, error) {
+	if s.Sidecar == nil {
+		return nil, nil
 	}
+	return s.Sidecar.ListUsers(ctx)
+}
 
-	return used.ByUserID, nil
+func (s *OutlineServer) GetUsage(ctx context.Context) (map[string]uint64, error) {
+	return s.API.GetTransfer(ctx)
 }
 
 // GetAllUser: curl -X GET baseurl
-func (s *OutlineServer) GetAllUser() error {
+// It returns new users sorted by id, built from complete responses only
+// but for the sidecar: when it fails, the users are built without it.
+func (s *OutlineServer) GetAllUser(ctx context.Context) ([]*OutlineUser, error) {
 	s.logger.Info("get all users info")
-	s.Lock()
-	s.Users = make(map[string]*OutlineUser)
-	s.Unlock()
 
-	usage, err := s.GetUsage()
+	usage, err := s.GetUsage(ctx)
 	if err != nil {
-		return err
-	}
-	goUser, err := s.GetGoUser()
-	if err != nil {
-		return err
-	}
-
-	req, err := http.NewRequest(http.MethodGet, s.URL+"/access-keys", nil)
-	if err != nil {
-		return err
-	}
-	req.Header.Add("Content-Type", "application/json")
-
-	r, err := unsafeClient.Do(req)
-	if err != nil {
-		return err
+		return nil, err
 	}
-	if r.StatusCode != http.StatusOK {
-		return errors.New("status code error, code: " + strconv.Itoa(r.StatusCode))
+	goUser, err := s.GetGoUser(ctx)
+	switch {
+	case err != nil:
+		// as the default sidecar url is only a guess, do without it
+		goUser = nil
+		if !s.sidecarDown.Swap(true) {
+			s.logger.Error(fmt.Sprintf("sidecar of server %v is unreachable, show keys without it: %v", s.ID, err))
+		}
+	case s.sidecarDown.Swap(false):
+		s.logger.Info(fmt.Sprintf("sidecar of server %v is reachable again", s.ID))
 	}
-
-	b, err := ioutil.ReadAll(r.Body)
+	keys, err := s.API.ListAccessKeys(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer r.Body.Close()
-
-	type Users struct {
-		AccessKeys []*OutlineUser `json:"accessKeys"`
+	records := map[string]KeyRecord{}
+	if s.store != nil {
+		if records, err = s.store.Keys(s.ID); err != nil {
+			return nil, err
+		}
 	}
 
-	users := Users{}
-	if err := json.Unmarshal(b, &users); err != nil {
-		return err
-	}
-	s.Lock()
-	for _, user := range users.AccessKeys {
+	users := make(map[string]*OutlineUser, len(keys))
+	for _, key := range keys {
+		user := newOutlineUser(key)
 		n := usage[user.ID]
 		user.TransferredBytes = ByteNum(n)
-		s.Users[user.ID] = user
+		if user.DataLimit != nil {
+			user.Limit = int(user.DataLimit.Bytes >> 30)
+		}
+		users[user.ID] = user
 	}
 	for _, user := range goUser {
-		if usr, ok := s.Users[user.ID]; ok {
+		if usr, ok := users[user.ID]; ok {
 			usr.IP = user.IP
 			usr.Enabled = user.Enabled
 			if user.Enabled {
@@ -446,198 +405,668 @@ func (s *OutlineServer) GetAllUser() error {
 		}
 	}
 	now := time.Now()
-	for _, usr := range s.Users {
+	loc := s.location()
+	list := make([]*OutlineUser, 0, len(users))
+	for _, usr := range users {
 		if usr.EnColor == "" {
 			usr.Enabled = true
 		}
+		usr.JSID = template.JS("\"" + usr.ID + "\"")
 		usr.AccessURL = strings.TrimSuffix(usr.AccessURL, "/?outline=1") + "#YnamlyVPN"
-		usr.Expire = now.Add(time.Hour * 24 * time.Duration(usr.DaysLeft)).Format("2006-01-02")
+		if rec := records[usr.ID]; !rec.Expiry.IsZero() {
+			usr.ExpiresAt = rec.Expiry
+			usr.DaysLeft = daysLeft(rec.Expiry, now)
+		} else if usr.DaysLeft > 0 {
+			// until the deadline of the sidecar is adopted
+			usr.ExpiresAt = now.AddDate(0, 0, usr.DaysLeft)
+		}
+		if !usr.ExpiresAt.IsZero() {
+			usr.ExpiresAt = usr.ExpiresAt.In(loc)
+			usr.Expire = usr.ExpiresAt.Format("2006-01-02")
+			usr.ExpireTime = usr.ExpiresAt.Format("2006-01-02T15:04")
+		}
+		usr.Metadata = records[usr.ID].Metadata
+		if !usr.Metadata.Created.IsZero() {
+			usr.Created = usr.Metadata.Created.In(loc).Format("2006-01-02")
+		}
+		if q := records[usr.ID].Quota; q != nil {
+			usr.Quota = q
+			usr.QuotaGB = int(q.Bytes >> 30)
+			usr.CycleEnd = q.cycleEnd(loc)
+		}
+		if rec := records[usr.ID]; rec.Expired {
+			usr.Expired = true
+			usr.Enabled = false
+			// show the limit the key gets back when renewed
+			usr.Limit = 0
+			if rec.SavedLimit != nil {
+				usr.Limit = int(*rec.SavedLimit >> 30)
+			}
+		}
+		list = append(list, usr)
 	}
-	s.Unlock()
+	sortUsers(list)
 
-	return nil
+	return list, nil
 }
 
-func (s *OutlineServer) SetRouter(prefix string, r *http.ServeMux) {
+// SetRouter registers the panel routes of the server under prefix,
+// each with the Operation documenting it.
+func (s *OutlineServer) SetRouter(prefix string, r Router) {
 	// baseurl GET
 	// GetAllUsers
-	r.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
-			return
-		}
-
-		if err := s.GetAllUser(); err != nil {
-			s.logger.Error(fmt.Sprintf("get all user error: %v", err))
-		}
-		s.Lock()
-		users := make([]*OutlineUser, 0, len(s.Users))
-		for _, user := range s.Users {
-			user.JSID = template.JS("\"" + user.ID + "\"")
-			users = append(users, user)
-		}
-		s.Unlock()
-
-		sort.Slice(users, func(i, j int) bool {
-			if len(users[i].ID) < len(users[j].ID) {
-				return true
-			}
-			if len(users[i].ID) > len(users[j].ID) {
-				return false
-			}
-			return users[i].ID < users[j].ID
-		})
-
+	r.Handle(Operation{
+		ID:      "showPanel",
+		Method:  http.MethodGet,
+		Path:    prefix,
+		Role:    RoleViewer,
+		Summary: "Show the panel of a server",
+		HTML:    true,
+	}, func(w http.ResponseWriter, r *http.Request) {
 		type Info struct {
-			Server *OutlineServer
-			Users  []*OutlineUser
+			Server    ServerInfo
+			Servers   []ServerEntry
+			Users     []*OutlineUser
+			Total     ByteNum
+			Refreshed string
+			Sidecar   bool
+			Expiry    bool
+			Store     bool
+			Report    string
+			TimeZone  string
+			Operator  bool
+			Owner     bool
 		}
-		info := Info{Server: s, Users: users}
-		usage, err := s.GetUsage()
-		if err != nil {
-			s.logger.Error(fmt.Sprintf("get all user usage: %v", err))
-			return
+		snap := s.Snapshot()
+		role := RoleFromContext(r.Context())
+		info := Info{
+			Server:    snap.Info,
+			Users:     snap.Users,
+			Total:     snap.Total,
+			Refreshed: snap.Refreshed.Format("2006-01-02 15:04:05"),
+			Sidecar:   s.HasSidecar(),
+			Expiry:    s.HasExpiry(),
+			Store:     s.store != nil,
+			TimeZone:  s.location().String(),
+			Operator:  role >= RoleOperator,
+			Owner:     role >= RoleOwner,
 		}
-		s.Lock()
-		info.Server.Total = 0
-		for _, v := range usage {
-			info.Server.Total += ByteNum(v)
+		if s.store != nil && s.ID != "" {
+			info.Report = APIPath + "/servers/" + s.ID + "/report"
+		}
+		if s.group != nil {
+			info.Servers = s.group.Entries(s)
 		}
-		s.Unlock()
 		if err := serverPanelTemplate.Execute(w, info); err != nil {
 			s.logger.Error(fmt.Sprintf("template error: %v", err))
 		}
 	})
 
+	// baseurl/refresh POST
+	// fetch the users now instead of waiting for the next poll
+	r.Handle(Operation{
+		ID:      "refreshPanel",
+		Method:  http.MethodPost,
+		Path:    prefix + "/refresh",
+		Role:    RoleViewer,
+		Summary: "Fetch the keys now instead of waiting for the next poll",
+	}, func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Refresh(r.Context()); err != nil {
+			s.logger.Error(fmt.Sprintf("refresh error: %v", err))
+			httpError(w, err)
+			return
+		}
+	})
+
 	// baseurl POST
-	// AddUser
-	r.HandleFunc(prefix+"/user", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
+	// id={id}&name={name}&method={cipher}&password={password}&port={port}&allowance={GB}&days={days}
+	// &quota={GB}&contact={contact}&plan={plan}&notes={notes}&field.{name}={value}
+	// AddUser, every value is optional, days defaults to 30
+	r.Handle(Operation{
+		ID:      "addUser",
+		Method:  http.MethodPost,
+		Path:    prefix + "/user",
+		Role:    RoleOperator,
+		Summary: "Create an access key, days defaults to 30, field.{name} sets a custom field",
+		Form:    []string{"id", "name", "method", "password", "port", "allowance", "days", "quota", "contact", "plan", "notes"},
+		Status:  http.StatusCreated,
+	}, func(w http.ResponseWriter, r *http.Request) {
+		opts, err := parseNewAccessKey(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// check every value before creating the key, a key is not
+		// deleted when a later step fails
+		var expiry time.Time
+		if s.HasExpiry() {
+			days := 30
+			if v := r.FormValue("days"); v != "" {
+				if days, err = strconv.Atoi(v); err != nil {
+					httpError(w, api.ErrInvalidArgument)
+					return
+				}
+			}
+			if expiry, err = expiryIn(days); err != nil {
+				httpError(w, err)
+				return
+			}
+		}
+		var quota *uint64
+		if v := r.FormValue("quota"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				httpError(w, api.ErrInvalidLimit)
+				return
+			}
+			quota = new(uint64)
+			*quota = uint64(n) << 30
+		}
+		patch := metadataForm(r)
+		if (quota != nil || !patch.empty()) && s.store == nil {
+			httpError(w, ErrNoStore)
+			return
+		}
+		if err := patch.validate(); err != nil {
+			httpError(w, err)
 			return
 		}
 
-		user, err := s.AddUser()
+		ctx := r.Context()
+		user, err := s.AddUser(ctx, opts)
 		if err != nil {
 			s.logger.Error(fmt.Sprintf("add new user error: %v", err))
-			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
+			httpError(w, err)
 			return
 		}
-		if err := s.SetGoUserDeadline(user.ID, "30"); err != nil {
-			s.logger.Error(fmt.Sprintf("set go user deadline error: %v", err))
-			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
-			return
+		steps := []step{}
+		if s.HasExpiry() {
+			steps = append(steps, step{"set expiry", func() error { return s.SetExpiry(ctx, user.ID, expiry) }})
+		}
+		if allowance := r.FormValue("allowance"); allowance != "" {
+			steps = append(steps, step{"set data limit", func() error { return s.SetGoDataLimit(ctx, user.ID, allowance) }})
+		}
+		if quota != nil {
+			steps = append(steps, step{"set quota", func() error { return s.SetQuota(ctx, user.ID, *quota) }})
+		}
+		if !patch.empty() {
+			steps = append(steps, step{"set metadata", func() error { return s.SetMetadata(ctx, user.ID, patch) }})
+		}
+		_, failed, _ := s.runSteps(user.ID, steps)
+		s.refreshAfter(ctx)
+		w.WriteHeader(http.StatusCreated)
+		if len(failed) > 0 {
+			fmt.Fprintf(w, "access key %v was created, but:\n%v\n", user.ID, strings.Join(failed, "\n"))
 		}
 	})
 
 	// baseurl?id={id} DELETE
 	// delete user from server
-	r.HandleFunc(prefix+"/id", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodDelete {
+	r.Handle(Operation{
+		ID:      "deleteUser",
+		Method:  http.MethodDelete,
+		Path:    prefix + "/id",
+		Role:    RoleOwner,
+		Summary: "Delete an access key",
+		Query:   []string{"id"},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if id == "" {
 			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
 			return
 		}
+		if err := s.DeleteUser(r.Context(), id); err != nil {
+			s.logger.Error(fmt.Sprintf("delete user error: %v", err))
+			httpError(w, err)
+			return
+		}
+		s.refreshAfter(r.Context())
+	})
 
+	// baseurl?id={id} GET
+	// get a single user as json
+	r.Handle(Operation{
+		ID:       "getUser",
+		Method:   http.MethodGet,
+		Path:     prefix + "/key",
+		Role:     RoleViewer,
+		Summary:  "Get an access key as reported by Outline",
+		Query:    []string{"id"},
+		Response: api.AccessKey{},
+	}, func(w http.ResponseWriter, r *http.Request) {
 		id := r.URL.Query().Get("id")
 		if id == "" {
 			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
 			return
 		}
-		if err := s.DeleteUser(id); err != nil {
-			s.logger.Error(fmt.Sprintf("delete user error: %v", err))
-			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
+		key, err := s.API.GetAccessKey(r.Context(), id)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("get user error: %v", err))
+			httpError(w, err)
 			return
 		}
-		s.Lock()
-		delete(s.Users, id)
-		s.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(key)
 	})
 
 	// baseurl?id={id}&name={name} PUT
 	// rename a user
-	r.HandleFunc(prefix+"/name", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPut {
-			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
-			return
-		}
-
+	r.Handle(Operation{
+		ID:      "renameUser",
+		Method:  http.MethodPut,
+		Path:    prefix + "/name",
+		Role:    RoleOperator,
+		Summary: "Rename an access key",
+		Query:   []string{"id", "name"},
+	}, func(w http.ResponseWriter, r *http.Request) {
 		id := r.URL.Query().Get("id")
 		name := r.URL.Query().Get("name")
 		if id == "" {
 			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
 			return
 		}
-		if err := s.RenameUser(id, name); err != nil {
-			s.logger.Error(fmt.Sprintln("rename user error: %v", err))
-			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
+		if err := s.RenameUser(r.Context(), id, name); err != nil {
+			s.logger.Error(fmt.Sprintf("rename user error: %v", err))
+			httpError(w, err)
 			return
 		}
+		s.refreshAfter(r.Context())
 	})
 
 	// baseurl?id={id}?allowance={usage} PUT
 	// update key data allowance
-	r.HandleFunc(prefix+"/data", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPut {
-			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
-			return
-		}
-
+	r.Handle(Operation{
+		ID:      "setUserAllowance",
+		Method:  http.MethodPut,
+		Path:    prefix + "/data",
+		Role:    RoleOperator,
+		Summary: "Set the data limit of an access key in GB",
+		Query:   []string{"id", "allowance"},
+	}, func(w http.ResponseWriter, r *http.Request) {
 		id := r.URL.Query().Get("id")
 		allowance := r.URL.Query().Get("allowance")
 		if id == "" || allowance == "" {
 			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
 			return
 		}
-		if err := s.SetGoDataLimit(id, allowance); err != nil {
-			s.logger.Error(fmt.Sprintln("set go user allowance error: %v", err))
-			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
+		if err := s.SetGoDataLimit(r.Context(), id, allowance); err != nil {
+			s.logger.Error(fmt.Sprintf("set go user allowance error: %v", err))
+			httpError(w, err)
 			return
 		}
-		if err := s.SetAllowance(id, allowance); err != nil {
-			s.logger.Error(fmt.Sprintln("set user allowance error: %v", err))
-			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
+		if err := s.SetAllowance(r.Context(), id, allowance); err != nil {
+			s.logger.Error(fmt.Sprintf("set user allowance error: %v", err))
+			httpError(w, err)
 			return
 		}
+		s.refreshAfter(r.Context())
 	})
 
-	// baseurl?id={id}
-	// change user from enabled to disbled or vice verse
-	r.HandleFunc(prefix+"/status", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPatch {
+	// baseurl?id={id} DELETE
+	// remove key data allowance
+	r.Handle(Operation{
+		ID:      "removeUserAllowance",
+		Method:  http.MethodDelete,
+		Path:    prefix + "/data",
+		Role:    RoleOperator,
+		Summary: "Remove the data limit of an access key",
+		Query:   []string{"id"},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if id == "" {
 			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
 			return
 		}
+		if err := s.RemoveAllowance(r.Context(), id); err != nil {
+			s.logger.Error(fmt.Sprintf("remove user allowance error: %v", err))
+			httpError(w, err)
+			return
+		}
+		s.refreshAfter(r.Context())
+	})
 
+	// baseurl?id={id}
+	// change user from enabled to disbled or vice verse
+	r.Handle(Operation{
+		ID:      "toggleUser",
+		Method:  http.MethodPatch,
+		Path:    prefix + "/status",
+		Role:    RoleOperator,
+		Summary: "Enable a disabled access key or disable an enabled one",
+		Query:   []string{"id"},
+	}, func(w http.ResponseWriter, r *http.Request) {
 		id := r.URL.Query().Get("id")
 		if id == "" {
 			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
 			return
 		}
-		if err := s.ChangeGoUserStatus(id); err != nil {
-			s.logger.Error(fmt.Sprintln("change go user status error: %v", err))
-			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
+		if err := s.ChangeGoUserStatus(r.Context(), id); err != nil {
+			s.logger.Error(fmt.Sprintf("change go user status error: %v", err))
+			httpError(w, err)
 			return
 		}
+		s.refreshAfter(r.Context())
 	})
 
 	// baseurl?id={id}&time={days}
 	// set up the last day of this account
-	r.HandleFunc(prefix+"/deadline", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPut {
+	r.Handle(Operation{
+		ID:      "setUserDeadline",
+		Method:  http.MethodPut,
+		Path:    prefix + "/deadline",
+		Role:    RoleOperator,
+		Summary: "Set the days left of an access key, 0 for never",
+		Query:   []string{"id", "days"},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		days := r.URL.Query().Get("days")
+		if id == "" || days == "" {
 			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
 			return
 		}
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			httpError(w, api.ErrInvalidArgument)
+			return
+		}
+		expiry, err := expiryIn(n)
+		if err == nil {
+			err = s.SetExpiry(r.Context(), id, expiry)
+		}
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("set user expiry error: %v", err))
+			httpError(w, err)
+			return
+		}
+		s.refreshAfter(r.Context())
+	})
 
+	// baseurl?id={id}&date={date} PUT
+	// baseurl?id={id} DELETE
+	// baseurl?id={id}&days={days}&months={months} PATCH
+	// set, remove or extend the expiry of this account
+	expiry := func(change func(r *http.Request, id string) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			id := r.URL.Query().Get("id")
+			if id == "" {
+				http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
+				return
+			}
+			if err := change(r, id); err != nil {
+				s.logger.Error(fmt.Sprintf("change user expiry error: %v", err))
+				httpError(w, err)
+				return
+			}
+			s.refreshAfter(r.Context())
+		}
+	}
+	r.Handle(Operation{
+		ID:      "setUserExpiry",
+		Method:  http.MethodPut,
+		Path:    prefix + "/expiry",
+		Role:    RoleOperator,
+		Summary: "Set the expiry of an access key, RFC 3339 or a date and time in the time zone of the manager",
+		Query:   []string{"id", "date"},
+	}, expiry(func(r *http.Request, id string) error {
+		expiry, err := parseTime(r.URL.Query().Get("date"), s.location())
+		if err != nil {
+			return err
+		}
+		return s.SetExpiry(r.Context(), id, expiry)
+	}))
+	r.Handle(Operation{
+		ID:      "removeUserExpiry",
+		Method:  http.MethodDelete,
+		Path:    prefix + "/expiry",
+		Role:    RoleOperator,
+		Summary: "Make an access key never expire",
+		Query:   []string{"id"},
+	}, expiry(func(r *http.Request, id string) error {
+		return s.SetExpiry(r.Context(), id, time.Time{})
+	}))
+	r.Handle(Operation{
+		ID:      "extendUserExpiry",
+		Method:  http.MethodPatch,
+		Path:    prefix + "/expiry",
+		Role:    RoleOperator,
+		Summary: "Extend the expiry of an access key by days and months, from now if it has none or is past",
+		Query:   []string{"id", "days", "months"},
+	}, expiry(func(r *http.Request, id string) (err error) {
+		days, months := 0, 0
+		if v := r.URL.Query().Get("days"); v != "" {
+			if days, err = strconv.Atoi(v); err != nil {
+				return api.ErrInvalidArgument
+			}
+		}
+		if v := r.URL.Query().Get("months"); v != "" {
+			if months, err = strconv.Atoi(v); err != nil {
+				return api.ErrInvalidArgument
+			}
+		}
+		_, err = s.ExtendExpiry(r.Context(), id, days, months)
+		return err
+	}))
+
+	// baseurl?id={id}&quota={GB} PUT
+	// set the data of this account per monthly cycle, 0 to remove it
+	r.Handle(Operation{
+		ID:      "setUserQuota",
+		Method:  http.MethodPut,
+		Path:    prefix + "/quota",
+		Role:    RoleOperator,
+		Summary: "Set the data in GB an access key may transfer per monthly cycle, 0 to remove the quota and its data limit",
+		Query:   []string{"id", "quota"},
+	}, func(w http.ResponseWriter, r *http.Request) {
 		id := r.URL.Query().Get("id")
-		days := r.URL.Query().Get("days")
-		if id == "" || days == "" {
+		quota := r.URL.Query().Get("quota")
+		if id == "" || quota == "" {
 			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
 			return
 		}
-		if err := s.SetGoUserDeadline(id, days); err != nil {
-			s.logger.Error(fmt.Sprintln("set go user left days error: %v", err))
+		n, err := strconv.Atoi(quota)
+		if err != nil || n < 0 {
+			httpError(w, api.ErrInvalidLimit)
+			return
+		}
+		if err := s.SetQuota(r.Context(), id, uint64(n)<<30); err != nil {
+			s.logger.Error(fmt.Sprintf("set user quota error: %v", err))
+			httpError(w, err)
+			return
+		}
+		s.refreshAfter(r.Context())
+	})
+
+	// baseurl?id={id}&contact={contact}&plan={plan}&notes={notes}&created={date}&field.{name}={value} PUT
+	// change the metadata of this account, empty values clear it
+	r.Handle(Operation{
+		ID:      "setUserMetadata",
+		Method:  http.MethodPut,
+		Path:    prefix + "/metadata",
+		Role:    RoleOperator,
+		Summary: "Set the contact, plan, notes, created date and custom fields, as field.{name}, of an access key, empty to clear",
+		Query:   []string{"id", "contact", "plan", "notes", "created"},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if id == "" {
 			http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
 			return
 		}
+		patch := metadataForm(r)
+		if _, ok := r.URL.Query()["created"]; ok {
+			created := time.Time{}
+			if v := r.URL.Query().Get("created"); v != "" {
+				var err error
+				if created, err = parseTime(v, s.location()); err != nil {
+					httpError(w, err)
+					return
+				}
+			}
+			patch.Created = &created
+		}
+		if err := s.SetMetadata(r.Context(), id, patch); err != nil {
+			s.logger.Error(fmt.Sprintf("set user metadata error: %v", err))
+			httpError(w, err)
+			return
+		}
+		s.refreshAfter(r.Context())
+	})
+
+	// server settings, each a PUT with one query value
+	// baseurl/server/name?name={name}
+	// baseurl/server/hostname?hostname={hostname}
+	// baseurl/server/port?port={port}
+	// baseurl/server/data?allowance={GB}, DELETE to remove it
+	// baseurl/server/metrics?enabled={true|false}
+	setting := func(name string, set func(r *http.Request) error) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if err := set(r); err != nil {
+				s.logger.Error(fmt.Sprintf("set server %v error: %v", name, err))
+				httpError(w, err)
+				return
+			}
+			s.refreshAfter(r.Context())
+		}
+	}
+	settings := []struct {
+		id      string
+		name    string
+		param   string
+		summary string
+		set     func(ctx context.Context, v string) error
+	}{
+		{"renameServerSetting", "name", "name", "Rename the server", s.RenameServer},
+		{"setHostnameSetting", "hostname", "hostname", "Set the hostname of new access keys", s.SetHostname},
+		{"setPortSetting", "port", "port", "Set the port of new access keys", s.SetDefaultPort},
+		{"setDefaultAllowanceSetting", "data", "allowance", "Set the default data limit in GB", s.SetDefaultAllowance},
+		{"setMetricsSetting", "metrics", "enabled", "Enable or disable sharing metrics", s.SetMetricsEnabled},
+	}
+	for _, v := range settings {
+		r.Handle(Operation{
+			ID:      v.id,
+			Method:  http.MethodPut,
+			Path:    prefix + "/server/" + v.name,
+			Role:    RoleOwner,
+			Summary: v.summary,
+			Query:   []string{v.param},
+		}, setting(v.name, func(r *http.Request) error {
+			return v.set(r.Context(), r.URL.Query().Get(v.param))
+		}))
+	}
+	r.Handle(Operation{
+		ID:      "removeDefaultAllowanceSetting",
+		Method:  http.MethodDelete,
+		Path:    prefix + "/server/data",
+		Role:    RoleOwner,
+		Summary: "Remove the default data limit",
+	}, setting("data", func(r *http.Request) error {
+		return s.RemoveDefaultAllowance(r.Context())
+	}))
+}
+
+// sortUsers sorts users by numeric id, as Outline assigns them.
+func sortUsers(users []*OutlineUser) {
+	sort.Slice(users, func(i, j int) bool {
+		if len(users[i].ID) < len(users[j].ID) {
+			return true
+		}
+		if len(users[i].ID) > len(users[j].ID) {
+			return false
+		}
+		return users[i].ID < users[j].ID
 	})
 }
+
+// parseNewAccessKey reads the settings of a new key from the form of r.
+func parseNewAccessKey(r *http.Request) (opts api.NewAccessKey, err error) {
+	opts.ID = r.FormValue("id")
+	opts.Name = r.FormValue("name")
+	opts.Method = r.FormValue("method")
+	opts.Password = r.FormValue("password")
+	if port := r.FormValue("port"); port != "" {
+		if opts.Port, err = strconv.Atoi(port); err != nil || opts.Port <= 0 || opts.Port > 65535 {
+			return opts, fmt.Errorf("invalid port: %v", port)
+		}
+	}
+	if allowance := r.FormValue("allowance"); allowance != "" {
+		n, err := strconv.Atoi(allowance)
+		if err != nil || n < 0 {
+			return opts, api.ErrInvalidLimit
+		}
+		opts.Limit = &api.DataLimit{Bytes: uint64(n) << 30}
+	}
+	return opts, nil
+}
+
+// metadataForm returns a patch setting the contact, plan and notes
+// present in the form of r, and the custom fields named by field.{name}.
+func metadataForm(r *http.Request) (patch MetadataPatch) {
+	r.ParseForm()
+	for name, field := range map[string]**string{"contact": &patch.Contact, "plan": &patch.Plan, "notes": &patch.Notes} {
+		if _, ok := r.Form[name]; ok {
+			v := r.Form.Get(name)
+			*field = &v
+		}
+	}
+	for name := range r.Form {
+		if field, ok := strings.CutPrefix(name, "field."); ok {
+			if patch.Fields == nil {
+				patch.Fields = make(map[string]string)
+			}
+			patch.Fields[field] = r.Form.Get(name)
+		}
+	}
+	return patch
+}
+
+// step is a named change of a key, like one completing a new key.
+type step struct {
+	name string
+	run  func() error
+}
+
+// runSteps runs every step in order, and returns the names of the steps
+// applied, the failures with the messages of errorStatus and the first
+// error.
+func (s *OutlineServer) runSteps(id string, steps []step) (applied, failed []string, err error) {
+	for _, step := range steps {
+		stepErr := step.run()
+		if stepErr == nil {
+			applied = append(applied, step.name)
+			continue
+		}
+		s.logger.Error(fmt.Sprintf("%v of user %v error: %v", step.name, id, stepErr))
+		_, msg := errorStatus(stepErr)
+		failed = append(failed, step.name+": "+msg)
+		if err == nil {
+			err = stepErr
+		}
+	}
+	return applied, failed, err
+}
+
+// httpError answers a failed call to the Outline server.
+func httpError(w http.ResponseWriter, err error) {
+	code, msg := errorStatus(err)
+	http.Error(w, msg, code)
+}
+
+// errorStatus maps an error of the Outline server to a response status
+// and a message safe to show to the admin.
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, api.ErrKeyNotFound):
+		return http.StatusNotFound, err.Error()
+	case errors.Is(err, api.ErrInvalidLimit), errors.Is(err, api.ErrInvalidArgument):
+		return http.StatusBadRequest, err.Error()
+	case errors.Is(err, api.ErrPortInUse), errors.Is(err, api.ErrKeyExists):
+		return http.StatusConflict, err.Error()
+	case errors.Is(err, api.ErrNoSidecar), errors.Is(err, ErrNoStore):
+		return http.StatusNotImplemented, err.Error()
+	case isStoreError(err):
+		return http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+	default:
+		// errors of the http client carry the secret api url
+		return http.StatusBadGateway, http.StatusText(http.StatusBadGateway)
+	}
+}
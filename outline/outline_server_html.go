@@ -34,20 +34,48 @@ tr:nth-child(odd) {
 
 <body onload = "JavaScript:auto_fresh(5000);">
 
-<h2 id="outline-title">Outline Manager - {{ .Server.Total }} - <button type="button" onclick="add_user();">ADD USER</button><button type="button" id="button-refresh" onclick="set_refresh();">REFRESH ON</button><button type="button" onclick="exit();">EXIT</button></h2>
+<h2 id="outline-title">Outline Manager - {{ .Total }} - {{ if .Operator }}<button type="button" onclick="add_user();">ADD USER</button>{{ end }}<button type="button" id="button-refresh" onclick="set_refresh();">REFRESH ON</button><button type="button" onclick="refresh_now();">REFRESH NOW</button><button type="button" onclick="exit();">EXIT</button></h2>
+<p>Last refreshed: {{ .Refreshed }}{{ if .Expiry }}  Expiry time zone: {{ .TimeZone }}{{ end }}</p>
+
+{{ if .Operator }}
+<p>New Key: ID <input id="new-id" value="" size="3"/>
+  Name <input id="new-name" value="" size="8"/>
+  Cipher <select id="new-method"><option value="">default</option><option value="chacha20-ietf-poly1305">chacha20-ietf-poly1305</option><option value="aes-256-gcm">aes-256-gcm</option><option value="aes-192-gcm">aes-192-gcm</option><option value="aes-128-gcm">aes-128-gcm</option></select>
+  Password <input id="new-password" value="" size="10"/>
+  Port <input id="new-port" value="" size="5"/>
+  Data Limit <input id="new-allowance" value="" size="4"/>GB{{ if .Expiry }}
+  Days <input id="new-days" value="30" size="3"/>{{ end }}{{ if .Store }}
+  Quota <input id="new-quota" value="" size="3"/>GB/month
+  Contact <input id="new-contact" value="" size="10"/>
+  Plan <input id="new-plan" value="" size="6"/>
+  Notes <input id="new-notes" value="" size="15"/>
+  Field <input id="new-field-name" value="" size="6" placeholder="name"/>=<input id="new-field-value" value="" size="8"/>{{ end }}</p>
+{{ end }}
+
+{{ if .Report }}
+<form method="get" action="{{ .Report }}"><p>Report: From <input type="date" name="from"/>
+  To <input type="date" name="to"/>
+  <select name="format"><option value="csv">CSV</option><option value="json">JSON</option></select>
+  <button type="submit">EXPORT</button></p></form>
+{{ end }}
+
+<p>Servers:{{ range .Servers }} | {{ if .Current }}<b>{{ .Name }}</b>{{ else if .Ready }}<a href="{{ .Link }}">{{ .Name }}</a>{{ else }}{{ .Name }} (connecting){{ end }}{{ end }}</p>
 
 <table>
   <tr>
     <th>ID</th>
     <th>Name</th>
-    <th>Expire Date</th>
+    {{ if .Expiry }}<th>Expires</th>{{ end }}
     <th>Access URL</th>
     <th>Transferred</th>
     <th>Data Limit</th>
+    {{ if .Sidecar }}
     <th>Client IP</th>
     <th>Online</th>
     <th>Enabled</th>
-    <th>Days Left</th>
+    {{ end }}
+    {{ if .Expiry }}<th>Days Left</th>{{ end }}
+    {{ if .Store }}<th>Customer</th>{{ end }}
     <th></th>
   </tr>
   {{ range .Users }}
@@ -56,39 +84,250 @@ tr:nth-child(odd) {
     <td>
       <input id="name-{{ .ID }}" value="{{ .Name }}" size="5" onkeydown="if(event.keyCode==13){rename_user({{ .JSID }});return false}"/>
     </td>
-    <td>{{ .Expire }}</td>
+    {{ if $.Expiry }}
+    <td>
+      <input type="datetime-local" id="expiry-{{ .ID }}" value="{{ .ExpireTime }}"/>
+      <button type="button" onclick="set_expiry({{ .JSID }});">SET</button>
+      <button type="button" onclick="remove_expiry({{ .JSID }});">NEVER</button>
+    </td>
+    {{ end }}
     <td>
       <input type="text" value="{{ .AccessURL }}" id="url-{{ .ID }}" size="50"/>
       <button type="button" onclick="copy_ss_url({{ .JSID }});">COPY</button>
     </td>
-    <td>{{ .TransferredBytes }}</td>
+    <td>{{ .TransferredBytes }}{{ if .Spark }}
+      <svg width="70" height="16"><title>last 14 days: {{ .Recent }}</title><polyline points="{{ .Spark }}" fill="none" stroke="#3366cc"/></svg>{{ end }}
+    </td>
     <td>
-      <input id="data-{{ .ID }}" value="{{ .Limit }}" size="4" onkeydown="if(event.keyCode==13){set_data_limit({{ .JSID }});return false}"/>GB
+      <input id="data-{{ .ID }}" value="{{ .Limit }}" size="4" onkeydown="if(event.keyCode==13){set_data_limit({{ .JSID }});return false}"/>GB{{ if .Expired }} <b>expired</b>{{ end }}{{ if $.Store }}
+      Quota <input id="quota-{{ .ID }}" value="{{ .QuotaGB }}" size="3" onkeydown="if(event.keyCode==13){set_quota({{ .JSID }});return false}"/>GB/month{{ if .Quota }}
+      used {{ .CycleUsed }}, renews {{ .CycleEnd.Format "2006-01-02" }}{{ end }}{{ end }}
     </td>
+    {{ if $.Sidecar }}
     <td>{{ .IP }}</td>
     <td bgcolor="{{ .OnColor }}">{{ .Online }}</td>
     <td bgcolor="{{ .EnColor }}">{{ .Enabled }}<button type="button" onclick="change_user_status({{ .JSID }})">SWITCH</button></td>
+    {{ end }}
+    {{ if $.Expiry }}
     <td>
       <input id="time-{{ .ID }}" value="{{ .DaysLeft }}" size="2" onkeydown="if(event.keyCode==13){set_deadline({{ .JSID }});return false}"/>
+      +<input id="extend-{{ .ID }}" value="1" size="2"/><select id="extend-unit-{{ .ID }}"><option value="months">months</option><option value="days">days</option></select>
+      <button type="button" onclick="extend_expiry({{ .JSID }});">EXTEND</button>
+    </td>
+    {{ end }}
+    {{ if $.Store }}
+    <td>
+      Contact <input id="contact-{{ .ID }}" value="{{ .Metadata.Contact }}" size="10"/>
+      Plan <input id="plan-{{ .ID }}" value="{{ .Metadata.Plan }}" size="6"/>
+      Notes <input id="notes-{{ .ID }}" value="{{ .Metadata.Notes }}" size="15"/>
+      Created <input type="date" id="created-{{ .ID }}" value="{{ .Created }}"/>{{ if .Metadata.CreatedBy }} by {{ .Metadata.CreatedBy }}{{ end }}{{ $id := .ID }}{{ range $name, $value := .Metadata.Fields }}
+      {{ $name }} <input class="field-{{ $id }}" data-name="{{ $name }}" value="{{ $value }}" size="8"/>{{ end }}
+      Field <input id="field-name-{{ .ID }}" value="" size="6" placeholder="name"/>=<input id="field-value-{{ .ID }}" value="" size="8"/>
+      <button type="button" onclick="set_metadata({{ .JSID }});">SAVE</button>
     </td>
+    {{ end }}
     <td>
-      <button type="button" onclick="delete_user({{ .JSID }});">DELETE</button>
+      {{ if $.Owner }}<button type="button" onclick="delete_user({{ .JSID }});">DELETE</button>{{ end }}
     </td>
   </tr>
   {{ end }}
 </table>
 
-<p>Admin Settings: Username: <input id="username" value="" size="10"/>  Password: <input id="password" type="password" value="" size="10"/><button type="button" onclick="set_manager();">MODIFY</button></p>
+{{ if .Owner }}
+<h3>Server Settings</h3>
+<p>Name: <input id="server-name" value="{{ .Server.Name }}" size="10" onkeydown="if(event.keyCode==13){set_server('name', 'name');return false}"/>
+  Hostname: <input id="server-hostname" value="{{ .Server.HostnameForAccessKeys }}" size="15" onkeydown="if(event.keyCode==13){set_server('hostname', 'hostname');return false}"/>
+  Port For New Keys: <input id="server-port" value="{{ .Server.PortForNewAccessKeys }}" size="5" onkeydown="if(event.keyCode==13){set_server('port', 'port');return false}"/>
+  Default Data Limit: <input id="server-data" value="{{ .Server.DefaultLimit }}" size="4" onkeydown="if(event.keyCode==13){set_server('data', 'allowance');return false}"/>GB
+  Share Metrics: <select id="server-metrics" onchange="set_server('metrics', 'enabled');"><option value="true" {{ if .Server.MetricsEnabled }}selected{{ end }}>true</option><option value="false" {{ if not .Server.MetricsEnabled }}selected{{ end }}>false</option></select>
+  {{ if .Server.Version }}Version: {{ .Server.Version }}{{ end }}</p>
 
 <script>
-function add_user() {
+function set_server(name, param) {
+  var value = document.getElementById("server-"+name).value;
   var xmlHttp = new XMLHttpRequest();
   xmlHttp.onreadystatechange = function() {
     setTimeout("location.reload();", 1000);
   }
-  xmlHttp.open("POST", document.URL+"/user", false);
+  if (name == "data" && value == "") {
+    xmlHttp.open("DELETE", document.URL+"/server/data", false);
+  } else {
+    xmlHttp.open("PUT", document.URL+"/server/"+name+"?"+param+"="+encodeURIComponent(value), false);
+  }
+  xmlHttp.send(null);
+}
+</script>
+
+<h3>Add Server</h3>
+<p>Access Config: <input id="server-config" value="" size="60" placeholder='{"apiUrl":"https://...","certSha256":"..."}'/>  ID: <input id="server-id" value="" size="10"/>  Label: <input id="server-label" value="" size="10"/>  Sidecar: <input id="server-sidecar" value="" size="20" placeholder="default, url or none"/><button type="button" onclick="add_server();">ADD SERVER</button></p>
+
+<script>
+function add_server() {
+  var config = document.getElementById("server-config").value;
+  var id = document.getElementById("server-id").value;
+  var label = document.getElementById("server-label").value;
+  var sidecar = document.getElementById("server-sidecar").value;
+
+  var xmlHttp = new XMLHttpRequest();
+  xmlHttp.open("POST", "/outline/manager/servers", false);
+  xmlHttp.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+  xmlHttp.send("config="+encodeURIComponent(config)+"&id="+encodeURIComponent(id)+"&label="+encodeURIComponent(label)+"&sidecar="+encodeURIComponent(sidecar));
+  if (xmlHttp.status == 201) {
+    location.replace(xmlHttp.getResponseHeader("Location"));
+  } else {
+    alert(xmlHttp.responseText);
+  }
+}
+</script>
+
+<h3>Admin Settings</h3>
+<table id="admins">
+  <tr>
+    <th>Username</th>
+    <th>Role</th>
+    <th></th>
+  </tr>
+</table>
+<p>Username: <input id="username" value="" size="10"/>  Password: <input id="password" type="password" value="" size="10"/>  Role: <select id="role"><option value="viewer">viewer</option><option value="operator">operator</option><option value="owner">owner</option></select><button type="button" onclick="set_manager();">MODIFY</button></p>
+
+<script>
+function list_managers() {
+  var xmlHttp = new XMLHttpRequest();
+  xmlHttp.open("GET", "/outline/manager/set/admin", false);
+  xmlHttp.send(null);
+  if (xmlHttp.status != 200) {
+    return;
+  }
+  var table = document.getElementById("admins");
+  JSON.parse(xmlHttp.responseText).forEach(function(admin) {
+    var row = table.insertRow(-1);
+    row.insertCell(0).innerText = admin.username;
+    row.insertCell(1).innerText = admin.role;
+    var button = document.createElement("button");
+    button.innerText = "DELETE";
+    button.onclick = function() { delete_manager(admin.username); };
+    row.insertCell(2).appendChild(button);
+  });
+}
+
+function delete_manager(user) {
+  var xmlHttp = new XMLHttpRequest();
+  xmlHttp.onreadystatechange = function() {
+    setTimeout("location.reload();", 1000);
+  }
+  xmlHttp.open("DELETE", "/outline/manager/set/admin?user="+encodeURIComponent(user), false);
+  xmlHttp.send(null);
+}
+
+list_managers();
+</script>
+{{ end }}
+
+<h3>API Tokens</h3>
+<table id="tokens">
+  <tr>
+    <th>ID</th>
+    <th>Label</th>
+    <th>Scope</th>
+    <th>Server</th>
+    <th>Admin</th>
+    <th>Last Used</th>
+    <th></th>
+  </tr>
+</table>
+<p>Label: <input id="token-label" value="" size="10"/>  Scope: <select id="token-scope"><option value="read">read</option><option value="write">write</option></select>  Server: <select id="token-server"><option value="">all</option>{{ range .Servers }}{{ if .ID }}<option value="{{ .ID }}">{{ .Name }}</option>{{ end }}{{ end }}</select><button type="button" onclick="mint_token();">NEW TOKEN</button></p>
+
+<script>
+function list_tokens() {
+  var xmlHttp = new XMLHttpRequest();
+  xmlHttp.open("GET", "/outline/manager/tokens", false);
+  xmlHttp.send(null);
+  if (xmlHttp.status != 200) {
+    return;
+  }
+  var table = document.getElementById("tokens");
+  JSON.parse(xmlHttp.responseText).forEach(function(token) {
+    var row = table.insertRow(-1);
+    row.insertCell(0).innerText = token.id;
+    var label = row.insertCell(1);
+    label.innerText = token.label || "-";
+    label.onclick = function() { label_token(token.id, token.label); };
+    row.insertCell(2).innerText = token.scope;
+    row.insertCell(3).innerText = token.server || "all";
+    row.insertCell(4).innerText = token.admin;
+    row.insertCell(5).innerText = token.last_used ? new Date(token.last_used).toLocaleString() : "never";
+    var button = document.createElement("button");
+    button.innerText = "REVOKE";
+    button.onclick = function() { revoke_token(token.id); };
+    row.insertCell(6).appendChild(button);
+  });
+}
+
+function mint_token() {
+  var label = document.getElementById("token-label").value;
+  var scope = document.getElementById("token-scope").value;
+  var server = document.getElementById("token-server").value;
+
+  var xmlHttp = new XMLHttpRequest();
+  xmlHttp.open("POST", "/outline/manager/tokens", false);
+  xmlHttp.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+  xmlHttp.send("label="+encodeURIComponent(label)+"&scope="+scope+"&server="+encodeURIComponent(server));
+  if (xmlHttp.status != 201) {
+    alert(xmlHttp.responseText);
+    return;
+  }
+  prompt("Copy the token now, it is not shown again", JSON.parse(xmlHttp.responseText).token);
+  location.reload();
+}
+
+function label_token(id, label) {
+  var value = prompt("Label", label || "");
+  if (value == null) {
+    return;
+  }
+  var xmlHttp = new XMLHttpRequest();
+  xmlHttp.onreadystatechange = function() {
+    setTimeout("location.reload();", 1000);
+  }
+  xmlHttp.open("PUT", "/outline/manager/tokens/"+encodeURIComponent(id), false);
+  xmlHttp.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+  xmlHttp.send("label="+encodeURIComponent(value));
+}
+
+function revoke_token(id) {
+  var xmlHttp = new XMLHttpRequest();
+  xmlHttp.onreadystatechange = function() {
+    setTimeout("location.reload();", 1000);
+  }
+  xmlHttp.open("DELETE", "/outline/manager/tokens/"+encodeURIComponent(id), false);
   xmlHttp.send(null);
 }
+
+list_tokens();
+</script>
+
+<script>
+function add_user() {
+  var body = [];
+  ["id", "name", "method", "password", "port", "allowance", "days", "quota", "contact", "plan", "notes"].forEach(function(k) {
+    var e = document.getElementById("new-"+k);
+    if (e && e.value != "") {
+      body.push(k+"="+encodeURIComponent(e.value));
+    }
+  });
+  var field = document.getElementById("new-field-name");
+  if (field && field.value != "") {
+    body.push("field."+encodeURIComponent(field.value)+"="+encodeURIComponent(document.getElementById("new-field-value").value));
+  }
+  var xmlHttp = new XMLHttpRequest();
+  xmlHttp.open("POST", document.URL+"/user", false);
+  xmlHttp.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+  xmlHttp.send(body.join("&"));
+  if (xmlHttp.status != 201 || xmlHttp.responseText != "") {
+    alert(xmlHttp.responseText);
+  }
+  setTimeout("location.reload();", 1000);
+}
 </script>
 
 <script>
@@ -162,6 +401,70 @@ function set_deadline(id) {
   xmlHttp.open("PUT", url, false);
   xmlHttp.send(null);
 }
+
+function change_expiry(method, query) {
+  var xmlHttp = new XMLHttpRequest();
+  xmlHttp.open(method, document.URL+"/expiry?"+query, false);
+  xmlHttp.send(null);
+  if (xmlHttp.status != 200) {
+    alert(xmlHttp.responseText);
+  }
+  setTimeout("location.reload();", 1000);
+}
+
+function set_expiry(id) {
+  var date = document.getElementById("expiry-"+id).value;
+  change_expiry("PUT", "id="+encodeURIComponent(id)+"&date="+encodeURIComponent(date));
+}
+
+function remove_expiry(id) {
+  change_expiry("DELETE", "id="+encodeURIComponent(id));
+}
+
+function extend_expiry(id) {
+  var n = document.getElementById("extend-"+id).value;
+  var unit = document.getElementById("extend-unit-"+id).value;
+  change_expiry("PATCH", "id="+encodeURIComponent(id)+"&"+unit+"="+encodeURIComponent(n));
+}
+</script>
+
+<script>
+function set_quota(id) {
+  var xmlHttp = new XMLHttpRequest();
+  var url = document.URL+"/quota?id="+encodeURIComponent(id)+"&quota="+encodeURIComponent(document.getElementById("quota-"+id).value);
+  xmlHttp.open("PUT", url, false);
+  xmlHttp.send(null);
+  if (xmlHttp.status != 200) {
+    alert(xmlHttp.responseText);
+  }
+  setTimeout("location.reload();", 1000);
+}
+
+function set_metadata(id) {
+  var query = "id="+encodeURIComponent(id);
+  ["contact", "plan", "notes"].forEach(function(k) {
+    query += "&"+k+"="+encodeURIComponent(document.getElementById(k+"-"+id).value);
+  });
+  // the date input only holds the day, keep the time of an unchanged date
+  var created = document.getElementById("created-"+id);
+  if (created.value != created.defaultValue) {
+    query += "&created="+encodeURIComponent(created.value);
+  }
+  Array.prototype.forEach.call(document.getElementsByClassName("field-"+id), function(e) {
+    query += "&field."+encodeURIComponent(e.dataset.name)+"="+encodeURIComponent(e.value);
+  });
+  var name = document.getElementById("field-name-"+id).value;
+  if (name != "") {
+    query += "&field."+encodeURIComponent(name)+"="+encodeURIComponent(document.getElementById("field-value-"+id).value);
+  }
+  var xmlHttp = new XMLHttpRequest();
+  xmlHttp.open("PUT", document.URL+"/metadata?"+query, false);
+  xmlHttp.send(null);
+  if (xmlHttp.status != 200) {
+    alert(xmlHttp.responseText);
+  }
+  setTimeout("location.reload();", 1000);
+}
 </script>
 
 <script>
@@ -182,43 +485,20 @@ function hide_title() {
 function set_manager() {
   var user = document.getElementById("username").value;
   var pass = document.getElementById("password").value;
+  var role = document.getElementById("role").value;
 
   var xmlHttp = new XMLHttpRequest();
   xmlHttp.onreadystatechange = function() {
     setTimeout("location.reload();", 1000);
   }
-  var url = document.URL+"/set/admin?user="+user+"&pass="+pass
-  xmlHttp.open("POST", url, false);
-  xmlHttp.send(null);
+  xmlHttp.open("POST", "/outline/manager/set/admin", false);
+  xmlHttp.setRequestHeader("Content-Type", "application/x-www-form-urlencoded");
+  xmlHttp.send("user="+encodeURIComponent(user)+"&pass="+encodeURIComponent(pass)+"&role="+role);
 }
 </script>
 
 <script type="text/JavaScript">
-function getCookie(cname) {
-  var name = cname + "=";
-  var decodedCookie = decodeURIComponent(document.cookie);
-  var ca = decodedCookie.split(';');
-  for(var i = 0; i <ca.length; i++) {
-    var c = ca[i];
-    while (c.charAt(0) == ' ') {
-      c = c.substring(1);
-    }
-    if (c.indexOf(name) == 0) {
-      return c.substring(name.length, c.length);
-    }
-  }
-  return "";
-}
-
 function auto_fresh(t) {
-  var outline = getCookie("outline");
-  if (outline != "") {
-    setCookie("outline", "manager", 30);
-    console.log(outline);
-  } else {
-    location.replace("/login");
-  }
-
   setInterval(function(){
     var bt = document.getElementById("button-refresh");
     if (bt.innerText == "REFRESH ON") {
@@ -230,6 +510,16 @@ function auto_fresh(t) {
 </script>
 
 <script>
+function refresh_now() {
+  var xmlHttp = new XMLHttpRequest();
+  xmlHttp.open("POST", document.URL+"/refresh", false);
+  xmlHttp.send(null);
+  if (xmlHttp.status != 200) {
+    alert(xmlHttp.responseText);
+  }
+  location.reload();
+}
+
 function set_refresh() {
   var bt = document.getElementById("button-refresh");
   if (bt.innerText == "REFRESH ON") {
@@ -247,16 +537,10 @@ function alert_user(id) {
 </script>
 
 <script>
-
-function setCookie(cname, cvalue, exdays) {
-  var d = new Date();
-  d.setTime(d.getTime() + (exdays*24*60*60*1000));
-  var expires = "expires="+ d.toUTCString();
-  document.cookie = cname + "=" + cvalue + ";" + expires + ";path=/;SameSite=Lax";
-}
-
 function exit() {
-  setCookie("outline", "manager", -1);
+  var xmlHttp = new XMLHttpRequest();
+  xmlHttp.open("POST", "/logout", false);
+  xmlHttp.send(null);
   location.replace("/login");
 }
 </script>
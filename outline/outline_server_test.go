@@ -0,0 +1,74 @@
+package outline
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/imgk/caddy-outline-manager/outline/api"
+)
+
+func TestSidecarUnreachable(t *testing.T) {
+	s, server, mock := newTestServer(t, false)
+	sidecar := &mockSidecar{fail: errors.New("connection refused")}
+	server.Sidecar = sidecar
+	mock.keys = map[string]*api.AccessKey{"1": {ID: "1", Name: "a"}}
+	ctx := context.Background()
+
+	if err := server.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh with the sidecar down: %v", err)
+	}
+	user := server.Snapshot().User("1")
+	if user == nil || !user.Enabled {
+		t.Fatalf("user %+v, want it enabled as without a sidecar", user)
+	}
+	if server.HasSidecar() || server.resource().Sidecar {
+		t.Error("sidecar reported while it is down")
+	}
+	if w := serve(s, RoleViewer, http.MethodGet, server.Prefix(), ""); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "Online") {
+		t.Errorf("panel %v shows the sidecar columns", w.Code)
+	}
+
+	sidecar.mu.Lock()
+	sidecar.fail = nil
+	sidecar.users = map[string]*api.GoUser{"1": {ID: "1", Online: true}}
+	sidecar.mu.Unlock()
+	if err := server.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !server.HasSidecar() {
+		t.Error("sidecar not reported once it is back")
+	}
+	if user := server.Snapshot().User("1"); user.Enabled || !user.Online {
+		t.Errorf("user %+v, want the state of the sidecar", user)
+	}
+}
+
+func TestAddUserSteps(t *testing.T) {
+	s, server, mock := newTestServer(t, false)
+	for _, query := range []string{"quota=1", "plan=pro"} {
+		if w := serve(s, RoleOperator, http.MethodPost, server.Prefix()+"/user?"+query, ""); w.Code < 400 {
+			t.Errorf("%v: got %v, want an error", query, w.Code)
+		}
+	}
+	if len(mock.keys) != 0 {
+		t.Errorf("keys created: %v", mock.keys)
+	}
+
+	s, server, mock = newTestServer(t, true)
+	for _, query := range []string{"days=x", "days=-1", "quota=-1", "field.=x"} {
+		if w := serve(s, RoleOperator, http.MethodPost, server.Prefix()+"/user?"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: got %v, want 400", query, w.Code)
+		}
+	}
+	if len(mock.keys) != 0 {
+		t.Errorf("keys created: %v", mock.keys)
+	}
+	s.Store.Close()
+	w := serve(s, RoleOperator, http.MethodPost, server.Prefix()+"/user?plan=pro", "")
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), "set metadata: Internal Server Error") {
+		t.Errorf("got %v, want 201 and the failed step: %q", w.Code, w.Body)
+	}
+}
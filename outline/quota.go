@@ -0,0 +1,199 @@
+package outline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Keys with a quota may transfer Quota.Bytes per billing cycle. Cycles
+// start every month on the day of the anchor of the quota, the creation
+// of the key or else when the quota was set. The usage of a cycle is the
+// sum of the usage sampled since its start, to the hour.
+//
+// The Outline server limits the bytes it counted over the last 30 days,
+// which shrink as old traffic leaves the window. The data limit of a key
+// with a quota is therefore its sampled counter plus what is left of
+// the quota, and it is set again whenever that changes, which is when
+// the counter shrinks or the cycle renews. Data limits set by hand on a
+// key with a quota stay until then.
+
+// Quota is the billing cycle of a key.
+type Quota struct {
+	// Bytes is the data the key may transfer per cycle.
+	Bytes uint64 `json:"bytes"`
+	// Anchor is the start of the first cycle.
+	Anchor time.Time `json:"anchor"`
+	// CycleStart is the start of the current cycle.
+	CycleStart time.Time `json:"cycle_start"`
+	// Limit is the data limit last set for the quota.
+	Limit uint64 `json:"limit"`
+}
+
+// cycle returns the number of the cycle holding t, counted from 0
+// at Anchor.
+func (q *Quota) cycle(t time.Time, loc *time.Location) int {
+	anchor := q.Anchor.In(loc)
+	if t.Before(anchor) {
+		return 0
+	}
+	t = t.In(loc)
+	n := (t.Year()-anchor.Year())*12 + int(t.Month()-anchor.Month())
+	if addMonths(anchor, n).After(t) {
+		n--
+	}
+	return n
+}
+
+// cycleStart returns the start of the cycle holding now.
+func (q *Quota) cycleStart(now time.Time, loc *time.Location) time.Time {
+	return addMonths(q.Anchor.In(loc), q.cycle(now, loc))
+}
+
+// cycleEnd returns the end of the current cycle, when the quota renews.
+func (q *Quota) cycleEnd(loc *time.Location) time.Time {
+	return addMonths(q.Anchor.In(loc), q.cycle(q.CycleStart, loc)+1)
+}
+
+// limit returns the data limit of a key whose counter is at counter
+// and which transferred used bytes in the current cycle.
+func (q *Quota) limit(counter, used uint64) uint64 {
+	return counter + q.Bytes - min(used, q.Bytes)
+}
+
+// cycleUsed returns the sampled usage of a key in the current cycle of q
+// up to now.
+func (s *OutlineServer) cycleUsed(id string, q *Quota, now time.Time) (uint64, error) {
+	points, err := s.store.KeyUsage(s.ID, id, PeriodHour, q.CycleStart, now, s.location())
+	if err != nil {
+		return 0, err
+	}
+	used := uint64(0)
+	for _, p := range points {
+		used += p.Bytes
+	}
+	return used, nil
+}
+
+// SetQuota sets the data a key may transfer per billing cycle, 0 to
+// remove the quota and the data limit it set. The current cycle keeps
+// its start, the first one is counted from the sampled usage of the key.
+func (s *OutlineServer) SetQuota(ctx context.Context, id string, quota uint64) error {
+	s.logger.Info(fmt.Sprintf("set user %v quota to %v bytes", id, quota))
+	if s.store == nil {
+		return ErrNoStore
+	}
+
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+
+	if quota == 0 {
+		if err := s.setDataLimit(ctx, id, nil); err != nil {
+			return err
+		}
+		return s.store.UpdateKey(s.ID, id, func(rec *KeyRecord) error {
+			rec.Quota = nil
+			return nil
+		})
+	}
+
+	usage, err := s.GetUsage(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := s.API.GetAccessKey(ctx, id); err != nil {
+		return err
+	}
+	// sample the counters now, so that the usage of the cycle ends
+	// at the counter the limit is set from
+	now := time.Now()
+	if err := s.store.RecordUsage(s.ID, usage, now, s.location()); err != nil {
+		return err
+	}
+	rec, err := s.store.Key(s.ID, id)
+	if err != nil {
+		return err
+	}
+	q := rec.Quota
+	if q == nil {
+		q = &Quota{Anchor: rec.Metadata.Created}
+		if q.Anchor.IsZero() {
+			q.Anchor = now
+		}
+		q.CycleStart = q.cycleStart(now, s.location())
+	}
+	q.Bytes = quota
+	used, err := s.cycleUsed(id, q, now)
+	if err != nil {
+		return err
+	}
+	q.Limit = q.limit(usage[id], used)
+	if err := s.setDataLimit(ctx, id, &q.Limit); err != nil {
+		return err
+	}
+	if err := s.SetGoDataLimit(ctx, id, gigabytes(quota)); err != nil {
+		return err
+	}
+	return s.store.UpdateKey(s.ID, id, func(rec *KeyRecord) error {
+		rec.Quota = q
+		return nil
+	})
+}
+
+// RenewQuotas starts a new cycle for the keys whose cycle is over, and
+// sets the data limit of the keys with a quota again when it changed.
+// It uses the usage sampled by the last refresh.
+func (s *OutlineServer) RenewQuotas(ctx context.Context) error {
+	if s.store == nil {
+		return nil
+	}
+
+	s.quotaMu.Lock()
+	defer s.quotaMu.Unlock()
+
+	records, err := s.store.Keys(s.ID)
+	if err != nil {
+		return err
+	}
+	snap := s.Snapshot()
+	now := time.Now()
+	changed := false
+	errs := []error{}
+	for id, rec := range records {
+		user := snap.User(id)
+		if rec.Quota == nil || user == nil {
+			continue
+		}
+		q := *rec.Quota
+		if start := q.cycleStart(now, s.location()); start.After(q.CycleStart) {
+			s.logger.Info(fmt.Sprintf("renew user %v quota from %v", id, start))
+			q.CycleStart = start
+		}
+		used, err := s.cycleUsed(id, &q, snap.Refreshed)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("renew user %v quota: %w", id, err))
+			continue
+		}
+		q.Limit = q.limit(uint64(user.TransferredBytes), used)
+		if q == *rec.Quota {
+			continue
+		}
+		err = s.setDataLimit(ctx, id, &q.Limit)
+		if err == nil {
+			err = s.store.UpdateKey(s.ID, id, func(rec *KeyRecord) error {
+				rec.Quota = &q
+				return nil
+			})
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("renew user %v quota: %w", id, err))
+			continue
+		}
+		changed = true
+	}
+	if changed {
+		s.refreshAfter(ctx)
+	}
+	return errors.Join(errs...)
+}
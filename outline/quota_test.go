@@ -0,0 +1,76 @@
+package outline
+
+import (
+	"context"
+	"testing"
+
+	"github.com/imgk/caddy-outline-manager/outline/api"
+)
+
+func TestQuotaShrinkingCounter(t *testing.T) {
+	_, server, mock := newTestServer(t, true)
+	ctx := context.Background()
+
+	mock.keys = map[string]*api.AccessKey{"1": {ID: "1"}}
+	transfer := func(counter uint64) {
+		t.Helper()
+		mock.mu.Lock()
+		mock.usage = map[string]uint64{"1": counter}
+		mock.mu.Unlock()
+		if err := server.Refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.RenewQuotas(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	limit := func() uint64 {
+		t.Helper()
+		mock.mu.Lock()
+		defer mock.mu.Unlock()
+		if mock.keys["1"].DataLimit == nil {
+			t.Fatal("no data limit")
+		}
+		return mock.keys["1"].DataLimit.Bytes
+	}
+
+	transfer(1000)
+	if err := server.SetQuota(ctx, "1", 500); err != nil {
+		t.Fatal(err)
+	}
+	if got := limit(); got != 1500 {
+		t.Errorf("limit %v, want 1500", got)
+	}
+
+	// the limit left as is stays while it lets the key use its quota
+	mock.keys["1"].DataLimit.Bytes = 9999
+	transfer(1200)
+	if got := limit(); got != 9999 {
+		t.Errorf("limit %v, want the one set by hand", got)
+	}
+	if used := server.Snapshot().User("1").CycleUsed; used != 200 {
+		t.Errorf("cycle used %v, want 200", used)
+	}
+
+	// old traffic leaves the window of the Outline server, the key has
+	// 300 bytes left
+	transfer(100)
+	if got := limit(); got != 400 {
+		t.Errorf("limit %v after the counter shrank, want 400", got)
+	}
+	transfer(350)
+	if used := server.Snapshot().User("1").CycleUsed; used != 450 {
+		t.Errorf("cycle used %v, want 450", used)
+	}
+	if got := limit(); got != 400 {
+		t.Errorf("limit %v, want 400", got)
+	}
+}
+
+func TestGigabytes(t *testing.T) {
+	for bytes, want := range map[uint64]string{0: "0", 1: "1", 1 << 30: "1", 1<<30 + 1: "2", 5 << 30: "5"} {
+		if got := gigabytes(bytes); got != want {
+			t.Errorf("gigabytes(%v) = %v, want %v", bytes, got, want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package outline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Reports list every key of a server with the data it transferred in a
+// range of days, as sampled by the manager, and its current settings.
+// Rows are written as they are built, so large reports are streamed.
+
+// ReportRow is a key in a report.
+type ReportRow struct {
+	Server string `json:"server"`
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	// Created and ExpiresAt are null when unknown and for never.
+	Created        *time.Time `json:"created"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	DataLimitBytes *uint64    `json:"data_limit_bytes"`
+	// TransferredBytes is the data transferred in the range.
+	TransferredBytes uint64 `json:"transferred_bytes"`
+	// Status is one of enabled, disabled, expired or limited.
+	Status string `json:"status"`
+}
+
+// reportHeader is the first line of CSV reports.
+var reportHeader = []string{"server", "id", "name", "created", "expires_at", "data_limit_bytes", "transferred_bytes", "status"}
+
+// record returns the row as a line of a CSV report.
+func (row *ReportRow) record() []string {
+	timeField := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	limit := ""
+	if row.DataLimitBytes != nil {
+		limit = strconv.FormatUint(*row.DataLimitBytes, 10)
+	}
+	return []string{row.Server, row.ID, row.Name, timeField(row.Created), timeField(row.ExpiresAt), limit,
+		strconv.FormatUint(row.TransferredBytes, 10), row.Status}
+}
+
+// UsageTotals returns the data transferred by every key of a server with
+// a history by key id, from the day holding from to the day holding to.
+func (s *Store) UsageTotals(server string, from, to time.Time, loc *time.Location) (map[string]uint64, error) {
+	first := []byte(from.In(loc).Format(dateLayout))
+	last := []byte(to.In(loc).Format(dateLayout))
+	totals := map[string]uint64{}
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usageBucket).Bucket([]byte(server))
+		if b == nil {
+			return nil
+		}
+		return b.ForEachBucket(func(id []byte) error {
+			db := b.Bucket(id).Bucket(dayBucket)
+			if db == nil {
+				return nil
+			}
+			c := db.Cursor()
+			for k, v := c.Seek(first); k != nil && bytes.Compare(k, last) <= 0; k, v = c.Next() {
+				totals[string(id)] += binary.BigEndian.Uint64(v)
+			}
+			return nil
+		})
+	})
+	return totals, err
+}
+
+// reportRange reads the range of a report query of r, which defaults to
+// the current month. from and to are as in usageRange, and whole days.
+func (s *OutlineServer) reportRange(r *http.Request) (from, to time.Time, err error) {
+	query := r.URL.Query()
+	to = time.Now()
+	if v := query.Get("to"); v != "" {
+		if to, err = parseTime(v, s.location()); err != nil {
+			return from, to, fmt.Errorf("invalid to: %q", v)
+		}
+	}
+	from = PeriodMonth.start(to, s.location())
+	if v := query.Get("from"); v != "" {
+		if from, err = parseTime(v, s.location()); err != nil {
+			return from, to, fmt.Errorf("invalid from: %q", v)
+		}
+	}
+	if from.After(to) {
+		err = fmt.Errorf("from is after to")
+	}
+	return
+}
+
+// status returns the status of the key in reports.
+func (u *OutlineUser) status() string {
+	switch {
+	case u.Expired:
+		return "expired"
+	case !u.Enabled:
+		return "disabled"
+	case u.DataLimit != nil && uint64(u.TransferredBytes) >= u.DataLimit.Bytes:
+		return "limited"
+	default:
+		return "enabled"
+	}
+}
+
+// reportWriter writes the rows of a report in one format.
+type reportWriter interface {
+	Write(*ReportRow) error
+	Close() error
+}
+
+// csvReport writes a CSV report with a header line.
+type csvReport struct {
+	w *csv.Writer
+}
+
+func newCSVReport(w io.Writer) (*csvReport, error) {
+	c := &csvReport{w: csv.NewWriter(w)}
+	return c, c.w.Write(reportHeader)
+}
+
+func (c *csvReport) Write(row *ReportRow) error {
+	return c.w.Write(row.record())
+}
+
+func (c *csvReport) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// jsonReport writes a JSON array of rows, one row per line.
+type jsonReport struct {
+	w     io.Writer
+	enc   *json.Encoder
+	count int
+}
+
+func newJSONReport(w io.Writer) (*jsonReport, error) {
+	_, err := io.WriteString(w, "[\n")
+	return &jsonReport{w: w, enc: json.NewEncoder(w)}, err
+}
+
+func (j *jsonReport) Write(row *ReportRow) error {
+	if j.count > 0 {
+		if _, err := io.WriteString(j.w, ","); err != nil {
+			return err
+		}
+	}
+	j.count++
+	return j.enc.Encode(row)
+}
+
+func (j *jsonReport) Close() error {
+	_, err := io.WriteString(j.w, "]\n")
+	return err
+}
+
+func apiGetReport(w http.ResponseWriter, r *http.Request, s *OutlineServer) {
+	if s.store == nil {
+		writeAPIError(w, ErrNoStore)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		WriteError(w, http.StatusBadRequest, fmt.Sprintf("unknown format: %q", format))
+		return
+	}
+	from, to, err := s.reportRange(r)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	loc := s.location()
+	totals, err := s.store.UsageTotals(s.ID, from, to, loc)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("read usage error: %v", err))
+		WriteError(w, http.StatusInternalServerError, "read usage error")
+		return
+	}
+	records, err := s.store.Keys(s.ID)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("read keys error: %v", err))
+		WriteError(w, http.StatusInternalServerError, "read keys error")
+		return
+	}
+
+	filename := fmt.Sprintf("%v-%v-%v.%v", s.ID, from.In(loc).Format(dateLayout), to.In(loc).Format(dateLayout), format)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	var report reportWriter
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		report, err = newCSVReport(w)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		report, err = newJSONReport(w)
+	}
+	for _, user := range s.Snapshot().Users {
+		if err != nil {
+			break
+		}
+		row := &ReportRow{
+			Server:           s.ID,
+			ID:               user.ID,
+			Name:             user.Name,
+			ExpiresAt:        user.expiresAt(),
+			TransferredBytes: totals[user.ID],
+			Status:           user.status(),
+		}
+		if created := records[user.ID].Metadata.Created; !created.IsZero() {
+			created = created.In(loc)
+			row.Created = &created
+		}
+		if user.DataLimit != nil {
+			n := user.DataLimit.Bytes
+			row.DataLimitBytes = &n
+		}
+		err = report.Write(row)
+	}
+	if err == nil {
+		err = report.Close()
+	}
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("write report error: %v", err))
+	}
+}
@@ -0,0 +1,943 @@
+package outline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/imgk/caddy-outline-manager/outline/api"
+)
+
+// APIPath is the root of the versioned JSON API.
+//
+//	GET    /api/v1/servers
+//	POST   /api/v1/servers
+//	GET    /api/v1/servers/{sid}
+//	PATCH  /api/v1/servers/{sid}
+//	POST   /api/v1/servers/{sid}/refresh
+//	GET    /api/v1/servers/{sid}/keys
+//	POST   /api/v1/servers/{sid}/keys
+//	GET    /api/v1/servers/{sid}/keys/{kid}
+//	PATCH  /api/v1/servers/{sid}/keys/{kid}
+//	DELETE /api/v1/servers/{sid}/keys/{kid}
+//	GET    /api/v1/servers/{sid}/keys/{kid}/usage
+//	GET    /api/v1/servers/{sid}/usage
+//	GET    /api/v1/servers/{sid}/usage/history
+//	GET    /api/v1/servers/{sid}/report
+//	GET    /api/v1/servers/{sid}/deadlines
+//	PUT    /api/v1/servers/{sid}/deadlines/{kid}
+//	GET    /api/v1/webhooks
+//	POST   /api/v1/webhooks/{hid}/ping
+//	GET    /api/v1/openapi.json
+//
+// Errors are answered with the matching status and a body like
+// {"error": "access key not found"}.
+const APIPath = "/api/v1"
+
+// maxBodySize limits the request bodies of the JSON API.
+const maxBodySize = 1 << 20
+
+// ServerResource is a managed server in the JSON API.
+// Servers that are not connected yet only have ID, Label and Ready.
+type ServerResource struct {
+	ID                    string  `json:"id"`
+	Label                 string  `json:"label,omitempty"`
+	Ready                 bool    `json:"ready"`
+	Name                  string  `json:"name,omitempty"`
+	ServerID              string  `json:"server_id,omitempty"`
+	Version               string  `json:"version,omitempty"`
+	MetricsEnabled        bool    `json:"metrics_enabled"`
+	CreatedTimestampMs    uint64  `json:"created_timestamp_ms,omitempty"`
+	PortForNewAccessKeys  int     `json:"port_for_new_access_keys,omitempty"`
+	HostnameForAccessKeys string  `json:"hostname_for_access_keys,omitempty"`
+	DefaultDataLimitBytes *uint64 `json:"default_data_limit_bytes"`
+	// Refreshed is when the keys were last fetched from the server.
+	Refreshed time.Time `json:"refreshed,omitzero"`
+	// Sidecar tells whether online, ip, enabled and deadlines of keys
+	// are available.
+	Sidecar bool `json:"sidecar"`
+}
+
+// ServerPatch changes the settings of a server. Unset fields are kept.
+type ServerPatch struct {
+	Name                   *string `json:"name,omitempty"`
+	HostnameForAccessKeys  *string `json:"hostname_for_access_keys,omitempty"`
+	PortForNewAccessKeys   *int    `json:"port_for_new_access_keys,omitempty"`
+	DefaultDataLimitBytes  *uint64 `json:"default_data_limit_bytes,omitempty"`
+	RemoveDefaultDataLimit bool    `json:"remove_default_data_limit,omitempty"`
+	MetricsEnabled         *bool   `json:"metrics_enabled,omitempty"`
+}
+
+// NewServerRequest adds a server. AccessConfig is the access config
+// printed by the Outline installer, APIURL and CertSHA256 can be used
+// instead.
+type NewServerRequest struct {
+	ID           string `json:"id,omitempty"`
+	Label        string `json:"label,omitempty"`
+	AccessConfig string `json:"access_config,omitempty"`
+	APIURL       string `json:"api_url,omitempty"`
+	CertSHA256   string `json:"cert_sha256,omitempty"`
+	// SidecarURL and DisableSidecar are as in Config.
+	SidecarURL     string `json:"sidecar_url,omitempty"`
+	DisableSidecar bool   `json:"disable_sidecar,omitempty"`
+}
+
+// KeyResource is an access key in the JSON API.
+type KeyResource struct {
+	ID               string  `json:"id"`
+	Name             string  `json:"name"`
+	Password         string  `json:"password"`
+	Port             int     `json:"port"`
+	Method           string  `json:"method"`
+	AccessURL        string  `json:"access_url"`
+	DataLimitBytes   *uint64 `json:"data_limit_bytes"`
+	TransferredBytes uint64  `json:"transferred_bytes"`
+	Enabled          bool    `json:"enabled"`
+	Online           bool    `json:"online"`
+	IP               net.IP  `json:"ip,omitempty"`
+	DaysLeft         int     `json:"days_left"`
+	Expire           string  `json:"expire"`
+	// ExpiresAt is when the key expires, null for never.
+	ExpiresAt *time.Time `json:"expires_at"`
+	// Expired is set while the key is held at a zero data limit
+	// because it is past its expiry.
+	Expired bool `json:"expired"`
+	// Metadata is what the admins track about the key.
+	Metadata Metadata `json:"metadata"`
+	// QuotaBytes is the data the key may transfer per monthly cycle,
+	// null for none. CycleUsedBytes is the usage sampled since
+	// CycleStart, its data limit lets it transfer the rest of QuotaBytes
+	// until the quota renews at CycleEnd.
+	QuotaBytes     *uint64    `json:"quota_bytes"`
+	CycleStart     *time.Time `json:"cycle_start,omitempty"`
+	CycleEnd       *time.Time `json:"cycle_end,omitempty"`
+	CycleUsedBytes uint64     `json:"cycle_used_bytes"`
+	// Failed lists the steps that failed after the key was created,
+	// like "set expiry: ...", or those of a change of which others were
+	// applied, listed in Applied. They are only set by createKey and
+	// patchKey.
+	Failed  []string `json:"failed,omitempty"`
+	Applied []string `json:"applied,omitempty"`
+}
+
+// NewKeyRequest creates an access key. The Outline server picks the
+// values of unset fields. The key expires at ExpiresAt, or in Days
+// which defaults to 30.
+type NewKeyRequest struct {
+	ID             string     `json:"id,omitempty"`
+	Name           string     `json:"name,omitempty"`
+	Method         string     `json:"method,omitempty"`
+	Password       string     `json:"password,omitempty"`
+	Port           int        `json:"port,omitempty"`
+	DataLimitBytes *uint64    `json:"data_limit_bytes,omitempty"`
+	Days           *int       `json:"days,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	// Metadata is kept by the manager. Created and CreatedBy
+	// are recorded for every new key.
+	Metadata *MetadataPatch `json:"metadata,omitempty"`
+	// QuotaBytes sets a monthly quota instead of DataLimitBytes.
+	QuotaBytes *uint64 `json:"quota_bytes,omitempty"`
+}
+
+// KeyPatch changes an access key. Unset fields are kept.
+type KeyPatch struct {
+	Name            *string `json:"name,omitempty"`
+	DataLimitBytes  *uint64 `json:"data_limit_bytes,omitempty"`
+	RemoveDataLimit bool    `json:"remove_data_limit,omitempty"`
+	Enabled         *bool   `json:"enabled,omitempty"`
+	DaysLeft        *int    `json:"days_left,omitempty"`
+	// ExpiresAt sets when the key expires, RemoveExpiry makes it never.
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	RemoveExpiry bool       `json:"remove_expiry,omitempty"`
+	// Metadata changes the fields it sets.
+	Metadata *MetadataPatch `json:"metadata,omitempty"`
+	// QuotaBytes sets the monthly quota, 0 removes it and the data
+	// limit it set.
+	QuotaBytes *uint64 `json:"quota_bytes,omitempty"`
+}
+
+// UsageResource is the data transferred by the keys of a server.
+type UsageResource struct {
+	TotalBytes       uint64            `json:"total_bytes"`
+	BytesTransferred map[string]uint64 `json:"bytes_transferred_by_key_id"`
+}
+
+// UsageSeriesResource is the data transferred by a key in each period
+// of a range, as sampled by the manager.
+type UsageSeriesResource struct {
+	ID         string       `json:"id"`
+	Period     Period       `json:"period"`
+	TotalBytes uint64       `json:"total_bytes"`
+	Points     []UsagePoint `json:"points"`
+}
+
+// DeadlineResource is the remaining lifetime of a key.
+type DeadlineResource struct {
+	ID       string `json:"id"`
+	DaysLeft int    `json:"days_left"`
+	Expire   string `json:"expire"`
+	// ExpiresAt is when the key expires, null for never.
+	ExpiresAt *time.Time `json:"expires_at"`
+	Enabled   bool       `json:"enabled"`
+	Expired   bool       `json:"expired"`
+}
+
+// DeadlineRequest changes the expiry of a key in one of three ways:
+// DaysLeft from now, 0 for never; ExpiresAt; or ExtendDays and
+// ExtendMonths added to the current expiry, or to now if there is none
+// or it is past.
+type DeadlineRequest struct {
+	DaysLeft     *int       `json:"days_left,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	ExtendDays   int        `json:"extend_days,omitempty"`
+	ExtendMonths int        `json:"extend_months,omitempty"`
+}
+
+// ErrorResource is the body of every error answered by the JSON API.
+type ErrorResource struct {
+	Error string `json:"error"`
+}
+
+// errServerNotFound is answered for unknown or unreachable servers.
+var errServerNotFound = errors.New("server not found or not connected")
+
+// setAPIRouter registers the routes of the JSON API.
+func (s *Server) setAPIRouter() {
+	// server routes look up the server and hand it to h
+	withServer := func(h func(http.ResponseWriter, *http.Request, *OutlineServer)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			server := s.lookup(r.PathValue("sid"))
+			if server == nil || !ServerAllowed(r.Context(), server.ID) {
+				WriteError(w, http.StatusNotFound, errServerNotFound.Error())
+				return
+			}
+			h(w, r, server)
+		}
+	}
+
+	s.Handle(Operation{
+		ID:       "listServers",
+		Method:   http.MethodGet,
+		Path:     APIPath + "/servers",
+		Role:     RoleViewer,
+		Summary:  "List the managed servers",
+		Response: []ServerResource{},
+	}, s.apiListServers)
+	s.Handle(Operation{
+		ID:       "addServer",
+		Method:   http.MethodPost,
+		Path:     APIPath + "/servers",
+		Role:     RoleOwner,
+		Summary:  "Add a server",
+		Request:  NewServerRequest{},
+		Response: ServerResource{},
+		Status:   http.StatusCreated,
+	}, s.apiAddServer)
+	s.Handle(Operation{
+		ID:       "getServer",
+		Method:   http.MethodGet,
+		Path:     APIPath + "/servers/{sid}",
+		Role:     RoleViewer,
+		Summary:  "Get a server",
+		Response: ServerResource{},
+	}, withServer(apiGetServer))
+	s.Handle(Operation{
+		ID:       "patchServer",
+		Method:   http.MethodPatch,
+		Path:     APIPath + "/servers/{sid}",
+		Role:     RoleOwner,
+		Summary:  "Change the settings of a server",
+		Request:  ServerPatch{},
+		Response: ServerResource{},
+	}, withServer(apiPatchServer))
+	s.Handle(Operation{
+		ID:       "refreshServer",
+		Method:   http.MethodPost,
+		Path:     APIPath + "/servers/{sid}/refresh",
+		Role:     RoleViewer,
+		Summary:  "Fetch the keys of a server now instead of waiting for the next poll",
+		Response: ServerResource{},
+	}, withServer(apiRefreshServer))
+	s.Handle(Operation{
+		ID:       "listKeys",
+		Method:   http.MethodGet,
+		Path:     APIPath + "/servers/{sid}/keys",
+		Role:     RoleViewer,
+		Summary:  "List the access keys of a server",
+		Response: []KeyResource{},
+	}, withServer(apiListKeys))
+	s.Handle(Operation{
+		ID:       "createKey",
+		Method:   http.MethodPost,
+		Path:     APIPath + "/servers/{sid}/keys",
+		Role:     RoleOperator,
+		Summary:  "Create an access key, failed lists the changes that could not be made after it was created",
+		Request:  NewKeyRequest{},
+		Response: KeyResource{},
+		Status:   http.StatusCreated,
+	}, withServer(apiCreateKey))
+	s.Handle(Operation{
+		ID:       "getKey",
+		Method:   http.MethodGet,
+		Path:     APIPath + "/servers/{sid}/keys/{kid}",
+		Role:     RoleViewer,
+		Summary:  "Get an access key",
+		Response: KeyResource{},
+	}, withServer(apiGetKey))
+	s.Handle(Operation{
+		ID:       "patchKey",
+		Method:   http.MethodPatch,
+		Path:     APIPath + "/servers/{sid}/keys/{kid}",
+		Role:     RoleOperator,
+		Summary:  "Change an access key, failed and applied list the changes made and not when only some could be",
+		Request:  KeyPatch{},
+		Response: KeyResource{},
+	}, withServer(apiPatchKey))
+	s.Handle(Operation{
+		ID:      "deleteKey",
+		Method:  http.MethodDelete,
+		Path:    APIPath + "/servers/{sid}/keys/{kid}",
+		Role:    RoleOwner,
+		Summary: "Delete an access key",
+		Status:  http.StatusNoContent,
+	}, withServer(apiDeleteKey))
+	s.Handle(Operation{
+		ID:       "getUsage",
+		Method:   http.MethodGet,
+		Path:     APIPath + "/servers/{sid}/usage",
+		Role:     RoleViewer,
+		Summary:  "Get the data transferred by each access key",
+		Response: UsageResource{},
+	}, withServer(apiGetUsage))
+	s.Handle(Operation{
+		ID:     "getUsageHistory",
+		Method: http.MethodGet,
+		Path:   APIPath + "/servers/{sid}/usage/history",
+		Role:   RoleViewer,
+		Summary: "Get the data transferred by each access key by hour, day or month. " +
+			"period defaults to day, from and to to the last 24 hours, 30 days or 12 months",
+		Query:    []string{"period", "from", "to"},
+		Response: []UsageSeriesResource{},
+	}, withServer(apiGetUsageHistory))
+	s.Handle(Operation{
+		ID:       "getKeyUsage",
+		Method:   http.MethodGet,
+		Path:     APIPath + "/servers/{sid}/keys/{kid}/usage",
+		Role:     RoleViewer,
+		Summary:  "Get the data transferred by an access key by hour, day or month, as getUsageHistory",
+		Query:    []string{"period", "from", "to"},
+		Response: UsageSeriesResource{},
+	}, withServer(apiGetKeyUsage))
+	s.Handle(Operation{
+		ID:     "getReport",
+		Method: http.MethodGet,
+		Path:   APIPath + "/servers/{sid}/report",
+		Role:   RoleViewer,
+		Summary: "Export the access keys of a server with the data they transferred from the day of from to the day of to, " +
+			"the current month by default, as json or csv",
+		Query:    []string{"format", "from", "to"},
+		Response: []ReportRow{},
+		CSV:      true,
+	}, withServer(apiGetReport))
+	s.Handle(Operation{
+		ID:       "listDeadlines",
+		Method:   http.MethodGet,
+		Path:     APIPath + "/servers/{sid}/deadlines",
+		Role:     RoleViewer,
+		Summary:  "List the remaining days and the expiry of each access key",
+		Response: []DeadlineResource{},
+	}, withServer(apiListDeadlines))
+	s.Handle(Operation{
+		ID:     "setDeadline",
+		Method: http.MethodPut,
+		Path:   APIPath + "/servers/{sid}/deadlines/{kid}",
+		Role:   RoleOperator,
+		Summary: "Set when an access key expires, by days_left from now (0 for never) or expires_at, " +
+			"or extend its expiry by extend_days and extend_months. An expired key is renewed",
+		Request:  DeadlineRequest{},
+		Response: DeadlineResource{},
+	}, withServer(apiSetDeadline))
+}
+
+// lookup returns the connected server with id, or nil.
+func (s *Server) lookup(id string) *OutlineServer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for server, ok := range s.ready {
+		if ok && server.ID == id {
+			return server
+		}
+	}
+	return nil
+}
+
+func (s *Server) apiListServers(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	servers := make([]ServerResource, 0, len(s.servers))
+	for _, server := range s.servers {
+		if !ServerAllowed(r.Context(), server.ID) {
+			continue
+		}
+		if s.ready[server] {
+			servers = append(servers, server.resource())
+			continue
+		}
+		servers = append(servers, ServerResource{ID: server.ID, Label: server.Label})
+	}
+	s.mu.RUnlock()
+
+	WriteJSON(w, http.StatusOK, servers)
+}
+
+func (s *Server) apiAddServer(w http.ResponseWriter, r *http.Request) {
+	req := NewServerRequest{}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	config := Config{APIURL: req.APIURL, CertSHA256: req.CertSHA256}
+	if req.AccessConfig != "" {
+		var err error
+		if config, err = ParseConfig(req.AccessConfig); err != nil {
+			WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	config.ID = req.ID
+	config.Label = req.Label
+	config.SidecarURL = req.SidecarURL
+	config.DisableSidecar = req.DisableSidecar
+
+	server, err := s.Add(r.Context(), config)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("add server %v error: %v", config.APIURL, err))
+		WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.Header().Set("Location", APIPath+"/servers/"+server.ID)
+	WriteJSON(w, http.StatusCreated, server.resource())
+}
+
+func apiGetServer(w http.ResponseWriter, r *http.Request, s *OutlineServer) {
+	WriteJSON(w, http.StatusOK, s.resource())
+}
+
+func apiRefreshServer(w http.ResponseWriter, r *http.Request, s *OutlineServer) {
+	if err := s.Refresh(r.Context()); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, s.resource())
+}
+
+func apiPatchServer(w http.ResponseWriter, r *http.Request, s *OutlineServer) {
+	patch := ServerPatch{}
+	if !readJSON(w, r, &patch) {
+		return
+	}
+	ctx := r.Context()
+
+	steps := []func() error{}
+	if patch.Name != nil {
+		steps = append(steps, func() error { return s.RenameServer(ctx, *patch.Name) })
+	}
+	if patch.HostnameForAccessKeys != nil {
+		steps = append(steps, func() error { return s.SetHostname(ctx, *patch.HostnameForAccessKeys) })
+	}
+	if patch.PortForNewAccessKeys != nil {
+		steps = append(steps, func() error { return s.SetDefaultPort(ctx, strconv.Itoa(*patch.PortForNewAccessKeys)) })
+	}
+	switch {
+	case patch.RemoveDefaultDataLimit:
+		steps = append(steps, func() error { return s.RemoveDefaultAllowance(ctx) })
+	case patch.DefaultDataLimitBytes != nil:
+		steps = append(steps, func() error {
+			s.logger.Info(fmt.Sprintf("set default data limit to %v bytes", *patch.DefaultDataLimitBytes))
+			return s.API.SetDefaultDataLimit(ctx, *patch.DefaultDataLimitBytes)
+		})
+	}
+	if patch.MetricsEnabled != nil {
+		steps = append(steps, func() error { return s.SetMetricsEnabled(ctx, strconv.FormatBool(*patch.MetricsEnabled)) })
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+	}
+	apiRefreshServer(w, r, s)
+}
+
+func apiListKeys(w http.ResponseWriter, r *http.Request, s *OutlineServer) {
+	users := s.Snapshot().Users
+	keys := make([]KeyResource, 0, len(users))
+	for _, user := range users {
+		keys = append(keys, user.resource())
+	}
+	WriteJSON(w, http.StatusOK, keys)
+}
+
+func apiCreateKey(w http.ResponseWriter, r *http.Request, s *OutlineServer) {
+	req := NewKeyRequest{}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Port < 0 || req.Port > 65535 {
+		WriteError(w, http.StatusBadRequest, "invalid port: "+strconv.Itoa(req.Port))
+		return
+	}
+	if req.Days != nil && req.ExpiresAt != nil {
+		WriteError(w, http.StatusBadRequest, "set days or expires_at, not both")
+		return
+	}
+	if (req.Days != nil || req.ExpiresAt != nil) && !s.HasExpiry() {
+		writeAPIError(w, api.ErrNoSidecar)
+		return
+	}
+	if req.DataLimitBytes != nil && req.QuotaBytes != nil {
+		WriteError(w, http.StatusBadRequest, "set data_limit_bytes or quota_bytes, not both")
+		return
+	}
+	if (req.Metadata != nil || req.QuotaBytes != nil) && s.store == nil {
+		writeAPIError(w, ErrNoStore)
+		return
+	}
+	if req.Metadata != nil {
+		if err := req.Metadata.validate(); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+	}
+	days := 30
+	if req.Days != nil {
+		days = *req.Days
+	}
+	expiry, err := expiryIn(days)
+	if req.ExpiresAt != nil {
+		expiry = *req.ExpiresAt
+		if !time.Now().Before(expiry) {
+			err = api.ErrInvalidArgument
+		}
+	}
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	opts := api.NewAccessKey{
+		ID:       req.ID,
+		Name:     req.Name,
+		Method:   req.Method,
+		Password: req.Password,
+		Port:     req.Port,
+	}
+	if req.DataLimitBytes != nil {
+		opts.Limit = &api.DataLimit{Bytes: *req.DataLimitBytes}
+	}
+
+	ctx := r.Context()
+	user, err := s.AddUser(ctx, opts)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	steps := []step{}
+	if s.HasExpiry() {
+		steps = append(steps, step{"set expiry", func() error { return s.SetExpiry(ctx, user.ID, expiry) }})
+	}
+	if opts.Limit != nil {
+		steps = append(steps, step{"set data limit", func() error {
+			return s.SetGoDataLimit(ctx, user.ID, gigabytes(opts.Limit.Bytes))
+		}})
+	}
+	if req.Metadata != nil {
+		steps = append(steps, step{"set metadata", func() error { return s.SetMetadata(ctx, user.ID, *req.Metadata) }})
+	}
+	if req.QuotaBytes != nil {
+		steps = append(steps, step{"set quota", func() error { return s.SetQuota(ctx, user.ID, *req.QuotaBytes) }})
+	}
+	_, failed, _ := s.runSteps(user.ID, steps)
+	s.refreshAfter(ctx)
+	if usr := s.Snapshot().User(user.ID); usr != nil {
+		user = usr
+	} else {
+		user.Enabled = true
+		if s.HasExpiry() && !expiry.IsZero() {
+			user.ExpiresAt = expiry.In(s.location())
+			user.DaysLeft = daysLeft(expiry, time.Now())
+			user.Expire = user.ExpiresAt.Format("2006-01-02")
+		}
+	}
+
+	key := user.resource()
+	key.Failed = failed
+	w.Header().Set("Location", APIPath+"/servers/"+s.ID+"/keys/"+user.ID)
+	WriteJSON(w, http.StatusCreated, key)
+}
+
+func apiGetKey(w http.ResponseWriter, r *http.Request, s *OutlineServer) {
+	user := s.Snapshot().User(r.PathValue("kid"))
+	if user == nil {
+		writeAPIError(w, api.ErrKeyNotFound)
+		return
+	}
+	WriteJSON(w, http.StatusOK, user.resource())
+}
+
+func apiPatchKey(w http.ResponseWriter, r *http.Request, s *OutlineServer) {
+	patch := KeyPatch{}
+	if !readJSON(w, r, &patch) {
+		return
+	}
+	if (patch.DataLimitBytes != nil || patch.RemoveDataLimit) && patch.QuotaBytes != nil {
+		WriteError(w, http.StatusBadRequest, "set the data limit or quota_bytes, not both")
+		return
+	}
+	ctx := r.Context()
+	id := r.PathValue("kid")
+
+	// read the key first to answer 404 before changing anything
+	// and to know whether the enabled state needs a toggle
+	if err := s.Refresh(ctx); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	user := s.Snapshot().User(id)
+	if user == nil {
+		writeAPIError(w, api.ErrKeyNotFound)
+		return
+	}
+
+	steps := []step{}
+	if patch.Name != nil {
+		steps = append(steps, step{"set name", func() error { return s.RenameUser(ctx, id, *patch.Name) }})
+	}
+	switch {
+	case patch.RemoveDataLimit:
+		steps = append(steps, step{"remove data limit", func() error { return s.RemoveAllowance(ctx, id) }})
+	case patch.DataLimitBytes != nil:
+		steps = append(steps, step{"set data limit", func() error {
+			s.logger.Info(fmt.Sprintf("set user %v data limit to %v bytes", id, *patch.DataLimitBytes))
+			if err := s.setDataLimit(ctx, id, patch.DataLimitBytes); err != nil {
+				return err
+			}
+			return s.SetGoDataLimit(ctx, id, gigabytes(*patch.DataLimitBytes))
+		}})
+	}
+	if patch.Enabled != nil && *patch.Enabled != user.Enabled {
+		steps = append(steps, step{"set enabled", func() error { return s.ChangeGoUserStatus(ctx, id) }})
+	}
+	switch {
+	case patch.RemoveExpiry:
+		steps = append(steps, step{"remove expiry", func() error { return s.SetExpiry(ctx, id, time.Time{}) }})
+	case patch.ExpiresAt != nil:
+		steps = append(steps, step{"set expiry", func() error { return s.SetExpiry(ctx, id, *patch.ExpiresAt) }})
+	case patch.DaysLeft != nil:
+		steps = append(steps, step{"set expiry", func() error {
+			expiry, err := expiryIn(*patch.DaysLeft)
+			if err != nil {
+				return err
+			}
+			return s.SetExpiry(ctx, id, expiry)
+		}})
+	}
+	if patch.Metadata != nil {
+		steps = append(steps, step{"set metadata", func() error { return s.SetMetadata(ctx, id, *patch.Metadata) }})
+	}
+	if patch.QuotaBytes != nil {
+		steps = append(steps, step{"set quota", func() error { return s.SetQuota(ctx, id, *patch.QuotaBytes) }})
+	}
+	applied, failed, err := s.runSteps(id, steps)
+	if len(applied) == 0 && err != nil {
+		// nothing changed, answer as a single change
+		writeAPIError(w, err)
+		return
+	}
+	s.refreshAfter(ctx)
+	user = s.Snapshot().User(id)
+	if user == nil {
+		writeAPIError(w, api.ErrKeyNotFound)
+		return
+	}
+	key := user.resource()
+	if len(failed) > 0 {
+		key.Failed, key.Applied = failed, applied
+	}
+	WriteJSON(w, http.StatusOK, key)
+}
+
+func apiDeleteKey(w http.ResponseWriter, r *http.Request, s *OutlineServer) {
+	if err := s.DeleteUser(r.Context(), r.PathValue("kid")); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	s.refreshAfter(r.Context())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiGetUsage(w http.ResponseWriter, r *http.Request, s *OutlineServer) {
+	snap := s.Snapshot()
+	res := UsageResource{TotalBytes: uint64(snap.Total), BytesTransferred: make(map[string]uint64, len(snap.Users))}
+	for _, user := range snap.Users {
+		res.BytesTransferred[user.ID] = uint64(user.TransferredBytes)
+	}
+	WriteJSON(w, http.StatusOK, res)
+}
+
+func apiGetUsageHistory(w http.ResponseWriter, r *http.Request, s *OutlineServer) {
+	if s.store == nil {
+		writeAPIError(w, ErrNoStore)
+		return
+	}
+	period, from, to, err := s.usageRange(r)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	usage, err := s.store.Usage(s.ID, period, from, to, s.location())
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	users := s.Snapshot().Users
+	series := make([]UsageSeriesResource, 0, len(users))
+	for _, user := range users {
+		points, ok := usage[user.ID]
+		if !ok {
+			points, _ = keyUsage(nil, period, from, to, s.location())
+		}
+		series = append(series, usageSeries(user.ID, period, points))
+	}
+	WriteJSON(w, http.StatusOK, series)
+}
+
+func apiGetKeyUsage(w http.ResponseWriter, r *http.Request, s *OutlineServer) {
+	if s.store == nil {
+		writeAPIError(w, ErrNoStore)
+		return
+	}
+	id := r.PathValue("kid")
+	if s.Snapshot().User(id) == nil {
+		writeAPIError(w, api.ErrKeyNotFound)
+		return
+	}
+	period, from, to, err := s.usageRange(r)
+	if err != nil {
+		WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	points, err := s.store.KeyUsage(s.ID, id, period, from, to, s.location())
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	WriteJSON(w, http.StatusOK, usageSeries(id, period, points))
+}
+
+// usageRange reads the period and range of a usage query of r.
+// from and to are RFC 3339 times or dates in the time zone of the Server.
+func (s *OutlineServer) usageRange(r *http.Request) (period Period, from, to time.Time, err error) {
+	query := r.URL.Query()
+	period = PeriodDay
+	if v := query.Get("period"); v != "" {
+		if period, err = ParsePeriod(v); err != nil {
+			return
+		}
+	}
+	to = time.Now()
+	if v := query.Get("to"); v != "" {
+		if to, err = parseTime(v, s.location()); err != nil {
+			return period, from, to, fmt.Errorf("invalid to: %q", v)
+		}
+	}
+	from = period.defaultFrom(to)
+	if v := query.Get("from"); v != "" {
+		if from, err = parseTime(v, s.location()); err != nil {
+			return period, from, to, fmt.Errorf("invalid from: %q", v)
+		}
+	}
+	if from.After(to) {
+		err = errors.New("from is after to")
+	}
+	return
+}
+
+func usageSeries(id string, period Period, points []UsagePoint) UsageSeriesResource {
+	res := UsageSeriesResource{ID: id, Period: period, Points: points}
+	for _, p := range points {
+		res.TotalBytes += p.Bytes
+	}
+	return res
+}
+
+func apiListDeadlines(w http.ResponseWriter, r *http.Request, s *OutlineServer) {
+	users := s.Snapshot().Users
+	deadlines := make([]DeadlineResource, 0, len(users))
+	for _, user := range users {
+		deadlines = append(deadlines, user.deadline())
+	}
+	WriteJSON(w, http.StatusOK, deadlines)
+}
+
+func apiSetDeadline(w http.ResponseWriter, r *http.Request, s *OutlineServer) {
+	req := DeadlineRequest{}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	ctx := r.Context()
+	id := r.PathValue("kid")
+	extend := req.ExtendDays != 0 || req.ExtendMonths != 0
+	var expiry time.Time
+	var err error
+	switch {
+	case req.DaysLeft != nil && req.ExpiresAt == nil && !extend:
+		if expiry, err = expiryIn(*req.DaysLeft); err == nil {
+			err = s.SetExpiry(ctx, id, expiry)
+		}
+	case req.ExpiresAt != nil && req.DaysLeft == nil && !extend:
+		expiry = *req.ExpiresAt
+		err = s.SetExpiry(ctx, id, expiry)
+	case extend && req.DaysLeft == nil && req.ExpiresAt == nil:
+		expiry, err = s.ExtendExpiry(ctx, id, req.ExtendDays, req.ExtendMonths)
+	default:
+		WriteError(w, http.StatusBadRequest, "set one of days_left, expires_at or extend_days and extend_months")
+		return
+	}
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	s.refreshAfter(ctx)
+	if user := s.Snapshot().User(id); user != nil {
+		WriteJSON(w, http.StatusOK, user.deadline())
+		return
+	}
+	user := &OutlineUser{ID: id, Enabled: true}
+	if !expiry.IsZero() {
+		user.ExpiresAt = expiry.In(s.location())
+		user.DaysLeft = daysLeft(expiry, time.Now())
+		user.Expire = user.ExpiresAt.Format("2006-01-02")
+	}
+	WriteJSON(w, http.StatusOK, user.deadline())
+}
+
+// deadline returns the expiry of the key as shown by the JSON API.
+func (u *OutlineUser) deadline() DeadlineResource {
+	return DeadlineResource{
+		ID:        u.ID,
+		DaysLeft:  u.DaysLeft,
+		Expire:    u.Expire,
+		ExpiresAt: u.expiresAt(),
+		Enabled:   u.Enabled,
+		Expired:   u.Expired,
+	}
+}
+
+// expiresAt returns ExpiresAt, nil for never.
+func (u *OutlineUser) expiresAt() *time.Time {
+	if u.ExpiresAt.IsZero() {
+		return nil
+	}
+	t := u.ExpiresAt
+	return &t
+}
+
+// resource returns the server as shown by the JSON API.
+func (s *OutlineServer) resource() ServerResource {
+	snap := s.Snapshot()
+	res := ServerResource{
+		ID:                    s.ID,
+		Label:                 s.Label,
+		Ready:                 true,
+		Name:                  snap.Info.Name,
+		ServerID:              snap.Info.ServerID,
+		Version:               snap.Info.Version,
+		MetricsEnabled:        snap.Info.MetricsEnabled,
+		CreatedTimestampMs:    snap.Info.CreatedTimestampMs,
+		PortForNewAccessKeys:  snap.Info.PortForNewAccessKeys,
+		HostnameForAccessKeys: snap.Info.HostnameForAccessKeys,
+		Refreshed:             snap.Refreshed,
+		Sidecar:               s.HasSidecar(),
+	}
+	if snap.Info.DefaultDataLimit != nil {
+		n := snap.Info.DefaultDataLimit.Bytes
+		res.DefaultDataLimitBytes = &n
+	}
+	return res
+}
+
+// resource returns the key as shown by the JSON API.
+func (u *OutlineUser) resource() KeyResource {
+	res := KeyResource{
+		ID:               u.ID,
+		Name:             u.Name,
+		Password:         u.Password,
+		Port:             u.Port,
+		Method:           u.Method,
+		AccessURL:        u.AccessURL,
+		TransferredBytes: uint64(u.TransferredBytes),
+		Enabled:          u.Enabled,
+		Online:           u.Online,
+		IP:               u.IP,
+		DaysLeft:         u.DaysLeft,
+		Expire:           u.Expire,
+		ExpiresAt:        u.expiresAt(),
+		Expired:          u.Expired,
+		Metadata:         u.Metadata,
+	}
+	if u.DataLimit != nil {
+		n := u.DataLimit.Bytes
+		res.DataLimitBytes = &n
+	}
+	if u.Quota != nil {
+		n, start, end := u.Quota.Bytes, u.Quota.CycleStart, u.CycleEnd
+		res.QuotaBytes = &n
+		res.CycleStart = &start
+		res.CycleEnd = &end
+		res.CycleUsedBytes = uint64(u.CycleUsed)
+	}
+	return res
+}
+
+// RequireJSON is Require answering with a JSON error body.
+func RequireJSON(role Role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if RoleFromContext(r.Context()) < role {
+			WriteError(w, http.StatusForbidden, "requires role "+role.String())
+			return
+		}
+		h(w, r)
+	}
+}
+
+// WriteJSON answers v as JSON with code.
+func WriteJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// WriteError answers an ErrorResource with code.
+func WriteError(w http.ResponseWriter, code int, msg string) {
+	WriteJSON(w, code, ErrorResource{Error: msg})
+}
+
+// writeAPIError answers a failed call to the Outline server.
+func writeAPIError(w http.ResponseWriter, err error) {
+	code, msg := errorStatus(err)
+	WriteError(w, code, msg)
+}
+
+// readJSON decodes the body of r into v, answering 400 when it fails.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		WriteError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return false
+	}
+	return true
+}
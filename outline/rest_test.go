@@ -0,0 +1,193 @@
+package outline
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/imgk/caddy-outline-manager/outline/api"
+)
+
+func TestAPIKeys(t *testing.T) {
+	s, _, mock := newTestServer(t, true)
+	keys := APIPath + "/servers/mock/keys"
+
+	for _, c := range []struct {
+		role   Role
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{RoleViewer, http.MethodPost, keys, `{"name":"a"}`, http.StatusForbidden},
+		{RoleOperator, http.MethodPost, keys, `{"id":"7","name":"a","data_limit_bytes":1073741824}`, http.StatusCreated},
+		{RoleOperator, http.MethodPost, keys, `{"id":"7"}`, http.StatusConflict},
+		{RoleOperator, http.MethodPost, keys, `{"bogus":1}`, http.StatusBadRequest},
+		{RoleOperator, http.MethodPost, keys, `{"port":70000}`, http.StatusBadRequest},
+		{RoleViewer, http.MethodGet, keys + "/7", "", http.StatusOK},
+		{RoleViewer, http.MethodGet, keys + "/8", "", http.StatusNotFound},
+		{RoleViewer, http.MethodGet, APIPath + "/servers/other/keys", "", http.StatusNotFound},
+		{RoleOperator, http.MethodPatch, keys + "/7", `{"name":"b","metadata":{"plan":"pro"}}`, http.StatusOK},
+		{RoleOperator, http.MethodPatch, keys + "/8", `{"name":"b"}`, http.StatusNotFound},
+		{RoleOperator, http.MethodDelete, keys + "/7", "", http.StatusForbidden},
+		{RoleOwner, http.MethodDelete, keys + "/7", "", http.StatusNoContent},
+		{RoleOwner, http.MethodDelete, keys + "/7", "", http.StatusNotFound},
+	} {
+		w := serve(s, c.role, c.method, c.path, c.body)
+		if w.Code != c.code {
+			t.Errorf("%v %v as %v: got %v, want %v: %v", c.method, c.path, c.role, w.Code, c.code, w.Body)
+		}
+	}
+	if len(mock.keys) != 0 {
+		t.Errorf("keys left: %v", mock.keys)
+	}
+}
+
+func TestAPICreateKey(t *testing.T) {
+	s, _, mock := newTestServer(t, true)
+
+	w := serve(s, RoleOperator, http.MethodPost, APIPath+"/servers/mock/keys",
+		`{"name":"a","data_limit_bytes":1024,"metadata":{"contact":"a@example.com"}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %v: %v", w.Code, w.Body)
+	}
+	key := KeyResource{}
+	if err := json.Unmarshal(w.Body.Bytes(), &key); err != nil {
+		t.Fatal(err)
+	}
+	if want := APIPath + "/servers/mock/keys/" + key.ID; w.Header().Get("Location") != want {
+		t.Errorf("Location %q, want %q", w.Header().Get("Location"), want)
+	}
+	if key.Name != "a" || key.DataLimitBytes == nil || *key.DataLimitBytes != 1024 {
+		t.Errorf("key %+v", key)
+	}
+	if key.Metadata.Contact != "a@example.com" {
+		t.Errorf("metadata %+v", key.Metadata)
+	}
+	if key.ExpiresAt == nil {
+		t.Error("no default expiry")
+	}
+	if mock.keys[key.ID] == nil {
+		t.Errorf("key %v not created", key.ID)
+	}
+}
+
+func TestAPIUpstreamError(t *testing.T) {
+	s, _, mock := newTestServer(t, false)
+	mock.mu.Lock()
+	mock.fail = errors.New("dial tcp https://192.0.2.1:1234/secret: refused")
+	mock.mu.Unlock()
+
+	for _, c := range []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{http.MethodPost, APIPath + "/servers/mock/keys", `{}`, http.StatusBadGateway},
+		{http.MethodPost, APIPath + "/servers/mock/refresh", "", http.StatusBadGateway},
+		{http.MethodGet, APIPath + "/servers/mock/usage/history", "", http.StatusNotImplemented},
+	} {
+		w := serve(s, RoleOwner, c.method, c.path, c.body)
+		if w.Code != c.code {
+			t.Errorf("%v %v: got %v, want %v: %v", c.method, c.path, w.Code, c.code, w.Body)
+		}
+		if c.code == http.StatusBadGateway && w.Body.String() != `{"error":"Bad Gateway"}`+"\n" {
+			t.Errorf("%v %v: body %q leaks the error", c.method, c.path, w.Body)
+		}
+	}
+
+	mock.mu.Lock()
+	mock.fail = api.ErrKeyNotFound
+	mock.mu.Unlock()
+	if w := serve(s, RoleOwner, http.MethodDelete, APIPath+"/servers/mock/keys/1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE: got %v, want 404", w.Code)
+	}
+}
+
+func TestAPICreateKeySteps(t *testing.T) {
+	s, _, mock := newTestServer(t, false)
+	keys := APIPath + "/servers/mock/keys"
+
+	// preconditions are checked before the key is created
+	for _, body := range []string{`{"metadata":{"plan":"pro"}}`, `{"quota_bytes":1024}`} {
+		if w := serve(s, RoleOperator, http.MethodPost, keys, body); w.Code != http.StatusNotImplemented {
+			t.Errorf("%v without a store: got %v, want 501", body, w.Code)
+		}
+	}
+	if len(mock.keys) != 0 {
+		t.Errorf("keys created: %v", mock.keys)
+	}
+
+	s, _, mock = newTestServer(t, true)
+	if w := serve(s, RoleOperator, http.MethodPost, keys, `{"metadata":{"fields":{"":"x"}}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("empty field name: got %v, want 400", w.Code)
+	}
+	if len(mock.keys) != 0 {
+		t.Errorf("keys created: %v", mock.keys)
+	}
+
+	// the steps after the creation fail with the store
+	s.Store.Close()
+	w := serve(s, RoleOperator, http.MethodPost, keys, `{"metadata":{"plan":"pro"}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %v: %v", w.Code, w.Body)
+	}
+	key := KeyResource{}
+	if err := json.Unmarshal(w.Body.Bytes(), &key); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"set expiry: Internal Server Error", "set metadata: Internal Server Error"}
+	if !reflect.DeepEqual(key.Failed, want) {
+		t.Errorf("failed %q, want %q", key.Failed, want)
+	}
+}
+
+func TestAPIPatchKeySteps(t *testing.T) {
+	s, _, mock := newTestServer(t, true)
+	keys := APIPath + "/servers/mock/keys"
+	if w := serve(s, RoleOperator, http.MethodPost, keys, `{"id":"7","name":"a"}`); w.Code != http.StatusCreated {
+		t.Fatalf("got %v: %v", w.Code, w.Body)
+	}
+
+	// a change failing alone is answered with its status
+	if w := serve(s, RoleOperator, http.MethodPatch, keys+"/7", `{"days_left":-1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid days_left: got %v, want 400", w.Code)
+	}
+
+	w := serve(s, RoleOperator, http.MethodPatch, keys+"/7", `{"name":"b","metadata":{"fields":{"":"x"}}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %v: %v", w.Code, w.Body)
+	}
+	key := KeyResource{}
+	if err := json.Unmarshal(w.Body.Bytes(), &key); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"set name"}; !reflect.DeepEqual(key.Applied, want) {
+		t.Errorf("applied %q, want %q", key.Applied, want)
+	}
+	if want := []string{`set metadata: invalid argument: custom field name ""`}; !reflect.DeepEqual(key.Failed, want) {
+		t.Errorf("failed %q, want %q", key.Failed, want)
+	}
+	if mock.keys["7"].Name != "b" {
+		t.Errorf("name %q, want b", mock.keys["7"].Name)
+	}
+
+	if w := serve(s, RoleViewer, http.MethodGet, keys+"/7/usage?period=hour&from=2000-01-01", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("too many points: got %v, want 400: %v", w.Code, w.Body)
+	}
+
+	// the failures of the store are not those of the Outline server
+	s.Store.Close()
+	for _, path := range []string{APIPath + "/servers/mock/usage/history", keys + "/7/usage"} {
+		if w := serve(s, RoleViewer, http.MethodGet, path, ""); w.Code != http.StatusInternalServerError {
+			t.Errorf("%v with a closed store: got %v, want 500", path, w.Code)
+		}
+	}
+	w = serve(s, RoleOperator, http.MethodPatch, keys+"/7", `{"metadata":{"plan":"pro"}}`)
+	if w.Code != http.StatusInternalServerError || w.Body.String() != `{"error":"Internal Server Error"}`+"\n" {
+		t.Errorf("patch with a closed store: got %v: %v", w.Code, w.Body)
+	}
+}
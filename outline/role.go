@@ -0,0 +1,132 @@
+package outline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Role is the permission level of an admin account.
+// Each role includes the permissions of the roles below it.
+type Role int
+
+const (
+	RoleNone Role = iota
+	// RoleViewer can read the panel and usage.
+	RoleViewer
+	// RoleOperator can add, rename, limit and enable keys.
+	RoleOperator
+	// RoleOwner can delete keys, manage admins and change server settings.
+	RoleOwner
+)
+
+var roleNames = map[Role]string{
+	RoleViewer:   "viewer",
+	RoleOperator: "operator",
+	RoleOwner:    "owner",
+}
+
+func ParseRole(name string) (Role, error) {
+	for role, n := range roleNames {
+		if n == name {
+			return role, nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role: %q", name)
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return "none"
+}
+
+func (r Role) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *Role) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	role, err := ParseRole(name)
+	if err != nil {
+		return err
+	}
+	*r = role
+	return nil
+}
+
+type roleKey struct{}
+
+// WithRole returns a copy of ctx carrying the role of the logged in admin.
+func WithRole(ctx context.Context, role Role) context.Context {
+	return context.WithValue(ctx, roleKey{}, role)
+}
+
+// RoleFromContext returns the role stored by WithRole.
+func RoleFromContext(ctx context.Context) Role {
+	role, _ := ctx.Value(roleKey{}).(Role)
+	return role
+}
+
+// Require rejects requests whose admin role is lower than role.
+func Require(role Role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if RoleFromContext(r.Context()) < role {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+type adminKey struct{}
+
+// WithAdmin returns a copy of ctx carrying the name of the logged in
+// admin, recorded as the creator of new keys.
+func WithAdmin(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, adminKey{}, name)
+}
+
+// AdminFromContext returns the name stored by WithAdmin.
+func AdminFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(adminKey{}).(string)
+	return name
+}
+
+type serverScopeKey struct{}
+
+// WithServerScope returns a copy of ctx limited to the server with id,
+// as for API tokens minted for a single server.
+func WithServerScope(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, serverScopeKey{}, id)
+}
+
+// ServerAllowed reports whether the request of ctx may reach the server
+// with id. An empty id stands for routes not tied to a single server.
+func ServerAllowed(ctx context.Context, id string) bool {
+	scope, _ := ctx.Value(serverScopeKey{}).(string)
+	return scope == "" || scope == id
+}
+
+// scopedRouter registers the panel routes of one server on mux,
+// rejecting requests limited to another server.
+type scopedRouter struct {
+	mux *routeMux
+	id  string
+}
+
+func (r scopedRouter) Handle(op Operation, h http.HandlerFunc) {
+	h = Require(op.Role, h)
+	r.mux.HandleFunc(op.Method+" "+op.Path, func(w http.ResponseWriter, r2 *http.Request) {
+		if !ServerAllowed(r2.Context(), r.id) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h(w, r2)
+	})
+}
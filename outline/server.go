@@ -1,41 +1,335 @@
 package outline
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-outline-manager/outline/api"
 )
 
+// BasePath is the root of all manager routes.
+const BasePath = "/outline/manager"
+
 // control panel server
 // control multiple servers
 type Server struct {
-	router  *http.ServeMux
-	logger  *zap.Logger
-	servers map[uint32]*OutlineServer
+	router *routeMux
+	logger *zap.Logger
+	// operations documents the routes registered by Handle
+	operations []Operation
+
+	mu      sync.RWMutex
+	servers []*OutlineServer
+	ready   map[*OutlineServer]bool
+
+	// Interval is how often servers are refreshed in the background,
+	// DefaultRefreshInterval if zero.
+	Interval time.Duration
+
+	// ctx is cancelled by Close to stop the pollers and retries
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// SessionCookie names the session cookie in the OpenAPI document.
+	SessionCookie string
+
+	// OnAdd is called with the config of every server added by Add,
+	// to persist it. Errors are logged.
+	OnAdd func(Config) error
+
+	// Store keeps expiries of keys, nil to leave them to sidecars.
+	Store *Store
+	// Location is the time zone of expiry dates in the panel,
+	// time.Local if nil.
+	Location *time.Location
+
+	// Webhooks receive the events of keys, queued in Store.
+	Webhooks []Webhook
+	// ExpiringDays is how many days before its expiry a key is
+	// reported as expiring, DefaultExpiringDays if zero.
+	ExpiringDays int
+	// wake has the dispatcher of webhooks look at the queue now
+	wake chan struct{}
 }
 
-func NewServer(servers map[uint32]*OutlineServer, logger *zap.Logger) *Server {
+func NewServer(servers []*OutlineServer, logger *zap.Logger) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
 	s := &Server{
-		router:  http.NewServeMux(),
+		ctx:     ctx,
+		cancel:  cancel,
+		router:  &routeMux{ServeMux: http.NewServeMux()},
 		logger:  logger,
 		servers: servers,
+		ready:   make(map[*OutlineServer]bool),
+		wake:    make(chan struct{}, 1),
+	}
+
+	// baseurl GET
+	// redirect to the panel of the first available server
+	s.Handle(Operation{
+		ID:      "showFirstPanel",
+		Method:  http.MethodGet,
+		Path:    BasePath,
+		Role:    RoleViewer,
+		Summary: "Redirect to the panel of the first connected server",
+		Status:  http.StatusFound,
+	}, func(w http.ResponseWriter, r *http.Request) {
+		for _, entry := range s.Entries(nil) {
+			if entry.Ready && ServerAllowed(r.Context(), entry.ID) {
+				http.Redirect(w, r, entry.Link, http.StatusFound)
+				return
+			}
+		}
+		http.Error(w, "no outline server is available yet", http.StatusServiceUnavailable)
+	})
+	s.Handle(Operation{
+		ID:      "getOpenAPI",
+		Method:  http.MethodGet,
+		Path:    SpecPath,
+		Summary: "Get this OpenAPI document",
+	}, s.serveSpec)
+	s.setAPIRouter()
+	s.setWebhookRouter()
+
+	return s
+}
+
+// Connect fetches the info and users of every server and registers the
+// routes of those that answer. Unreachable servers are retried in the
+// background with backoff until Close, as are webhooks.
+func (s *Server) Connect(ctx context.Context) {
+	if s.Store != nil && len(s.Webhooks) > 0 {
+		s.wg.Add(1)
+		go s.dispatch(s.ctx)
+	}
+	for _, server := range s.servers {
+		// do not hold up provisioning for long on an unreachable server
+		tctx, cancel := context.WithTimeout(ctx, api.DefaultTimeout)
+		err := s.connect(tctx, server)
+		cancel()
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("failed to connect to server: %v, error: %v, retry in background", server.URL, err))
+			s.wg.Add(1)
+			go s.retry(s.ctx, server)
+		}
 	}
+}
 
-	type ServerEntry struct {
-		URL     string
-		Pattern string
+// Add validates config by connecting to the server and starts managing it.
+func (s *Server) Add(ctx context.Context, config Config) (*OutlineServer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	server, err := NewOutlineServer(config, s.logger)
+	if err != nil {
+		return nil, err
 	}
-	entrys := make([]ServerEntry, 0, len(servers))
 
-	for _, server := range servers {
-		pattern := "/outline/manager"
-		server.SetRouter(pattern, s.router)
-		entrys = append(entrys, ServerEntry{URL: server.URL, Pattern: pattern})
+	s.mu.RLock()
+	for _, other := range s.servers {
+		if other.URL == config.APIURL {
+			s.mu.RUnlock()
+			return nil, fmt.Errorf("server %v is already managed", other.ID)
+		}
+		if config.ID != "" && other.ID == config.ID {
+			s.mu.RUnlock()
+			return nil, fmt.Errorf("server id %v is used by %v", other.ID, other.URL)
+		}
 	}
+	s.mu.RUnlock()
 
-	return s
+	if err := s.connect(ctx, server); err != nil {
+		server.forgetMetrics()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.servers = append(s.servers, server)
+	s.mu.Unlock()
+
+	if s.OnAdd != nil {
+		// the server is managed from now on even if it is not saved
+		config.ID = server.ID
+		if err := s.OnAdd(config); err != nil {
+			s.logger.Error(fmt.Sprintf("save server %v error: %v", server.ID, err))
+		}
+	}
+	return server, nil
+}
+
+func (s *Server) connect(ctx context.Context, server *OutlineServer) error {
+	server.store = s.Store
+	if err := server.Refresh(ctx); err != nil {
+		return err
+	}
+
+	if server.ID == "" {
+		id := server.Snapshot().Info.ServerID
+		if err := validID(id); err != nil || id == "" {
+			return fmt.Errorf("no usable server id, set one in config: %q", id)
+		}
+		s.mu.Lock()
+		err := s.checkID(server, id)
+		if err == nil {
+			server.ID = id
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		// join the records of the store, kept by id, without holding
+		// up the other servers
+		server.refreshAfter(ctx)
+	}
+
+	s.mu.Lock()
+	if err := s.checkID(server, server.ID); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	server.group = s
+	server.SetRouter(server.Prefix(), scopedRouter{mux: s.router, id: server.ID})
+	s.ready[server] = true
+	s.wg.Add(1)
+	go s.poll(s.ctx, server)
+	s.mu.Unlock()
+
+	s.logger.Info(fmt.Sprintf("manage server %v: %v at %v", server.ID, server.URL, server.Prefix()))
+	return nil
+}
+
+// checkID fails when id is used by a connected server other than
+// server. s.mu must be held.
+func (s *Server) checkID(server *OutlineServer, id string) error {
+	for other, ok := range s.ready {
+		if ok && other != server && other.ID == id {
+			return fmt.Errorf("server id %v is used by %v", id, other.URL)
+		}
+	}
+	return nil
+}
+
+func (s *Server) retry(ctx context.Context, server *OutlineServer) {
+	defer s.wg.Done()
+
+	const maxDelay = 5 * time.Minute
+
+	delay := 5 * time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		err := s.connect(ctx, server)
+		if err == nil {
+			return
+		}
+		s.logger.Error(fmt.Sprintf("failed to connect to server: %v, error: %v, retry in %v", server.URL, err, delay))
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// Close stops refreshing and retrying servers and waits for it. The
+// upstream metrics of the servers are deleted unless another Server
+// manages them.
+func (s *Server) Close() {
+	s.cancel()
+	s.wg.Wait()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, server := range s.servers {
+		server.forgetMetrics()
+	}
+}
+
+// ServerEntry is a server shown in the server switcher of the panel.
+type ServerEntry struct {
+	ID      string
+	Name    string
+	Link    string
+	Ready   bool
+	Current bool
+}
+
+// Entries lists all configured servers in config order,
+// marking current as the one being shown.
+func (s *Server) Entries(current *OutlineServer) []ServerEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := make([]ServerEntry, 0, len(s.servers))
+	for _, server := range s.servers {
+		entry := ServerEntry{ID: server.ID, Ready: s.ready[server], Current: server == current}
+		if entry.Ready {
+			entry.Link = server.Prefix()
+		}
+		switch {
+		case server.Label != "":
+			entry.Name = server.Label
+		case entry.Ready && server.Snapshot().Info.Name != "":
+			entry.Name = server.Snapshot().Info.Name
+		default:
+			if uri, err := url.Parse(server.URL); err == nil {
+				entry.Name = uri.Host
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Handle registers h for the method and path of op, requiring its role,
+// and adds op to the OpenAPI document. Routes of the JSON API answer
+// errors as JSON. Changes to anything but a server in {sid} are
+// rejected for requests limited to one server.
+func (s *Server) Handle(op Operation, h http.HandlerFunc) {
+	isAPI := strings.HasPrefix(op.Path, APIPath+"/")
+	if !strings.Contains(op.Path, "{sid}") && op.Method != http.MethodGet {
+		// changes beyond a single server are out of reach of server scopes
+		next := h
+		h = func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case ServerAllowed(r.Context(), ""):
+				next(w, r)
+			case isAPI:
+				WriteError(w, http.StatusForbidden, "not allowed for a server scoped token")
+			default:
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			}
+		}
+	}
+	if isAPI {
+		h = RequireJSON(op.Role, h)
+	} else {
+		h = Require(op.Role, h)
+	}
+	s.router.HandleFunc(op.Method+" "+op.Path, h)
+
+	s.mu.Lock()
+	s.operations = append(s.operations, op)
+	s.mu.Unlock()
+}
+
+// ServeHTTP routes r, setting the path values of the matched pattern.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
 }
 
+// Handler reports the handler of r and whether a route matches it.
+// Serve matched requests with ServeHTTP, the handler alone does not
+// see path values.
 func (s *Server) Handler(r *http.Request) (http.Handler, bool) {
 	handler, pattern := s.router.Handler(r)
 	return handler, pattern != ""
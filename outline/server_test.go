@@ -0,0 +1,120 @@
+package outline
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TestConnectUnlocked checks that a server without a configured id is
+// refreshed under its resolved id without holding the lock of the group.
+func TestConnectUnlocked(t *testing.T) {
+	server, err := NewOutlineServer(Config{APIURL: "https://192.0.2.1:1234/secret", DisableSidecar: true}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := &mockAPI{}
+	server.API = mock
+	s := NewServer([]*OutlineServer{server}, zap.NewNop())
+	t.Cleanup(s.Close)
+
+	lists := 0
+	blocked, release := make(chan struct{}), make(chan struct{})
+	mock.onList = func() {
+		// the second list is the refresh under the resolved id
+		if lists++; lists == 2 {
+			close(blocked)
+			<-release
+		}
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.connect(context.Background(), server) }()
+
+	<-blocked
+	entries := make(chan []ServerEntry, 1)
+	go func() { entries <- s.Entries(nil) }()
+	select {
+	case list := <-entries:
+		if len(list) != 1 || list[0].ID != "mock" || list[0].Ready {
+			t.Errorf("entries %+v while connecting", list)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Entries blocked by connect")
+	}
+	close(release)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if s.lookup("mock") != server {
+		t.Error("server not connected")
+	}
+}
+
+// TestConcurrentAccess reads snapshots while keys are changed and
+// refreshed, for the race detector.
+func TestConcurrentAccess(t *testing.T) {
+	s, server, _ := newTestServer(t, true)
+	keys := APIPath + "/servers/mock/keys"
+
+	var wg sync.WaitGroup
+	run := func(n int, f func(i int)) {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				f(i)
+			}()
+		}
+	}
+	check := func(method, path, body string, codes ...int) {
+		w := serve(s, RoleOwner, method, path, body)
+		for _, code := range codes {
+			if w.Code == code {
+				return
+			}
+		}
+		t.Errorf("%v %v: got %v: %v", method, path, w.Code, w.Body)
+	}
+
+	run(8, func(i int) {
+		id := fmt.Sprint(100 + i)
+		check(http.MethodPost, keys, `{"id":"`+id+`","name":"a","quota_bytes":1073741824}`, http.StatusCreated)
+		check(http.MethodPatch, keys+"/"+id, `{"name":"b","metadata":{"plan":"pro"}}`, http.StatusOK)
+		check(http.MethodPut, APIPath+"/servers/mock/deadlines/"+id, `{"extend_days":3}`, http.StatusOK)
+		check(http.MethodDelete, keys+"/"+id, "", http.StatusNoContent)
+	})
+	run(8, func(i int) {
+		for j := 0; j < 10; j++ {
+			check(http.MethodGet, keys, "", http.StatusOK)
+			check(http.MethodGet, APIPath+"/servers", "", http.StatusOK)
+			check(http.MethodGet, APIPath+"/servers/mock/usage", "", http.StatusOK)
+			check(http.MethodGet, server.Prefix(), "", http.StatusOK)
+			s.Entries(server)
+		}
+	})
+	run(2, func(i int) {
+		ctx := context.Background()
+		for j := 0; j < 5; j++ {
+			if err := server.Refresh(ctx); err != nil {
+				t.Error(err)
+			}
+			if err := server.ExpireKeys(ctx); err != nil {
+				t.Error(err)
+			}
+			if err := server.RenewQuotas(ctx); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	wg.Wait()
+
+	if users := server.Snapshot().Users; len(users) != 0 {
+		t.Errorf("%v keys left", len(users))
+	}
+}
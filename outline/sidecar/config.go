@@ -0,0 +1,130 @@
+package sidecar
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Key is an access key of the outline-ss-server config file.
+type Key struct {
+	ID     string `yaml:"id" json:"id"`
+	Port   int    `yaml:"port" json:"port"`
+	Cipher string `yaml:"cipher" json:"cipher"`
+	Secret string `yaml:"secret" json:"secret"`
+	// Extra keeps fields this package does not know about.
+	Extra map[string]any `yaml:",inline" json:"extra,omitempty"`
+}
+
+// ssConfig is the config file of outline-ss-server, as written by the
+// Outline server:
+//
+//	keys:
+//	  - id: "1"
+//	    port: 12345
+//	    cipher: chacha20-ietf-poly1305
+//	    secret: Secret0
+type ssConfig struct {
+	Keys []Key `yaml:"keys"`
+	// Extra keeps the other sections of the file.
+	Extra map[string]any `yaml:",inline"`
+
+	// sum is the checksum of the file read
+	sum string
+}
+
+func readConfig(path string) (*ssConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &ssConfig{sum: checksum(b)}
+	if err := yaml.Unmarshal(b, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// checksum returns the hex SHA-256 of b.
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// user is what the sidecar keeps about a key.
+type user struct {
+	// Key is set while the key is disabled and left out of the config.
+	Key *Key `json:"key,omitempty"`
+	// Expired is set when the key was disabled by its deadline,
+	// so that a new deadline enables it again.
+	Expired  bool      `json:"expired,omitempty"`
+	Deadline time.Time `json:"deadline,omitzero"`
+	// Limit is the data limit in GB, 0 for none.
+	Limit int `json:"limit,omitempty"`
+}
+
+// state is the state file of the sidecar.
+type state struct {
+	Users map[string]*user `json:"users"`
+	// Config is the checksum of the config file as last written by
+	// the sidecar. Another one means the Outline server wrote it.
+	Config string `json:"config,omitempty"`
+}
+
+func readState(path string) (*state, error) {
+	st := &state{}
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, st); err != nil {
+			return nil, err
+		}
+	}
+	if st.Users == nil {
+		st.Users = map[string]*user{}
+	}
+	return st, nil
+}
+
+func writeState(path string, st *state) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, b)
+}
+
+// writeFile replaces the file at path with b, so that readers never
+// see it half written.
+func writeFile(path string, b []byte) error {
+	mode := fs.FileMode(0o600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
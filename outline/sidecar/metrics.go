@@ -0,0 +1,62 @@
+package sidecar
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+// dataMetric is the counter of bytes transferred by outline-ss-server,
+// labeled by access_key.
+const dataMetric = "shadowsocks_data_bytes"
+
+// fetchMetrics reads the bytes transferred by each key from Metrics and
+// records when they last grew.
+func (s *Sidecar) fetchMetrics(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Metrics, nil)
+	if err != nil {
+		return err
+	}
+	r, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code error, code: %v", r.StatusCode)
+	}
+
+	parser := expfmt.TextParser{}
+	families, err := parser.TextToMetricFamilies(r.Body)
+	if err != nil {
+		return err
+	}
+	bytes := map[string]float64{}
+	if family, ok := families[dataMetric]; ok {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "access_key" {
+					bytes[label.GetValue()] += metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, n := range bytes {
+		a, ok := s.active[id]
+		switch {
+		case !ok:
+			// traffic before the first fetch says nothing about now
+			s.active[id] = activity{bytes: n}
+		case n != a.bytes:
+			s.active[id] = activity{bytes: n, changed: now}
+		}
+	}
+	return nil
+}
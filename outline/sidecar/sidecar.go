@@ -0,0 +1,435 @@
+// Package sidecar is a reference implementation of the go/manager API
+// of customized Outline servers, which the manager uses to enable and
+// disable access keys and to set their deadlines.
+//
+// It works on the config file of outline-ss-server: disabling a key
+// takes it out of the file and enabling it puts it back. The Outline
+// server rewrites the file whenever its keys change, so disabled keys
+// are taken out again every Interval.
+package sidecar
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+
+	"github.com/imgk/caddy-outline-manager/outline/api"
+)
+
+// Path is where the API is served, below Prefix.
+const Path = "/go/manager"
+
+// DefaultInterval is how often deadlines are enforced by default.
+const DefaultInterval = 30 * time.Second
+
+// Sidecar manages the keys of a local outline-ss-server.
+type Sidecar struct {
+	// Prefix is a secret path to serve the API below, like the one
+	// in the URL of the management API.
+	Prefix string
+	// Metrics is the URL of the Prometheus metrics of outline-ss-server.
+	// Keys are online while their transferred bytes grow. Without it no
+	// key is online.
+	Metrics string
+	// Reload makes outline-ss-server read its config file again,
+	// called after the file is written.
+	Reload func() error
+	// Interval is how often deadlines are enforced and metrics fetched.
+	Interval time.Duration
+
+	config string
+	state  string
+	logger *zap.Logger
+	client *http.Client
+
+	mu     sync.Mutex
+	users  map[string]*user
+	active map[string]activity
+	// written is the checksum of the config file last written
+	written string
+}
+
+// activity is the traffic of a key as of the last metrics fetch.
+type activity struct {
+	bytes   float64
+	changed time.Time
+}
+
+// New returns a sidecar for the outline-ss-server config file at config,
+// keeping disabled keys, deadlines and limits in the file at state.
+func New(config, state string, logger *zap.Logger) (*Sidecar, error) {
+	if _, err := readConfig(config); err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+	st, err := readState(state)
+	if err != nil {
+		return nil, fmt.Errorf("read state: %w", err)
+	}
+	s := &Sidecar{
+		config:  config,
+		state:   state,
+		logger:  logger,
+		client:  &http.Client{Timeout: api.DefaultTimeout},
+		users:   st.Users,
+		active:  map[string]activity{},
+		written: st.Config,
+	}
+	return s, nil
+}
+
+// ListUsers returns the keys of the config file and the disabled keys,
+// sorted by id.
+func (s *Sidecar) ListUsers(ctx context.Context) ([]*api.GoUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	config, err := readConfig(s.config)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	list := make([]*api.GoUser, 0, len(config.Keys))
+	for _, key := range config.Keys {
+		if u := s.users[key.ID]; u != nil && u.Key != nil {
+			// listed below, until taken out of the file again
+			continue
+		}
+		list = append(list, s.goUser(key.ID, true, now))
+	}
+	for id, u := range s.users {
+		if u.Key != nil {
+			list = append(list, s.goUser(id, false, now))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+// goUser returns the go/manager view of the key id. s.mu must be held.
+func (s *Sidecar) goUser(id string, enabled bool, now time.Time) *api.GoUser {
+	user := &api.GoUser{ID: id, Enabled: enabled}
+	if a, ok := s.active[id]; ok && !a.changed.IsZero() {
+		user.Online = now.Sub(a.changed) <= 2*s.interval()
+	}
+	if u := s.users[id]; u != nil {
+		user.Limit = u.Limit
+		if left := u.Deadline.Sub(now); left > 0 {
+			user.DaysLeft = int((left + 24*time.Hour - 1) / (24 * time.Hour))
+		}
+	}
+	return user
+}
+
+// ToggleUser disables an enabled key and enables a disabled one.
+// Enabling a key past its deadline removes the deadline.
+func (s *Sidecar) ToggleUser(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	config, err := readConfig(s.config)
+	if err != nil {
+		return err
+	}
+	u := s.users[id]
+	switch {
+	case u != nil && u.Key != nil:
+		if !u.Deadline.IsZero() && !time.Now().Before(u.Deadline) {
+			u.Deadline = time.Time{}
+		}
+		s.enable(config, u)
+	case index(config, id) >= 0:
+		s.disable(config, id)
+	default:
+		return api.ErrKeyNotFound
+	}
+	return s.save(config)
+}
+
+// SetDeadline sets the deadline of a key to days from now, after which
+// the key is disabled. Zero days removes the deadline. A key disabled by
+// its deadline is enabled again.
+func (s *Sidecar) SetDeadline(ctx context.Context, id string, days int) error {
+	if days < 0 {
+		return api.ErrInvalidArgument
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	config, err := readConfig(s.config)
+	if err != nil {
+		return err
+	}
+	u, err := s.user(config, id)
+	if err != nil {
+		return err
+	}
+	u.Deadline = time.Time{}
+	if days > 0 {
+		u.Deadline = time.Now().Add(time.Duration(days) * 24 * time.Hour)
+	}
+	if u.Expired {
+		s.enable(config, u)
+		return s.save(config)
+	}
+	return s.saveState()
+}
+
+// SetLimit records the data limit of a key in GB. The limit is enforced
+// by the Outline server, it is only kept to be listed.
+func (s *Sidecar) SetLimit(ctx context.Context, id string, gb int) error {
+	if gb < 0 {
+		return api.ErrInvalidLimit
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	config, err := readConfig(s.config)
+	if err != nil {
+		return err
+	}
+	u, err := s.user(config, id)
+	if err != nil {
+		return err
+	}
+	u.Limit = gb
+	return s.saveState()
+}
+
+// Enforce disables the keys past their deadline, takes disabled keys
+// put back by the Outline server out of the config file again and
+// forgets keys deleted from it. Disabled keys are out of the file, they
+// are known to be deleted when the Outline server wrote the file
+// without them.
+func (s *Sidecar) Enforce() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	config, err := readConfig(s.config)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	// without a checksum, as of an older state file, the file is
+	// taken as written by the sidecar
+	rewritten := s.written != "" && s.written != config.sum
+	changed, forgot := false, false
+	for id, u := range s.users {
+		i := index(config, id)
+		switch {
+		case u.Key != nil && i >= 0:
+			// keep the key as last written by the Outline server
+			*u.Key = config.Keys[i]
+			config.Keys = slices.Delete(config.Keys, i, i+1)
+			changed = true
+		case u.Key != nil && !rewritten:
+		case i < 0:
+			s.logger.Info(fmt.Sprintf("key %v is deleted, forget it", id))
+			delete(s.users, id)
+			delete(s.active, id)
+			forgot = true
+		case !u.Deadline.IsZero() && !now.Before(u.Deadline):
+			s.logger.Info(fmt.Sprintf("key %v is past its deadline, disable it", id))
+			s.disable(config, id)
+			s.users[id].Expired = true
+			changed = true
+		}
+	}
+	if changed {
+		return s.save(config)
+	}
+	if rewritten {
+		// tell later writes of the Outline server from this one
+		s.written = config.sum
+	}
+	if forgot || rewritten {
+		return s.saveState()
+	}
+	return nil
+}
+
+// user returns the user of a key in config or disabled,
+// adding it if needed. s.mu must be held.
+func (s *Sidecar) user(config *ssConfig, id string) (*user, error) {
+	if u := s.users[id]; u != nil {
+		return u, nil
+	}
+	if index(config, id) < 0 {
+		return nil, api.ErrKeyNotFound
+	}
+	u := &user{}
+	s.users[id] = u
+	return u, nil
+}
+
+// enable puts the key of u back into config. s.mu must be held.
+func (s *Sidecar) enable(config *ssConfig, u *user) {
+	if index(config, u.Key.ID) < 0 {
+		config.Keys = append(config.Keys, *u.Key)
+	}
+	s.logger.Info(fmt.Sprintf("enable key %v", u.Key.ID))
+	u.Key = nil
+	u.Expired = false
+}
+
+// disable takes the key id out of config. s.mu must be held.
+func (s *Sidecar) disable(config *ssConfig, id string) {
+	i := index(config, id)
+	key := config.Keys[i]
+	config.Keys = slices.Delete(config.Keys, i, i+1)
+	u := s.users[id]
+	if u == nil {
+		u = &user{}
+		s.users[id] = u
+	}
+	u.Key = &key
+	s.logger.Info(fmt.Sprintf("disable key %v", id))
+}
+
+// save writes config and the state, then reloads outline-ss-server.
+// The state goes first so that a disabled key is never lost.
+// s.mu must be held.
+func (s *Sidecar) save(config *ssConfig) error {
+	b, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	s.written = checksum(b)
+	if err := s.saveState(); err != nil {
+		return err
+	}
+	if err := writeFile(s.config, b); err != nil {
+		return err
+	}
+	if s.Reload == nil {
+		return nil
+	}
+	if err := s.Reload(); err != nil {
+		return fmt.Errorf("reload outline-ss-server: %w", err)
+	}
+	return nil
+}
+
+// saveState writes the users and the checksum of the config file.
+// s.mu must be held.
+func (s *Sidecar) saveState() error {
+	return writeState(s.state, &state{Users: s.users, Config: s.written})
+}
+
+// index returns the index of the key id in config, -1 if absent.
+func index(config *ssConfig, id string) int {
+	return slices.IndexFunc(config.Keys, func(key Key) bool { return key.ID == id })
+}
+
+// Run enforces deadlines and fetches metrics every Interval until ctx is done.
+func (s *Sidecar) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval())
+	defer ticker.Stop()
+	for {
+		if err := s.Enforce(); err != nil {
+			s.logger.Error(fmt.Sprintf("enforce deadlines error: %v", err))
+		}
+		if s.Metrics != "" {
+			if err := s.fetchMetrics(ctx); err != nil && ctx.Err() == nil {
+				s.logger.Error(fmt.Sprintf("fetch metrics error: %v", err))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Sidecar) interval() time.Duration {
+	if s.Interval > 0 {
+		return s.Interval
+	}
+	return DefaultInterval
+}
+
+// ServeHTTP serves the go/manager API at Prefix+Path:
+//
+//	GET    ?                     200 {"status": [GoUser, ...]}
+//	PATCH  ?id={id}              200, 404 for an unknown key
+//	PUT    ?id={id}&deadline={n} 200, 400 for a bad n, 404 for an unknown key
+//	POST   ?id={id}&limit={gb}   200, 400 for a bad gb, 404 for an unknown key
+//
+// Failures answer a plain text error.
+func (s *Sidecar) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != s.Prefix+Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	id := r.URL.Query().Get("id")
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		type Status struct {
+			Status []*api.GoUser `json:"status"`
+		}
+		users, err := s.ListUsers(ctx)
+		if err != nil {
+			s.httpError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Status{Status: users})
+		return
+	case http.MethodPatch:
+		err = s.ToggleUser(ctx, id)
+	case http.MethodPut:
+		days, perr := strconv.Atoi(r.URL.Query().Get("deadline"))
+		if perr != nil {
+			http.Error(w, "deadline must be a number of days", http.StatusBadRequest)
+			return
+		}
+		err = s.SetDeadline(ctx, id, days)
+	case http.MethodPost:
+		gb, perr := strconv.Atoi(r.URL.Query().Get("limit"))
+		if perr != nil {
+			http.Error(w, "limit must be a number of GB", http.StatusBadRequest)
+			return
+		}
+		err = s.SetLimit(ctx, id, gb)
+	default:
+		w.Header().Set("Allow", "GET, PATCH, PUT, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		s.httpError(w, err)
+	}
+}
+
+func (s *Sidecar) httpError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, api.ErrKeyNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, api.ErrInvalidArgument), errors.Is(err, api.ErrInvalidLimit):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		s.logger.Error(fmt.Sprintf("go/manager error: %v", err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// Interface guards
+var (
+	_ api.Sidecar  = (*Sidecar)(nil)
+	_ http.Handler = (*Sidecar)(nil)
+)
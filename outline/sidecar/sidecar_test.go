@@ -0,0 +1,227 @@
+package sidecar
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/imgk/caddy-outline-manager/outline/api"
+)
+
+// ssConfigFile is a config file written by the Outline server.
+const ssConfigFile = `keys:
+  - id: "1"
+    port: 12345
+    cipher: chacha20-ietf-poly1305
+    secret: Secret1
+  - id: "2"
+    port: 12345
+    cipher: chacha20-ietf-poly1305
+    secret: Secret2
+  - id: "3"
+    port: 12345
+    cipher: chacha20-ietf-poly1305
+    secret: Secret3
+`
+
+// newTestSidecar returns a sidecar of a temporary copy of ssConfigFile.
+func newTestSidecar(t *testing.T) *Sidecar {
+	t.Helper()
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.yml")
+	if err := os.WriteFile(config, []byte(ssConfigFile), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(config, filepath.Join(dir, "go-manager.json"), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Prefix = "/secret"
+	return s
+}
+
+// call sends a request to the API of s and returns the response.
+func call(s *Sidecar, method, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(method, "/secret"+Path+query, nil))
+	return w
+}
+
+// list returns the keys listed by the API of s by id.
+func list(t *testing.T, s *Sidecar) map[string]*api.GoUser {
+	t.Helper()
+	w := call(s, http.MethodGet, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET: %v %v", w.Code, w.Body)
+	}
+	status := struct {
+		Status []*api.GoUser `json:"status"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	users := map[string]*api.GoUser{}
+	for _, user := range status.Status {
+		users[user.ID] = user
+	}
+	return users
+}
+
+// keys returns the ids of the keys in the config file of s.
+func keys(t *testing.T, s *Sidecar) []string {
+	t.Helper()
+	config, err := readConfig(s.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, key := range config.Keys {
+		ids = append(ids, key.ID)
+	}
+	return ids
+}
+
+func TestServeHTTP(t *testing.T) {
+	s := newTestSidecar(t)
+
+	for _, c := range []struct {
+		method string
+		query  string
+		code   int
+	}{
+		{http.MethodPatch, "?id=2", http.StatusOK},
+		{http.MethodPatch, "?id=9", http.StatusNotFound},
+		{http.MethodPut, "?id=1&deadline=3", http.StatusOK},
+		{http.MethodPut, "?id=1&deadline=x", http.StatusBadRequest},
+		{http.MethodPut, "?id=1&deadline=-1", http.StatusBadRequest},
+		{http.MethodPut, "?id=9&deadline=3", http.StatusNotFound},
+		{http.MethodPost, "?id=3&limit=5", http.StatusOK},
+		{http.MethodPost, "?id=3&limit=x", http.StatusBadRequest},
+		{http.MethodPost, "?id=3&limit=-1", http.StatusBadRequest},
+		{http.MethodPost, "?id=9&limit=5", http.StatusNotFound},
+		{http.MethodDelete, "?id=1", http.StatusMethodNotAllowed},
+	} {
+		if w := call(s, c.method, c.query); w.Code != c.code {
+			t.Errorf("%v %v: got %v, want %v: %v", c.method, c.query, w.Code, c.code, w.Body)
+		}
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/other"+Path, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET without the prefix: got %v, want 404", w.Code)
+	}
+
+	users := list(t, s)
+	if len(users) != 3 {
+		t.Fatalf("users %v, want 3", users)
+	}
+	if u := users["1"]; !u.Enabled || u.DaysLeft != 3 {
+		t.Errorf("user 1 %+v, want enabled with 3 days left", u)
+	}
+	if u := users["2"]; u.Enabled {
+		t.Errorf("user 2 %+v, want disabled", u)
+	}
+	if u := users["3"]; !u.Enabled || u.Limit != 5 {
+		t.Errorf("user 3 %+v, want enabled with a limit of 5", u)
+	}
+	if ids := keys(t, s); len(ids) != 2 || ids[0] != "1" || ids[1] != "3" {
+		t.Errorf("config keys %v, want 1 and 3", ids)
+	}
+
+	if w := call(s, http.MethodPatch, "?id=2"); w.Code != http.StatusOK {
+		t.Fatalf("PATCH: %v", w.Code)
+	}
+	if u := list(t, s)["2"]; !u.Enabled {
+		t.Errorf("user 2 %+v, want enabled again", u)
+	}
+	if ids := keys(t, s); len(ids) != 3 {
+		t.Errorf("config keys %v, want 3", ids)
+	}
+}
+
+func TestEnforce(t *testing.T) {
+	s := newTestSidecar(t)
+	if w := call(s, http.MethodPatch, "?id=2"); w.Code != http.StatusOK {
+		t.Fatalf("PATCH: %v", w.Code)
+	}
+
+	// the file as written by the sidecar
+	if err := s.Enforce(); err != nil {
+		t.Fatal(err)
+	}
+	if u := list(t, s)["2"]; u == nil || u.Enabled {
+		t.Fatalf("user 2 %+v, want disabled", u)
+	}
+
+	// the Outline server puts the disabled key back with a new one
+	rewrite := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(s.config, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Enforce(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rewrite(ssConfigFile + "  - id: \"4\"\n    port: 12345\n    cipher: chacha20-ietf-poly1305\n    secret: Secret4\n")
+	if ids := keys(t, s); len(ids) != 3 || ids[0] != "1" || ids[1] != "3" || ids[2] != "4" {
+		t.Errorf("config keys %v, want 1, 3 and 4", ids)
+	}
+	if u := list(t, s)["2"]; u == nil || u.Enabled {
+		t.Errorf("user 2 %+v, want disabled", u)
+	}
+
+	// a sidecar started again knows the key is disabled
+	again, err := New(s.config, s.state, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	again.Prefix = s.Prefix
+	if err := again.Enforce(); err != nil {
+		t.Fatal(err)
+	}
+	if u := list(t, again)["2"]; u == nil || u.Enabled {
+		t.Errorf("user 2 %+v after restart, want disabled", u)
+	}
+
+	// the Outline server deletes the disabled key
+	rewrite(`keys:
+  - id: "1"
+    port: 12345
+    cipher: chacha20-ietf-poly1305
+    secret: Secret1
+`)
+	users := list(t, s)
+	if _, ok := users["2"]; ok {
+		t.Errorf("deleted user 2 still listed: %v", users)
+	}
+	if len(users) != 1 {
+		t.Errorf("users %v, want 1", users)
+	}
+
+	// past its deadline, a key is disabled until a new deadline
+	if w := call(s, http.MethodPut, "?id=1&deadline=1"); w.Code != http.StatusOK {
+		t.Fatalf("PUT: %v", w.Code)
+	}
+	s.mu.Lock()
+	s.users["1"].Deadline = time.Now().Add(-time.Minute)
+	s.mu.Unlock()
+	if err := s.Enforce(); err != nil {
+		t.Fatal(err)
+	}
+	if u := list(t, s)["1"]; u == nil || u.Enabled {
+		t.Errorf("user 1 %+v, want disabled by its deadline", u)
+	}
+	if w := call(s, http.MethodPut, "?id=1&deadline=2"); w.Code != http.StatusOK {
+		t.Fatalf("PUT: %v", w.Code)
+	}
+	if u := list(t, s)["1"]; u == nil || !u.Enabled || u.DaysLeft != 2 {
+		t.Errorf("user 1 %+v, want enabled with 2 days left", u)
+	}
+}
@@ -0,0 +1,150 @@
+package outline
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/imgk/caddy-outline-manager/outline/api"
+)
+
+// DefaultRefreshInterval is how often servers are polled by default.
+const DefaultRefreshInterval = 30 * time.Second
+
+// Snapshot is the state of a server as of one refresh. It is shared by
+// all readers and never modified once built.
+type Snapshot struct {
+	Info ServerInfo
+	// Users are sorted by id.
+	Users     []*OutlineUser
+	Total     ByteNum
+	Refreshed time.Time
+}
+
+// ServerInfo is the info reported by the management API.
+type ServerInfo struct {
+	Name                  string
+	ServerID              string
+	MetricsEnabled        bool
+	CreatedTimestampMs    uint64
+	PortForNewAccessKeys  int
+	Version               string
+	HostnameForAccessKeys string
+	// DefaultLimit is the server-wide data limit in GB, empty for none.
+	DefaultLimit     string
+	DefaultDataLimit *api.DataLimit
+}
+
+func newServerInfo(info *api.ServerInfo) ServerInfo {
+	s := ServerInfo{
+		Name:                  info.Name,
+		ServerID:              info.ServerID,
+		MetricsEnabled:        info.MetricsEnabled,
+		CreatedTimestampMs:    info.CreatedTimestampMs,
+		PortForNewAccessKeys:  info.PortForNewAccessKeys,
+		Version:               info.Version,
+		HostnameForAccessKeys: info.HostnameForAccessKeys,
+		DefaultDataLimit:      info.AccessKeyDataLimit,
+	}
+	if info.AccessKeyDataLimit != nil {
+		s.DefaultLimit = strconv.FormatUint(info.AccessKeyDataLimit.Bytes>>30, 10)
+	}
+	return s
+}
+
+// User returns the user with id, or nil.
+func (s *Snapshot) User(id string) *OutlineUser {
+	for _, user := range s.Users {
+		if user.ID == id {
+			return user
+		}
+	}
+	return nil
+}
+
+// Snapshot returns the state of the last successful refresh,
+// an empty one before the first.
+func (s *OutlineServer) Snapshot() *Snapshot {
+	if snap := s.snapshot.Load(); snap != nil {
+		return snap
+	}
+	return &Snapshot{}
+}
+
+// Refresh fetches the server info and users and replaces the snapshot
+// once both are complete. Concurrent calls are serialized.
+func (s *OutlineServer) Refresh(ctx context.Context) error {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	info, err := s.GetServerInfo(ctx)
+	if err != nil {
+		s.failing.Store(true)
+		return fmt.Errorf("get server info: %w", err)
+	}
+	users, err := s.GetAllUser(ctx)
+	if err != nil {
+		s.failing.Store(true)
+		return fmt.Errorf("get users: %w", err)
+	}
+	s.failing.Store(false)
+
+	snap := &Snapshot{Info: info, Users: users, Refreshed: time.Now()}
+	if err := s.sampleUsage(users, snap.Refreshed); err != nil {
+		s.logger.Error(fmt.Sprintf("record usage of server %v error: %v", s.ID, err))
+	}
+	for _, user := range users {
+		snap.Total += user.TransferredBytes
+	}
+	s.snapshot.Store(snap)
+	return nil
+}
+
+// refreshAfter refreshes the snapshot after a change,
+// so that the next read shows it.
+func (s *OutlineServer) refreshAfter(ctx context.Context) {
+	if err := s.Refresh(ctx); err != nil {
+		s.logger.Error(fmt.Sprintf("refresh server %v error: %v", s.ID, err))
+	}
+}
+
+// poll refreshes server, expires its keys, renews their quotas and sends
+// their threshold events every interval until ctx is done.
+func (s *Server) poll(ctx context.Context, server *OutlineServer) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		tctx, cancel := context.WithTimeout(ctx, api.DefaultTimeout*3)
+		err := server.Refresh(tctx)
+		if err == nil {
+			if err := server.ExpireKeys(tctx); err != nil && ctx.Err() == nil {
+				s.logger.Error(fmt.Sprintf("expire keys of server %v error: %v", server.ID, err))
+			}
+			if err := server.RenewQuotas(tctx); err != nil && ctx.Err() == nil {
+				s.logger.Error(fmt.Sprintf("renew quotas of server %v error: %v", server.ID, err))
+			}
+			if err := server.NotifyThresholds(tctx); err != nil && ctx.Err() == nil {
+				s.logger.Error(fmt.Sprintf("notify thresholds of server %v error: %v", server.ID, err))
+			}
+		}
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			s.logger.Error(fmt.Sprintf("refresh server %v error: %v", server.ID, err))
+		}
+	}
+}
+
+func (s *Server) interval() time.Duration {
+	if s.Interval > 0 {
+		return s.Interval
+	}
+	return DefaultRefreshInterval
+}
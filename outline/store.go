@@ -0,0 +1,198 @@
+package outline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// keysBucket holds a bucket per server, of KeyRecord by key id.
+var keysBucket = []byte("keys")
+
+// Store keeps what the manager knows about access keys beyond what the
+// Outline API tracks, in a bbolt file. Records are keyed by server id
+// and key id.
+type Store struct {
+	db *bolt.DB
+}
+
+// KeyRecord is what the manager keeps about an access key.
+type KeyRecord struct {
+	// Expiry is when the key expires, zero for never.
+	Expiry time.Time `json:"expiry,omitzero"`
+	// Expired is set once the key was disabled at Expiry.
+	Expired bool `json:"expired,omitempty"`
+	// SavedLimit is the data limit in bytes the key had before it
+	// expired, nil for none. It is restored when the key is renewed.
+	SavedLimit *uint64 `json:"saved_limit,omitempty"`
+	// Metadata is what the admins track about the key.
+	Metadata Metadata `json:"metadata,omitzero"`
+	// Quota is the billing cycle of the key, nil for none.
+	Quota *Quota `json:"quota,omitempty"`
+	// Notified is what was sent to webhooks about the key.
+	Notified Notified `json:"notified,omitzero"`
+}
+
+// Metadata is what the admins track about an access key,
+// which the Outline API has no place for.
+type Metadata struct {
+	// Contact is how to reach the customer of the key.
+	Contact string `json:"contact,omitempty"`
+	Plan    string `json:"plan,omitempty"`
+	Notes   string `json:"notes,omitempty"`
+	// Created is when the key was created, zero if it was not created
+	// by the manager and was not set since.
+	Created time.Time `json:"created,omitzero"`
+	// CreatedBy is the admin who created the key.
+	CreatedBy string `json:"created_by,omitempty"`
+	// Fields are custom fields named by the admins, like an invoice
+	// number or a region.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// OpenStore opens the store at path, creating it if needed.
+func OpenStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{keysBucket, usageBucket, webhookBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the file of the store.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// storeError is a failure of the store, which is answered unlike the
+// failures of the Outline server.
+type storeError struct {
+	err error
+}
+
+func (e *storeError) Error() string { return e.err.Error() }
+func (e *storeError) Unwrap() error { return e.err }
+
+// isStoreError reports whether err is a failure of the store.
+func isStoreError(err error) bool {
+	var e *storeError
+	return errors.As(err, &e)
+}
+
+// view runs f in a read transaction, marking its error as a storeError.
+func (s *Store) view(f func(*bolt.Tx) error) error {
+	if err := s.db.View(f); err != nil {
+		return &storeError{err}
+	}
+	return nil
+}
+
+// update runs f in a write transaction, marking its error as a
+// storeError.
+func (s *Store) update(f func(*bolt.Tx) error) error {
+	if err := s.db.Update(f); err != nil {
+		return &storeError{err}
+	}
+	return nil
+}
+
+// Key returns the record of a key, the zero record if there is none.
+func (s *Store) Key(server, id string) (KeyRecord, error) {
+	rec := KeyRecord{}
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keysBucket).Bucket([]byte(server))
+		if b == nil {
+			return nil
+		}
+		return decodeRecord(b.Get([]byte(id)), &rec)
+	})
+	return rec, err
+}
+
+// Keys returns the records of the keys of a server by key id.
+func (s *Store) Keys(server string) (map[string]KeyRecord, error) {
+	records := map[string]KeyRecord{}
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(keysBucket).Bucket([]byte(server))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			rec := KeyRecord{}
+			if err := decodeRecord(v, &rec); err != nil {
+				return err
+			}
+			records[string(k)] = rec
+			return nil
+		})
+	})
+	return records, err
+}
+
+// UpdateKey changes the record of a key with f in one transaction.
+// Nothing is written when f fails, whose error is returned as is.
+func (s *Store) UpdateKey(server, id string, f func(*KeyRecord) error) error {
+	var ferr error
+	err := s.update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(keysBucket).CreateBucketIfNotExists([]byte(server))
+		if err != nil {
+			return err
+		}
+		rec := KeyRecord{}
+		if err := decodeRecord(b.Get([]byte(id)), &rec); err != nil {
+			return err
+		}
+		if ferr = f(&rec); ferr != nil {
+			return ferr
+		}
+		v, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), v)
+	})
+	if ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// DeleteKey forgets a key and its usage.
+func (s *Store) DeleteKey(server, id string) error {
+	return s.update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(keysBucket).Bucket([]byte(server)); b != nil {
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		if b := tx.Bucket(usageBucket).Bucket([]byte(server)); b != nil && b.Bucket([]byte(id)) != nil {
+			return b.DeleteBucket([]byte(id))
+		}
+		return nil
+	})
+}
+
+func decodeRecord(v []byte, rec *KeyRecord) error {
+	if v == nil {
+		return nil
+	}
+	if err := json.Unmarshal(v, rec); err != nil {
+		return fmt.Errorf("corrupt key record: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package outline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/imgk/caddy-outline-manager/outline/api"
+)
+
+// The manager samples the transferred bytes of every key at each refresh
+// and keeps the growth since the last sample, by hour for hourRetention
+// and by day for good. The Outline server reports the bytes of the last
+// 30 days, which shrink as old traffic leaves the window: shrinking is
+// taken as no traffic, so usage is a lower bound.
+//
+// In the store, usage/{server}/{key} holds the last counter and the
+// buckets hour, by unix time of the hour, and day, by date in the time
+// zone of the Server.
+
+var (
+	usageBucket = []byte("usage")
+	hourBucket  = []byte("hour")
+	dayBucket   = []byte("day")
+	counterKey  = []byte("counter")
+)
+
+const dateLayout = "2006-01-02"
+
+// hourRetention is how long hourly usage is kept.
+const hourRetention = 31 * 24 * time.Hour
+
+// maxPoints limits the length of usage series.
+const maxPoints = 1000
+
+// sparkDays is the number of days in the sparklines of the panel.
+const sparkDays = 14
+
+// Period is the length of the points of a usage series.
+type Period string
+
+const (
+	PeriodHour  Period = "hour"
+	PeriodDay   Period = "day"
+	PeriodMonth Period = "month"
+)
+
+// ParsePeriod returns the period named name.
+func ParsePeriod(name string) (Period, error) {
+	switch p := Period(name); p {
+	case PeriodHour, PeriodDay, PeriodMonth:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown period: %q", name)
+}
+
+// start returns the start of the period holding t.
+func (p Period) start(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch p {
+	case PeriodHour:
+		return t.Truncate(time.Hour)
+	case PeriodDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+	}
+}
+
+// next returns the start of the period after the one starting at t.
+func (p Period) next(t time.Time) time.Time {
+	switch p {
+	case PeriodHour:
+		return t.Add(time.Hour)
+	case PeriodDay:
+		return t.AddDate(0, 0, 1)
+	default:
+		return t.AddDate(0, 1, 0)
+	}
+}
+
+// defaultFrom returns the start of the range ending at to
+// when none is given.
+func (p Period) defaultFrom(to time.Time) time.Time {
+	switch p {
+	case PeriodHour:
+		return to.Add(-23 * time.Hour)
+	case PeriodDay:
+		return to.AddDate(0, 0, -29)
+	default:
+		return to.AddDate(0, -11, 0)
+	}
+}
+
+// UsagePoint is the data transferred in the period starting at Start.
+type UsagePoint struct {
+	Start time.Time `json:"start"`
+	Bytes uint64    `json:"bytes"`
+}
+
+// RecordUsage records the transferred bytes of the keys of a server
+// by key id as of now.
+func (s *Store) RecordUsage(server string, counters map[string]uint64, now time.Time, loc *time.Location) error {
+	hour := unixKey(now.Truncate(time.Hour))
+	day := []byte(now.In(loc).Format(dateLayout))
+	oldest := unixKey(now.Add(-hourRetention).Truncate(time.Hour))
+	return s.update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(usageBucket).CreateBucketIfNotExists([]byte(server))
+		if err != nil {
+			return err
+		}
+		for id, counter := range counters {
+			kb, err := b.CreateBucketIfNotExists([]byte(id))
+			if err != nil {
+				return err
+			}
+			last := kb.Get(counterKey)
+			if err := kb.Put(counterKey, uint64Value(counter)); err != nil {
+				return err
+			}
+			if last == nil || counter <= binary.BigEndian.Uint64(last) {
+				continue
+			}
+			delta := counter - binary.BigEndian.Uint64(last)
+			hb, err := kb.CreateBucketIfNotExists(hourBucket)
+			if err != nil {
+				return err
+			}
+			if err := addUint64(hb, hour, delta); err != nil {
+				return err
+			}
+			c := hb.Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, oldest) < 0; k, _ = c.First() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+			db, err := kb.CreateBucketIfNotExists(dayBucket)
+			if err != nil {
+				return err
+			}
+			if err := addUint64(db, day, delta); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Usage returns the usage of every key of a server with a history
+// by key id, in points of period from the one holding from to the
+// one holding to. Periods without traffic are zero.
+func (s *Store) Usage(server string, period Period, from, to time.Time, loc *time.Location) (map[string][]UsagePoint, error) {
+	usage := map[string][]UsagePoint{}
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usageBucket).Bucket([]byte(server))
+		if b == nil {
+			return nil
+		}
+		return b.ForEachBucket(func(id []byte) error {
+			points, err := keyUsage(b.Bucket(id), period, from, to, loc)
+			usage[string(id)] = points
+			return err
+		})
+	})
+	return usage, err
+}
+
+// KeyUsage is Usage for the key id.
+func (s *Store) KeyUsage(server, id string, period Period, from, to time.Time, loc *time.Location) ([]UsagePoint, error) {
+	var points []UsagePoint
+	err := s.view(func(tx *bolt.Tx) (err error) {
+		var kb *bolt.Bucket
+		if b := tx.Bucket(usageBucket).Bucket([]byte(server)); b != nil {
+			kb = b.Bucket([]byte(id))
+		}
+		points, err = keyUsage(kb, period, from, to, loc)
+		return err
+	})
+	return points, err
+}
+
+// keyUsage reads the usage of the key bucket kb, which may be nil.
+func keyUsage(kb *bolt.Bucket, period Period, from, to time.Time, loc *time.Location) ([]UsagePoint, error) {
+	points := []UsagePoint{}
+	index := map[int64]int{}
+	for t := period.start(from, loc); !t.After(to); t = period.next(t) {
+		if len(points) == maxPoints {
+			return nil, fmt.Errorf("%w: more than %v points, narrow the range", api.ErrInvalidArgument, maxPoints)
+		}
+		index[t.Unix()] = len(points)
+		points = append(points, UsagePoint{Start: t})
+	}
+	if kb == nil || len(points) == 0 {
+		return points, nil
+	}
+	add := func(t time.Time, v []byte) {
+		if i, ok := index[period.start(t, loc).Unix()]; ok {
+			points[i].Bytes += binary.BigEndian.Uint64(v)
+		}
+	}
+
+	if period == PeriodHour {
+		hb := kb.Bucket(hourBucket)
+		if hb == nil {
+			return points, nil
+		}
+		c := hb.Cursor()
+		last := unixKey(to)
+		for k, v := c.Seek(unixKey(points[0].Start)); k != nil && bytes.Compare(k, last) <= 0; k, v = c.Next() {
+			add(time.Unix(int64(binary.BigEndian.Uint64(k)), 0), v)
+		}
+		return points, nil
+	}
+
+	db := kb.Bucket(dayBucket)
+	if db == nil {
+		return points, nil
+	}
+	c := db.Cursor()
+	last := []byte(to.In(loc).Format(dateLayout))
+	for k, v := c.Seek([]byte(points[0].Start.Format(dateLayout))); k != nil && bytes.Compare(k, last) <= 0; k, v = c.Next() {
+		day, err := time.ParseInLocation(dateLayout, string(k), loc)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt usage record: %w", err)
+		}
+		add(day, v)
+	}
+	return points, nil
+}
+
+func unixKey(t time.Time) []byte {
+	return uint64Value(uint64(t.Unix()))
+}
+
+func uint64Value(n uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, n)
+}
+
+// addUint64 adds n to the value of k in b.
+func addUint64(b *bolt.Bucket, k []byte, n uint64) error {
+	if v := b.Get(k); v != nil {
+		n += binary.BigEndian.Uint64(v)
+	}
+	return b.Put(k, uint64Value(n))
+}
+
+// sampleUsage records the usage of users as of now and gives them their
+// daily usage of the last sparkDays days, and their usage in the cycle
+// of their quota.
+func (s *OutlineServer) sampleUsage(users []*OutlineUser, now time.Time) error {
+	if s.store == nil || s.ID == "" {
+		return nil
+	}
+	loc := s.location()
+	counters := make(map[string]uint64, len(users))
+	for _, user := range users {
+		counters[user.ID] = uint64(user.TransferredBytes)
+	}
+	if err := s.store.RecordUsage(s.ID, counters, now, loc); err != nil {
+		return err
+	}
+	usage, err := s.store.Usage(s.ID, PeriodDay, now.AddDate(0, 0, 1-sparkDays), now, loc)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		user.Spark, user.Recent = sparkline(usage[user.ID])
+		if user.Quota != nil {
+			used, err := s.cycleUsed(user.ID, user.Quota, now)
+			if err != nil {
+				return err
+			}
+			user.CycleUsed = ByteNum(used)
+		}
+	}
+	return nil
+}
+
+// sparkline returns the points of an svg polyline 70x16 drawing points
+// and their sum.
+func sparkline(points []UsagePoint) (string, ByteNum) {
+	if len(points) < 2 {
+		return "", 0
+	}
+	peak, sum := uint64(0), uint64(0)
+	for _, p := range points {
+		peak = max(peak, p.Bytes)
+		sum += p.Bytes
+	}
+	coords := make([]string, 0, len(points))
+	for i, p := range points {
+		x := i * 69 / (len(points) - 1)
+		y := 15
+		if peak > 0 {
+			y = 15 - int(p.Bytes*14/peak)
+		}
+		coords = append(coords, strconv.Itoa(x)+","+strconv.Itoa(y))
+	}
+	return strings.Join(coords, " "), ByteNum(sum)
+}
@@ -0,0 +1,593 @@
+package outline
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Webhooks receive the events of the keys of all servers as JSON POST
+// requests. Events are queued in the store, one delivery per webhook,
+// and retried with backoff until the webhook answers 2xx or
+// webhookMaxAttempts fail, so a delivery may be sent more than once:
+// the X-Outline-Delivery header tells them apart. Every webhook is sent
+// its deliveries in order by its own goroutine, a failed delivery holds
+// back the later ones of its webhook until it is retried.
+//
+// Data limit and expiry events are sent once per limit and expiry,
+// which KeyRecord.Notified keeps. Webhooks need the store.
+
+// EventType names an event sent to webhooks.
+type EventType string
+
+const (
+	EventKeyCreated  EventType = "key.created"
+	EventKeyDeleted  EventType = "key.deleted"
+	EventKeyRenamed  EventType = "key.renamed"
+	EventKeyEnabled  EventType = "key.enabled"
+	EventKeyDisabled EventType = "key.disabled"
+	// EventDataLimit80 and EventDataLimit100 are sent when a key has
+	// transferred 80% and all of its data limit.
+	EventDataLimit80  EventType = "key.data_limit_80"
+	EventDataLimit100 EventType = "key.data_limit_100"
+	// EventKeyExpiring is sent when a key expires within
+	// Server.ExpiringDays.
+	EventKeyExpiring EventType = "key.expiring"
+	// EventPing is sent by the pingWebhook route, whatever the events
+	// of the webhook.
+	EventPing EventType = "ping"
+)
+
+// eventTypes are the types webhooks may filter on.
+var eventTypes = []EventType{
+	EventKeyCreated, EventKeyDeleted, EventKeyRenamed, EventKeyEnabled, EventKeyDisabled,
+	EventDataLimit80, EventDataLimit100, EventKeyExpiring,
+}
+
+// DefaultExpiringDays is how many days before its expiry a key is
+// reported as expiring by default.
+const DefaultExpiringDays = 7
+
+const (
+	// webhookTimeout limits every request to a webhook.
+	webhookTimeout = 10 * time.Second
+	// webhookRetryDelay is the delay after the first failed attempt,
+	// doubled after every other up to webhookMaxDelay.
+	webhookRetryDelay = 10 * time.Second
+	webhookMaxDelay   = time.Hour
+	// webhookMaxAttempts failed attempts drop a delivery.
+	webhookMaxAttempts = 10
+	// webhookInterval is how often due deliveries are looked for
+	// when no event wakes the dispatcher.
+	webhookInterval = 5 * time.Second
+)
+
+// Webhook is a receiver of events.
+//
+//	{"id": "billing", "url": "https://example.com/hook", "secret": "...", "events": ["key.created", "key.deleted"]}
+type Webhook struct {
+	// ID names the webhook in the API, the queue and logs.
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Secret signs every request with HMAC-SHA256 of the unix time in
+	// the X-Outline-Timestamp header, a '.' and the body, in the
+	// X-Outline-Signature header like sha256=<hex>. Receivers should
+	// reject old timestamps against replays. Empty for none.
+	Secret string `json:"secret,omitempty"`
+	// Events are the types of events sent, all if empty.
+	Events []EventType `json:"events,omitempty"`
+	// Servers are the ids of the servers whose events are sent,
+	// all if empty.
+	Servers []string `json:"servers,omitempty"`
+}
+
+// Validate checks the ID, URL and events.
+func (w *Webhook) Validate() error {
+	if err := validID(w.ID); err != nil || w.ID == "" {
+		return fmt.Errorf("invalid webhook id %q: only letters, digits, '-', '_' and '.' are allowed", w.ID)
+	}
+	uri, err := url.Parse(w.URL)
+	if err != nil || (uri.Scheme != "https" && uri.Scheme != "http") || uri.Host == "" {
+		return fmt.Errorf("invalid webhook %v url %q: not an http url", w.ID, w.URL)
+	}
+	for _, event := range w.Events {
+		if !slices.Contains(eventTypes, event) {
+			return fmt.Errorf("invalid webhook %v event %q", w.ID, event)
+		}
+	}
+	return nil
+}
+
+// wants reports whether event is sent to w.
+func (w *Webhook) wants(event *Event) bool {
+	if event.Type == EventPing {
+		return true
+	}
+	if len(w.Events) > 0 && !slices.Contains(w.Events, event.Type) {
+		return false
+	}
+	return len(w.Servers) == 0 || slices.Contains(w.Servers, event.Server)
+}
+
+// sign returns the signature of body sent at timestamp, empty without
+// a secret.
+func (w *Webhook) sign(timestamp string, body []byte) string {
+	if w.Secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(w.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Event is the body of the requests sent to webhooks.
+type Event struct {
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Server  string    `json:"server,omitempty"`
+	KeyID   string    `json:"key_id,omitempty"`
+	KeyName string    `json:"key_name,omitempty"`
+	// Admin made the change, empty for events of the manager itself.
+	Admin string `json:"admin,omitempty"`
+	// OldName is the name of a renamed key before.
+	OldName string `json:"old_name,omitempty"`
+	// TransferredBytes and DataLimitBytes are set by data limit events.
+	TransferredBytes uint64 `json:"transferred_bytes,omitempty"`
+	DataLimitBytes   uint64 `json:"data_limit_bytes,omitempty"`
+	// ExpiresAt and DaysLeft are set by expiring events.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	DaysLeft  int        `json:"days_left,omitempty"`
+}
+
+// Notified is what was sent to webhooks about a key.
+type Notified struct {
+	// Usage is the percentage of Limit last reported, 0, 80 or 100.
+	// A new data limit starts over.
+	Usage int    `json:"usage,omitempty"`
+	Limit uint64 `json:"limit,omitempty"`
+	// Expiry is the expiry last reported.
+	Expiry time.Time `json:"expiry,omitzero"`
+}
+
+// webhookBucket holds the deliveries of events by sequence number.
+var webhookBucket = []byte("webhooks")
+
+// delivery is an event queued for a webhook.
+type delivery struct {
+	ID       uint64          `json:"-"`
+	Hook     string          `json:"hook"`
+	Type     EventType       `json:"type"`
+	Body     json.RawMessage `json:"body"`
+	Attempts int             `json:"attempts,omitempty"`
+	// Next is when the delivery is due.
+	Next time.Time `json:"next"`
+}
+
+// enqueue adds deliveries to the queue, setting their ids.
+func (s *Store) enqueue(deliveries []delivery) error {
+	return s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(webhookBucket)
+		for i := range deliveries {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			deliveries[i].ID = id
+			if err := putDelivery(b, &deliveries[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// dueDeliveries returns the deliveries due at now, oldest first. The
+// deliveries of a webhook queued after one which is not due are held
+// back, so that a failed delivery is retried before the later ones.
+func (s *Store) dueDeliveries(now time.Time) ([]delivery, error) {
+	due := []delivery{}
+	held := map[string]bool{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhookBucket).ForEach(func(k, v []byte) error {
+			d := delivery{ID: binary.BigEndian.Uint64(k)}
+			if err := json.Unmarshal(v, &d); err != nil {
+				return fmt.Errorf("corrupt webhook delivery: %w", err)
+			}
+			if d.Next.After(now) {
+				held[d.Hook] = true
+			} else if !held[d.Hook] {
+				due = append(due, d)
+			}
+			return nil
+		})
+	})
+	return due, err
+}
+
+// pendingDeliveries counts the queued deliveries by webhook id.
+func (s *Store) pendingDeliveries() (map[string]int, error) {
+	pending := map[string]int{}
+	err := s.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhookBucket).ForEach(func(k, v []byte) error {
+			d := delivery{}
+			if err := json.Unmarshal(v, &d); err != nil {
+				return fmt.Errorf("corrupt webhook delivery: %w", err)
+			}
+			pending[d.Hook]++
+			return nil
+		})
+	})
+	return pending, err
+}
+
+// updateDelivery writes d back to the queue.
+func (s *Store) updateDelivery(d *delivery) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return putDelivery(tx.Bucket(webhookBucket), d)
+	})
+}
+
+// removeDelivery drops the delivery id from the queue.
+func (s *Store) removeDelivery(id uint64) error {
+	return s.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhookBucket).Delete(uint64Value(id))
+	})
+}
+
+func putDelivery(b *bolt.Bucket, d *delivery) error {
+	v, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return b.Put(uint64Value(d.ID), v)
+}
+
+// webhook returns the webhook with id, or nil.
+func (s *Server) webhook(id string) *Webhook {
+	for i := range s.Webhooks {
+		if s.Webhooks[i].ID == id {
+			return &s.Webhooks[i]
+		}
+	}
+	return nil
+}
+
+// Notify queues event for the webhooks wanting it. Errors are logged.
+func (s *Server) Notify(event Event) {
+	if s.Store == nil || len(s.Webhooks) == 0 {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("encode %v event error: %v", event.Type, err))
+		return
+	}
+	deliveries := []delivery{}
+	for _, hook := range s.Webhooks {
+		if hook.wants(&event) {
+			deliveries = append(deliveries, delivery{Hook: hook.ID, Type: event.Type, Body: body, Next: event.Time})
+		}
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+	if err := s.Store.enqueue(deliveries); err != nil {
+		s.logger.Error(fmt.Sprintf("queue %v event error: %v", event.Type, err))
+		return
+	}
+	s.wakeDispatcher()
+}
+
+// wakeDispatcher has dispatch look for due deliveries now.
+func (s *Server) wakeDispatcher() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch sends the queued deliveries as they are due until ctx is done.
+// Deliveries of removed webhooks are dropped first.
+func (s *Server) dispatch(ctx context.Context) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(webhookInterval)
+	defer ticker.Stop()
+	// busy has the webhooks being sent to
+	busy := map[string]bool{}
+	done := make(chan string)
+	for {
+		now := time.Now()
+		due, err := s.Store.dueDeliveries(now)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("read webhook queue error: %v", err))
+		}
+		rounds := map[string][]delivery{}
+		for _, d := range due {
+			if busy[d.Hook] {
+				continue
+			}
+			if s.webhook(d.Hook) == nil {
+				s.logger.Warn(fmt.Sprintf("drop %v event %v of removed webhook %v", d.Type, d.ID, d.Hook))
+				if err := s.Store.removeDelivery(d.ID); err != nil {
+					s.logger.Error(fmt.Sprintf("update webhook queue error: %v", err))
+				}
+				continue
+			}
+			rounds[d.Hook] = append(rounds[d.Hook], d)
+		}
+		for id, due := range rounds {
+			busy[id] = true
+			go func() {
+				s.deliver(ctx, s.webhook(id), due, now)
+				done <- id
+			}()
+		}
+
+		select {
+		case <-ctx.Done():
+			for len(busy) > 0 {
+				delete(busy, <-done)
+			}
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		case id := <-done:
+			delete(busy, id)
+		}
+	}
+}
+
+// deliver sends the deliveries due at now to hook in order, up to the
+// first that fails, which holds back the others until it is retried.
+func (s *Server) deliver(ctx context.Context, hook *Webhook, due []delivery, now time.Time) {
+	for i := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		d := &due[i]
+		err := s.post(ctx, hook, d)
+		switch {
+		case err == nil:
+			err = s.Store.removeDelivery(d.ID)
+		case ctx.Err() != nil:
+			// stopped, not the fault of the webhook
+			return
+		default:
+			if d.Attempts++; d.Attempts >= webhookMaxAttempts {
+				s.logger.Error(fmt.Sprintf("drop %v event %v of webhook %v after %v attempts: %v", d.Type, d.ID, d.Hook, d.Attempts, err))
+				err = s.Store.removeDelivery(d.ID)
+				break
+			}
+			delay := min(webhookRetryDelay<<(d.Attempts-1), webhookMaxDelay)
+			s.logger.Warn(fmt.Sprintf("send %v event %v to webhook %v error: %v, retry in %v", d.Type, d.ID, d.Hook, err, delay))
+			d.Next = now.Add(delay)
+			if err := s.Store.updateDelivery(d); err != nil {
+				s.logger.Error(fmt.Sprintf("update webhook queue error: %v", err))
+			}
+			return
+		}
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("update webhook queue error: %v", err))
+		}
+	}
+}
+
+// webhookClient sends the requests to webhooks. Redirects are not
+// followed, the signed events are only sent to the configured url.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// errWebhookStatus is returned for webhooks answering other than 2xx.
+var errWebhookStatus = errors.New("unexpected status")
+
+// post sends d to hook.
+func (s *Server) post(ctx context.Context, hook *Webhook, d *delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "outline-manager")
+	req.Header.Set("X-Outline-Event", string(d.Type))
+	req.Header.Set("X-Outline-Delivery", strconv.FormatUint(d.ID, 10))
+	req.Header.Set("X-Outline-Timestamp", timestamp)
+	if sig := hook.sign(timestamp, d.Body); sig != "" {
+		req.Header.Set("X-Outline-Signature", sig)
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%w: %v", errWebhookStatus, resp.Status)
+	}
+	return nil
+}
+
+// notify queues an event of the key id of s, made by the admin of ctx.
+func (s *OutlineServer) notify(ctx context.Context, event Event) {
+	if s.group == nil {
+		return
+	}
+	event.Server = s.ID
+	event.Admin = AdminFromContext(ctx)
+	s.group.Notify(event)
+}
+
+// expiringDays returns the days before its expiry a key is expiring.
+func (s *OutlineServer) expiringDays() int {
+	if s.group != nil && s.group.ExpiringDays > 0 {
+		return s.group.ExpiringDays
+	}
+	return DefaultExpiringDays
+}
+
+// NotifyThresholds sends the data limit and expiring events of the keys
+// which reached them since the last call.
+func (s *OutlineServer) NotifyThresholds(ctx context.Context) error {
+	if s.store == nil || s.group == nil || len(s.group.Webhooks) == 0 {
+		return nil
+	}
+	records, err := s.store.Keys(s.ID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	errs := []error{}
+	for _, user := range s.Snapshot().Users {
+		rec := records[user.ID]
+		notified := rec.Notified
+		events := []Event{}
+
+		limit, usage := uint64(0), 0
+		if user.DataLimit != nil && !rec.Expired {
+			limit = user.DataLimit.Bytes
+		}
+		used := uint64(user.TransferredBytes)
+		switch {
+		case limit == 0:
+		case used >= limit:
+			usage = 100
+		case used >= limit-limit/5:
+			usage = 80
+		}
+		if notified.Limit != limit {
+			notified.Usage = 0
+		}
+		for _, step := range []struct {
+			usage int
+			event EventType
+		}{{80, EventDataLimit80}, {100, EventDataLimit100}} {
+			if notified.Usage < step.usage && step.usage <= usage {
+				events = append(events, Event{Type: step.event, TransferredBytes: used, DataLimitBytes: limit})
+			}
+		}
+		notified.Usage, notified.Limit = usage, limit
+
+		expiry := user.ExpiresAt
+		if left := daysLeft(expiry, now); left > 0 && left <= s.expiringDays() && !notified.Expiry.Equal(expiry) {
+			events = append(events, Event{Type: EventKeyExpiring, ExpiresAt: user.expiresAt(), DaysLeft: left})
+			notified.Expiry = expiry
+		}
+
+		if notified == rec.Notified {
+			continue
+		}
+		err := s.store.UpdateKey(s.ID, user.ID, func(rec *KeyRecord) error {
+			rec.Notified = notified
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("notify user %v: %w", user.ID, err))
+			continue
+		}
+		for _, event := range events {
+			s.logger.Info(fmt.Sprintf("user %v: %v", user.ID, event.Type))
+			event.KeyID, event.KeyName = user.ID, user.Name
+			s.notify(ctx, event)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WebhookResource is a webhook in the JSON API, without its secret.
+type WebhookResource struct {
+	ID      string      `json:"id"`
+	URL     string      `json:"url"`
+	Signed  bool        `json:"signed"`
+	Events  []EventType `json:"events"`
+	Servers []string    `json:"servers"`
+	// Pending counts the deliveries waiting in the queue.
+	Pending int `json:"pending"`
+}
+
+// setWebhookRouter registers the routes of the JSON API for webhooks.
+func (s *Server) setWebhookRouter() {
+	s.Handle(Operation{
+		ID:       "listWebhooks",
+		Method:   http.MethodGet,
+		Path:     APIPath + "/webhooks",
+		Role:     RoleOwner,
+		Summary:  "List the webhooks with their queued deliveries",
+		Response: []WebhookResource{},
+	}, s.apiListWebhooks)
+	s.Handle(Operation{
+		ID:      "pingWebhook",
+		Method:  http.MethodPost,
+		Path:    APIPath + "/webhooks/{hid}/ping",
+		Role:    RoleOwner,
+		Summary: "Queue a ping event for a webhook",
+		Status:  http.StatusAccepted,
+	}, s.apiPingWebhook)
+}
+
+func (s *Server) apiListWebhooks(w http.ResponseWriter, r *http.Request) {
+	pending := map[string]int{}
+	if s.Store != nil {
+		var err error
+		if pending, err = s.Store.pendingDeliveries(); err != nil {
+			s.logger.Error(fmt.Sprintf("read webhook queue error: %v", err))
+			WriteError(w, http.StatusInternalServerError, "read webhook queue error")
+			return
+		}
+	}
+	hooks := make([]WebhookResource, 0, len(s.Webhooks))
+	for _, hook := range s.Webhooks {
+		hooks = append(hooks, WebhookResource{
+			ID:      hook.ID,
+			URL:     hook.URL,
+			Signed:  hook.Secret != "",
+			Events:  append([]EventType{}, hook.Events...),
+			Servers: append([]string{}, hook.Servers...),
+			Pending: pending[hook.ID],
+		})
+	}
+	WriteJSON(w, http.StatusOK, hooks)
+}
+
+func (s *Server) apiPingWebhook(w http.ResponseWriter, r *http.Request) {
+	if s.Store == nil {
+		writeAPIError(w, ErrNoStore)
+		return
+	}
+	hook := s.webhook(r.PathValue("hid"))
+	if hook == nil {
+		WriteError(w, http.StatusNotFound, "webhook not found")
+		return
+	}
+	body, err := json.Marshal(Event{Type: EventPing, Time: time.Now(), Admin: AdminFromContext(r.Context())})
+	if err == nil {
+		err = s.Store.enqueue([]delivery{{Hook: hook.ID, Type: EventPing, Body: body, Next: time.Now()}})
+	}
+	if err != nil {
+		s.logger.Error(fmt.Sprintf("queue ping of webhook %v error: %v", hook.ID, err))
+		WriteError(w, http.StatusInternalServerError, "queue ping error")
+		return
+	}
+	s.wakeDispatcher()
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,266 @@
+package outline
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// newWebhookServer returns a Server without servers sending events to
+// hooks, whose dispatcher is not started.
+func newWebhookServer(t *testing.T, hooks ...Webhook) *Server {
+	t.Helper()
+	s := NewServer(nil, zap.NewNop())
+	store, err := OpenStore(filepath.Join(t.TempDir(), "outline.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	s.Store, s.Webhooks = store, hooks
+	t.Cleanup(s.Close)
+	return s
+}
+
+// hookServer serves webhook requests with handler and counts them.
+func hookServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	n := &atomic.Int32{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, n
+}
+
+// queued returns the deliveries due at now.
+func queued(t *testing.T, s *Server, now time.Time) []delivery {
+	t.Helper()
+	due, err := s.Store.dueDeliveries(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return due
+}
+
+// queue returns every queued delivery, oldest first.
+func queue(t *testing.T, s *Server) []delivery {
+	t.Helper()
+	return queued(t, s, time.Now().Add(webhookMaxDelay*2))
+}
+
+func TestWebhookSignature(t *testing.T) {
+	var header http.Header
+	var body []byte
+	srv, _ := hookServer(t, func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+	})
+	s := newWebhookServer(t, Webhook{ID: "hook", URL: srv.URL, Secret: "secret"})
+
+	s.Notify(Event{Type: EventKeyCreated, Server: "a", KeyID: "1"})
+	now := time.Now()
+	s.deliver(context.Background(), &s.Webhooks[0], queued(t, s, now), now)
+
+	timestamp := header.Get("X-Outline-Timestamp")
+	if timestamp == "" {
+		t.Fatal("no timestamp")
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); header.Get("X-Outline-Signature") != want {
+		t.Errorf("signature %q, want %q", header.Get("X-Outline-Signature"), want)
+	}
+	if header.Get("X-Outline-Event") != string(EventKeyCreated) {
+		t.Errorf("event %q", header.Get("X-Outline-Event"))
+	}
+	if left := queue(t, s); len(left) != 0 {
+		t.Errorf("%v deliveries left", len(left))
+	}
+}
+
+func TestWebhookEvents(t *testing.T) {
+	s := newWebhookServer(t,
+		Webhook{ID: "all", URL: "http://192.0.2.1"},
+		Webhook{ID: "created", URL: "http://192.0.2.1", Events: []EventType{EventKeyCreated}},
+		Webhook{ID: "server-a", URL: "http://192.0.2.1", Servers: []string{"a"}},
+	)
+	s.Notify(Event{Type: EventKeyCreated, Server: "a"})
+	s.Notify(Event{Type: EventKeyDeleted, Server: "a"})
+	s.Notify(Event{Type: EventKeyCreated, Server: "b"})
+	s.Notify(Event{Type: EventPing})
+
+	pending, err := s.Store.pendingDeliveries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hook, want := range map[string]int{"all": 4, "created": 3, "server-a": 3} {
+		if pending[hook] != want {
+			t.Errorf("webhook %v: %v deliveries, want %v", hook, pending[hook], want)
+		}
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	srv, n := hookServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	s := newWebhookServer(t, Webhook{ID: "hook", URL: srv.URL})
+	hook := &s.Webhooks[0]
+	ctx := context.Background()
+
+	s.Notify(Event{Type: EventKeyCreated})
+	s.Notify(Event{Type: EventKeyDeleted})
+
+	// a failure holds back the later deliveries, with backoff
+	now := time.Now()
+	for attempt, delay := range []time.Duration{webhookRetryDelay, webhookRetryDelay * 2} {
+		n.Store(0)
+		s.deliver(ctx, hook, queued(t, s, now), now)
+		if n.Load() != 1 {
+			t.Errorf("attempt %v: %v requests, want 1", attempt+1, n.Load())
+		}
+		if due := queued(t, s, now); len(due) != 0 {
+			t.Errorf("attempt %v: %v deliveries not held back", attempt+1, len(due))
+		}
+		hold := queue(t, s)[0].Next
+		if want := now.Add(delay); !hold.Equal(want) {
+			t.Errorf("attempt %v: held until %v, want %v", attempt+1, hold, want)
+		}
+		now = hold
+	}
+	due := queued(t, s, now)
+	if len(due) != 2 || due[0].Type != EventKeyCreated || due[0].Attempts != 2 || due[1].Attempts != 0 {
+		t.Fatalf("queue %+v", due)
+	}
+
+	// the last attempt drops the delivery and goes on with the next
+	due[0].Attempts = webhookMaxAttempts - 1
+	if err := s.Store.updateDelivery(&due[0]); err != nil {
+		t.Fatal(err)
+	}
+	s.deliver(ctx, hook, queued(t, s, now), now)
+	due = queued(t, s, now.Add(webhookMaxDelay))
+	if len(due) != 1 || due[0].Type != EventKeyDeleted || due[0].Attempts != 1 {
+		t.Errorf("queue %+v, want the second delivery only", due)
+	}
+}
+
+func TestWebhookHold(t *testing.T) {
+	s := newWebhookServer(t,
+		Webhook{ID: "failed", URL: "http://192.0.2.1", Events: []EventType{EventKeyCreated, EventKeyDeleted}},
+		Webhook{ID: "other", URL: "http://192.0.2.1", Events: []EventType{EventKeyDeleted}},
+	)
+	s.Notify(Event{Type: EventKeyCreated})
+	s.Notify(Event{Type: EventKeyDeleted})
+
+	// a failed delivery left in the queue, as after a restart
+	now := time.Now()
+	failed := queue(t, s)[0]
+	failed.Attempts, failed.Next = 1, now.Add(webhookRetryDelay)
+	if err := s.Store.updateDelivery(&failed); err != nil {
+		t.Fatal(err)
+	}
+	due := queued(t, s, now)
+	if len(due) != 1 || due[0].Hook != "other" {
+		t.Fatalf("due %+v, want the delivery of the other webhook only", due)
+	}
+	if due := queued(t, s, failed.Next); len(due) != 3 || due[0].ID != failed.ID {
+		t.Errorf("due %+v, want the failed delivery first", due)
+	}
+}
+
+func TestWebhookRedirect(t *testing.T) {
+	target, hit := hookServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	srv, _ := hookServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+	})
+	s := newWebhookServer(t, Webhook{ID: "hook", URL: srv.URL, Secret: "secret"})
+
+	s.Notify(Event{Type: EventKeyCreated})
+	now := time.Now()
+	s.deliver(context.Background(), &s.Webhooks[0], queued(t, s, now), now)
+	if left := queue(t, s); len(left) != 1 || left[0].Attempts != 1 {
+		t.Error("redirect taken as delivered")
+	}
+	if hit.Load() != 0 {
+		t.Error("redirect followed")
+	}
+}
+
+func TestWebhookDeadHook(t *testing.T) {
+	release := make(chan struct{})
+	dead, _ := hookServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	received := make(chan struct{}, 1)
+	live, _ := hookServer(t, func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	})
+	s := newWebhookServer(t, Webhook{ID: "dead", URL: dead.URL}, Webhook{ID: "live", URL: live.URL})
+	t.Cleanup(func() { close(release) })
+	s.Connect(context.Background())
+
+	s.Notify(Event{Type: EventKeyCreated})
+	s.Notify(Event{Type: EventKeyDeleted})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(webhookTimeout / 2):
+			t.Fatalf("live webhook got %v events while the other hangs", i)
+		}
+	}
+}
+
+func TestWebhookExpiry(t *testing.T) {
+	s, server, _ := newTestServer(t, true)
+	s.Webhooks = []Webhook{{ID: "hook", URL: "http://192.0.2.1", Events: []EventType{EventKeyEnabled, EventKeyDisabled}}}
+	ctx := context.Background()
+
+	w := serve(s, RoleOwner, http.MethodPost, APIPath+"/servers/mock/keys", `{"name":"a"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %v: %v", w.Code, w.Body)
+	}
+	id := server.Snapshot().Users[0].ID
+	if err := s.Store.UpdateKey("mock", id, func(rec *KeyRecord) error {
+		rec.Expiry = time.Now().Add(-time.Minute)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// expired keys are disabled once, and enabled again when renewed
+	for i := 0; i < 2; i++ {
+		if err := server.ExpireKeys(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := server.SetExpiry(ctx, id, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	events := queue(t, s)
+	if len(events) != 2 || events[0].Type != EventKeyDisabled || events[1].Type != EventKeyEnabled {
+		t.Fatalf("events %+v", events)
+	}
+	event := Event{}
+	if err := json.Unmarshal(events[0].Body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Server != "mock" || event.KeyID != id || event.KeyName != "a" {
+		t.Errorf("event %+v", event)
+	}
+}
@@ -0,0 +1,107 @@
+package outline
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionCookie is the name of the cookie carrying the signed session.
+const sessionCookie = "outline_session"
+
+// defaultSessionTTL is used when the handler does not configure session_ttl.
+const defaultSessionTTL = 7 * 24 * time.Hour
+
+// sessions issues and verifies HMAC signed session cookies.
+// A cookie value is made of three dot separated parts:
+// base64(username).expiry-unix-seconds.base64(hmac-sha256)
+type sessions struct {
+	key []byte
+	ttl time.Duration
+}
+
+func newSessions(key []byte, ttl time.Duration) (*sessions, error) {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	return &sessions{key: key, ttl: ttl}, nil
+}
+
+func (s *sessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// issue sets a new session cookie for user on w.
+func (s *sessions) issue(w http.ResponseWriter, r *http.Request, user string) {
+	expires := time.Now().Add(s.ttl)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    payload + "." + s.sign(payload),
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(s.ttl / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clear removes the session cookie from the client.
+func (s *sessions) clear(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+var errInvalidSession = errors.New("invalid session")
+
+// user returns the username of a valid, unexpired session carried by r.
+func (s *sessions) user(r *http.Request) (string, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", errInvalidSession
+	}
+	i := strings.LastIndexByte(c.Value, '.')
+	if i < 0 {
+		return "", errInvalidSession
+	}
+	payload, sig := c.Value[:i], c.Value[i+1:]
+	if subtle.ConstantTimeCompare([]byte(sig), []byte(s.sign(payload))) != 1 {
+		return "", errInvalidSession
+	}
+	user, expiry, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", errInvalidSession
+	}
+	n, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() >= n {
+		return "", errInvalidSession
+	}
+	b, err := base64.RawURLEncoding.DecodeString(user)
+	if err != nil {
+		return "", errInvalidSession
+	}
+	return string(b), nil
+}
@@ -0,0 +1,75 @@
+package outline
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withCookie returns a request carrying a session cookie of value.
+func withCookie(value string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/outline/manager", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: value})
+	return r
+}
+
+func TestSession(t *testing.T) {
+	s, err := newSessions([]byte("key"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.issue(w, httptest.NewRequest(http.MethodPost, "/login", nil), "alice")
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || cookies[0].MaxAge != 3600 {
+		t.Fatalf("cookies %+v", cookies)
+	}
+	value := cookies[0].Value
+	if user, err := s.user(withCookie(value)); err != nil || user != "alice" {
+		t.Errorf("user %q, %v, want alice", user, err)
+	}
+
+	sig := value[strings.LastIndexByte(value, '.')+1:]
+	tampered := []byte(value)
+	tampered[len(tampered)-1] ^= 1
+	other, _ := newSessions([]byte("other"), time.Hour)
+	payload := base64.RawURLEncoding.EncodeToString([]byte("mallory")) + "." + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	expired := base64.RawURLEncoding.EncodeToString([]byte("alice")) + "." + strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)
+	for name, value := range map[string]string{
+		"tampered signature": string(tampered),
+		"other user":         payload + "." + sig,
+		"other key":          payload + "." + other.sign(payload),
+		"expired":            expired + "." + s.sign(expired),
+		"no signature":       payload,
+	} {
+		if user, err := s.user(withCookie(value)); err == nil {
+			t.Errorf("%v: got user %q", name, user)
+		}
+	}
+	if _, err := s.user(httptest.NewRequest(http.MethodGet, "/", nil)); err == nil {
+		t.Error("no cookie: got a user")
+	}
+}
+
+func TestSessionOfDeletedAdmin(t *testing.T) {
+	m := newTestHandler(t)
+	operator := loginAs(t, m, "operator")
+	if w := send(m, http.MethodGet, "/api/v1/servers", "", operator); w.Code != http.StatusOK {
+		t.Fatalf("got %v: %v", w.Code, w.Body)
+	}
+
+	if w := send(m, http.MethodDelete, "/outline/manager/set/admin?user=operator", "", loginAs(t, m, "owner")); w.Code != http.StatusOK {
+		t.Fatalf("delete: got %v: %v", w.Code, w.Body)
+	}
+	r := withCookie(operator.Value)
+	if _, ok := m.caller(r); ok {
+		t.Error("caller accepts the session of a deleted admin")
+	}
+	if w := send(m, http.MethodGet, "/api/v1/servers", "", operator); w.Code != http.StatusUnauthorized {
+		t.Errorf("got %v, want 401", w.Code)
+	}
+}
@@ -0,0 +1,111 @@
+package outline
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+
+	"github.com/spf13/cobra"
+
+	"github.com/imgk/caddy-outline-manager/outline/sidecar"
+)
+
+// defaultSSConfig is where the Outline installer keeps the config file
+// of outline-ss-server.
+const defaultSSConfig = "/opt/outline/persisted-state/outline-ss-server/config.yml"
+
+// sidecarCommand is `caddy outline sidecar`, which serves the go/manager
+// API on an Outline server.
+func sidecarCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sidecar --listen <addr>",
+		Short: "Serve the go/manager API for a local outline-ss-server",
+		Long: `
+Serves the go/manager API used by the manager to enable and disable access
+keys and to set their deadlines, by editing the config file of the local
+outline-ss-server. Point the sidecar_url of the server at it, including
+--prefix when set.`,
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdSidecar),
+	}
+	fs := flag.NewFlagSet("sidecar", flag.ExitOnError)
+	fs.String("listen", "", "address to serve the API on")
+	fs.String("config", defaultSSConfig, "outline-ss-server config file")
+	fs.String("state", "", "file of disabled keys and deadlines, next to the config file by default")
+	fs.String("prefix", "", "secret path to serve the API below")
+	fs.String("metrics", "", "prometheus metrics url of outline-ss-server, to tell online keys")
+	fs.String("pid-file", "", "pid file of outline-ss-server, sent SIGHUP to reload the config file")
+	fs.String("interval", sidecar.DefaultInterval.String(), "how often deadlines are enforced")
+	cmd.Flags().AddGoFlagSet(fs)
+	return cmd
+}
+
+func cmdSidecar(fl caddycmd.Flags) (int, error) {
+	listen := fl.String("listen")
+	if listen == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--listen is required")
+	}
+	config := fl.String("config")
+	state := fl.String("state")
+	if state == "" {
+		state = filepath.Join(filepath.Dir(config), "go-manager.json")
+	}
+
+	logger := caddy.Log()
+	s, err := sidecar.New(config, state, logger)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if prefix := strings.Trim(fl.String("prefix"), "/"); prefix != "" {
+		s.Prefix = "/" + prefix
+	}
+	s.Metrics = fl.String("metrics")
+	s.Interval = fl.Duration("interval")
+	if pidFile := fl.String("pid-file"); pidFile != "" {
+		s.Reload = func() error { return signalPIDFile(pidFile, syscall.SIGHUP) }
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: listen, Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	go s.Run(ctx)
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	logger.Info(fmt.Sprintf("serve go/manager for %v on %v", config, listen))
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return caddy.ExitCodeSuccess, nil
+}
+
+// signalPIDFile sends sig to the process whose pid is in the file at path.
+func signalPIDFile(path string, sig os.Signal) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return fmt.Errorf("pid file %v: %w", path, err)
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Signal(sig)
+}
@@ -0,0 +1,45 @@
+package outline
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/caddyserver/caddy/v2"
+
+	"github.com/imgk/caddy-outline-manager/outline"
+)
+
+// storeFile is the default name of the store in the Caddy data directory.
+const storeFile = "outline-manager.db"
+
+// stores shares open stores across config reloads, as a store file
+// is locked by the handler that opened it.
+var stores = caddy.NewUsagePool()
+
+type pooledStore struct {
+	*outline.Store
+}
+
+// Destruct implements caddy.Destructor.
+func (s pooledStore) Destruct() error {
+	return s.Close()
+}
+
+// openStore returns the store at path, opened by a previous config
+// or now. Every call must be matched by stores.Delete(path).
+func openStore(path string) (*outline.Store, error) {
+	v, _, err := stores.LoadOrNew(path, func() (caddy.Destructor, error) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		store, err := outline.OpenStore(path)
+		if err != nil {
+			return nil, err
+		}
+		return pooledStore{store}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(pooledStore).Store, nil
+}
@@ -0,0 +1,364 @@
+package outline
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imgk/caddy-outline-manager/outline"
+)
+
+// tokenPrefix marks API tokens so that leaked ones are easy to recognize.
+const tokenPrefix = "om_"
+
+// tokenTouchInterval limits how often last use times are saved.
+const tokenTouchInterval = time.Minute
+
+// Scopes of API tokens.
+const (
+	// ScopeRead limits a token to the routes open to viewers.
+	ScopeRead = "read"
+	// ScopeWrite gives a token the role of the admin who minted it.
+	ScopeWrite = "write"
+)
+
+// Token is a long-lived API token, sent as `Authorization: Bearer <token>`.
+// Only the hash of the token is stored.
+type Token struct {
+	ID    string `json:"id"`
+	Label string `json:"label,omitempty"`
+	// Hash is the hex SHA-256 of the token. It is left out of listings.
+	Hash  string `json:"hash,omitempty"`
+	Scope string `json:"scope"`
+	// Server limits the token to the server with this id.
+	Server string `json:"server,omitempty"`
+	// Admin is the username of the admin who minted the token.
+	// The token stops working when the admin is deleted.
+	Admin    string    `json:"admin"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used,omitzero"`
+}
+
+// NewToken is the answer to minting a token, the only time it is shown.
+type NewToken struct {
+	ID    string `json:"id"`
+	Token string `json:"token"`
+}
+
+// hashToken returns the hex SHA-256 of token. Tokens are random enough
+// to not need a slow password hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokens converts token config to tokens keyed by hash.
+func tokens(list []Token) (map[string]*Token, error) {
+	m := make(map[string]*Token, len(list))
+	for _, token := range list {
+		if token.ID == "" || len(token.Hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("token %q: no id or hash", token.ID)
+		}
+		if token.Scope != ScopeRead && token.Scope != ScopeWrite {
+			return nil, fmt.Errorf("token %v: unknown scope %q", token.ID, token.Scope)
+		}
+		m[token.Hash] = &token
+	}
+	return m, nil
+}
+
+// caller is who sent a request to a manager route.
+type caller struct {
+	user string
+	role outline.Role
+	// token is set when the request carries an API token
+	token *Token
+}
+
+type callerKey struct{}
+
+// context returns a copy of ctx carrying c.
+func (c caller) context(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, callerKey{}, c)
+	ctx = outline.WithRole(ctx, c.role)
+	if c.token != nil {
+		ctx = outline.WithAdmin(ctx, c.user+" (token "+c.token.ID+")")
+	} else {
+		ctx = outline.WithAdmin(ctx, c.user)
+	}
+	if c.token != nil && c.token.Server != "" {
+		ctx = outline.WithServerScope(ctx, c.token.Server)
+	}
+	return ctx
+}
+
+// callerFrom returns the caller stored by caller.context.
+func callerFrom(ctx context.Context) caller {
+	c, _ := ctx.Value(callerKey{}).(caller)
+	return c
+}
+
+// caller authenticates r by API token or by session cookie.
+func (m *Handler) caller(r *http.Request) (caller, bool) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme, token, ok := strings.Cut(auth, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return caller{}, false
+		}
+		return m.tokenCaller(strings.TrimSpace(token))
+	}
+
+	user, err := m.sessions.user(r)
+	if err != nil {
+		return caller{}, false
+	}
+	m.mu.RLock()
+	acc, ok := m.accounts[user]
+	m.mu.RUnlock()
+	return caller{user: user, role: acc.role}, ok
+}
+
+// tokenCaller looks up token and records its use.
+func (m *Handler) tokenCaller(token string) (caller, bool) {
+	hash := hashToken(token)
+
+	m.mu.RLock()
+	tok, ok := m.tokens[hash]
+	var copied Token
+	var acc account
+	if ok {
+		copied = *tok
+		acc, ok = m.accounts[tok.Admin]
+	}
+	saved := m.tokensSaved
+	m.mu.RUnlock()
+	if !ok {
+		return caller{}, false
+	}
+
+	now := time.Now()
+	if m.tokenUse.touch(hash, now, now.Sub(saved) >= tokenTouchInterval) {
+		go m.saveTokenUse()
+	}
+
+	role := acc.role
+	if copied.Scope == ScopeRead {
+		role = outline.RoleViewer
+	}
+	copied.LastUsed = now
+	return caller{user: copied.Admin, role: role, token: &copied}, true
+}
+
+// tokenUse records when tokens were last used, so that requests only
+// read lock the tokens. The uses are copied into the tokens when they
+// are saved.
+type tokenUse struct {
+	mu     sync.Mutex
+	used   map[string]time.Time
+	saving bool
+}
+
+func newTokenUse() *tokenUse {
+	return &tokenUse{used: make(map[string]time.Time)}
+}
+
+// touch records the use at now of the token with hash. It reports
+// whether the caller should save the uses, when due is set and no one
+// else is saving them.
+func (u *tokenUse) touch(hash string, now time.Time, due bool) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.used[hash] = now
+	if !due || u.saving {
+		return false
+	}
+	u.saving = true
+	return true
+}
+
+// last returns the last recorded use of the token with hash.
+func (u *tokenUse) last(hash string) (time.Time, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	t, ok := u.used[hash]
+	return t, ok
+}
+
+// take returns the recorded uses and forgets them.
+func (u *tokenUse) take() map[string]time.Time {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	used := u.used
+	u.used = make(map[string]time.Time)
+	return used
+}
+
+// saveTokenUse saves the tokens with their recorded uses, in the
+// background of the request whose touch reported it due.
+func (m *Handler) saveTokenUse() {
+	m.mu.Lock()
+	err := m.saveTokens()
+	m.mu.Unlock()
+
+	m.tokenUse.mu.Lock()
+	m.tokenUse.saving = false
+	m.tokenUse.mu.Unlock()
+
+	if err != nil {
+		m.logger.Error(fmt.Sprintf("save tokens error: %v", err))
+	}
+}
+
+// ListTokens writes the tokens of the admin as JSON, those of
+// every admin for owners.
+func (m *Handler) ListTokens(w http.ResponseWriter, r *http.Request) error {
+	c := callerFrom(r.Context())
+
+	m.mu.RLock()
+	list := make([]Token, 0, len(m.tokens))
+	for _, tok := range m.tokens {
+		if tok.Admin == c.user || c.role >= outline.RoleOwner {
+			entry := *tok
+			if used, ok := m.tokenUse.last(tok.Hash); ok {
+				entry.LastUsed = used
+			}
+			entry.Hash = ""
+			list = append(list, entry)
+		}
+	}
+	m.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(list)
+}
+
+// MintToken creates a token for the admin and answers it once.
+func (m *Handler) MintToken(w http.ResponseWriter, r *http.Request) error {
+	c := callerFrom(r.Context())
+
+	scope := r.FormValue("scope")
+	if scope == "" {
+		scope = ScopeRead
+	}
+	if scope != ScopeRead && scope != ScopeWrite {
+		http.Error(w, "scope must be read or write", http.StatusBadRequest)
+		return nil
+	}
+	server := r.FormValue("server")
+	if server != "" && !slices.ContainsFunc(m.server.Entries(nil), func(entry outline.ServerEntry) bool {
+		return entry.ID == server
+	}) {
+		http.Error(w, "unknown server: "+server, http.StatusBadRequest)
+		return nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	secret := tokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	tok := &Token{
+		ID:      hex.EncodeToString(id),
+		Label:   r.FormValue("label"),
+		Hash:    hashToken(secret),
+		Scope:   scope,
+		Server:  server,
+		Admin:   c.user,
+		Created: time.Now(),
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tokens[tok.Hash] = tok
+	if err := m.saveTokens(); err != nil {
+		return err
+	}
+
+	m.logger.Info(fmt.Sprintf("admin %v mint %v token %v", c.user, scope, tok.ID))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(NewToken{ID: tok.ID, Token: secret})
+}
+
+// LabelToken changes the label of a token.
+func (m *Handler) LabelToken(w http.ResponseWriter, r *http.Request) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tok := m.ownToken(r)
+	if tok == nil {
+		http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
+		return nil
+	}
+	tok.Label = r.FormValue("label")
+	return m.saveTokens()
+}
+
+// RevokeToken deletes a token.
+func (m *Handler) RevokeToken(w http.ResponseWriter, r *http.Request) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tok := m.ownToken(r)
+	if tok == nil {
+		http.HandlerFunc(http.NotFound).ServeHTTP(w, r)
+		return nil
+	}
+	delete(m.tokens, tok.Hash)
+
+	m.logger.Info(fmt.Sprintf("revoke token %v of %v", tok.ID, tok.Admin))
+
+	return m.saveTokens()
+}
+
+// ownToken returns the token named by the path of r if the caller may
+// change it, its own or any for owners. m.mu must be held.
+func (m *Handler) ownToken(r *http.Request) *Token {
+	c := callerFrom(r.Context())
+	id := r.PathValue("id")
+	for _, tok := range m.tokens {
+		if tok.ID == id && (tok.Admin == c.user || c.role >= outline.RoleOwner) {
+			return tok
+		}
+	}
+	return nil
+}
+
+// saveTokens writes all tokens to the state file, with their recorded
+// uses. m.mu must be held.
+func (m *Handler) saveTokens() error {
+	for hash, used := range m.tokenUse.take() {
+		if tok, ok := m.tokens[hash]; ok && used.After(tok.LastUsed) {
+			tok.LastUsed = used
+		}
+	}
+	list := make([]Token, 0, len(m.tokens))
+	for _, tok := range m.tokens {
+		list = append(list, *tok)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	m.tokensSaved = time.Now()
+	return updateManagerFile(m.StateFile, func(config *managerConfig) {
+		config.Tokens = list
+	})
+}
@@ -0,0 +1,120 @@
+package outline
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/imgk/caddy-outline-manager/outline"
+)
+
+// mint mints a token as user with the form of the mintToken route.
+func mint(t *testing.T, m *Handler, user, form string) NewToken {
+	t.Helper()
+	w := send(m, http.MethodPost, outline.BasePath+"/tokens", form, loginAs(t, m, user))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("mint %v as %v: got %v: %v", form, user, w.Code, w.Body)
+	}
+	tok := NewToken{}
+	if err := json.Unmarshal(w.Body.Bytes(), &tok); err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+// tokenRole returns the role of a request with token, RoleNone when it
+// is rejected.
+func tokenRole(m *Handler, token string) outline.Role {
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/servers", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	c, ok := m.caller(r)
+	if !ok {
+		return outline.RoleNone
+	}
+	return c.role
+}
+
+func TestTokenScope(t *testing.T) {
+	m := newTestHandler(t)
+	for _, c := range []struct {
+		user  string
+		scope string
+		role  outline.Role
+	}{
+		{"owner", "write", outline.RoleOwner},
+		{"owner", "read", outline.RoleViewer},
+		{"operator", "write", outline.RoleOperator},
+		{"viewer", "write", outline.RoleViewer},
+	} {
+		tok := mint(t, m, c.user, "scope="+c.scope)
+		if role := tokenRole(m, tok.Token); role != c.role {
+			t.Errorf("%v token of %v: role %v, want %v", c.scope, c.user, role, c.role)
+		}
+	}
+
+	// a write token of a viewer cannot do what a viewer cannot
+	tok := mint(t, m, "viewer", "scope=write")
+	if w := send(m, http.MethodPost, "/api/v1/servers", `{}`, tok.Token); w.Code != http.StatusForbidden {
+		t.Errorf("add server with the token of a viewer: got %v, want 403", w.Code)
+	}
+	if w := send(m, http.MethodPost, outline.BasePath+"/tokens", "scope=read", tok.Token); w.Code != http.StatusForbidden {
+		t.Errorf("mint with a token: got %v, want 403", w.Code)
+	}
+	if w := send(m, http.MethodPost, outline.BasePath+"/tokens", "server=c", loginAs(t, m, "owner")); w.Code != http.StatusBadRequest {
+		t.Errorf("mint for an unknown server: got %v, want 400", w.Code)
+	}
+}
+
+func TestTokenServer(t *testing.T) {
+	m := newTestHandler(t)
+	tok := mint(t, m, "owner", "scope=write&server=a")
+
+	w := send(m, http.MethodGet, "/api/v1/servers", "", tok.Token)
+	servers := []outline.ServerResource{}
+	if err := json.Unmarshal(w.Body.Bytes(), &servers); err != nil {
+		t.Fatalf("got %v: %v", w.Code, w.Body)
+	}
+	if len(servers) != 1 || servers[0].ID != "a" {
+		t.Errorf("servers %+v, want a only", servers)
+	}
+	// changes beyond server a are refused
+	if w := send(m, http.MethodPost, "/api/v1/servers", `{}`, tok.Token); w.Code != http.StatusForbidden {
+		t.Errorf("add server: got %v, want 403", w.Code)
+	}
+	if w := send(m, http.MethodPost, outline.BasePath+"/servers", "config=x", tok.Token); w.Code != http.StatusForbidden {
+		t.Errorf("add server from the panel: got %v, want 403", w.Code)
+	}
+}
+
+func TestTokenRevoked(t *testing.T) {
+	m := newTestHandler(t)
+	revoked := mint(t, m, "operator", "scope=write")
+	kept := mint(t, m, "operator", "scope=read")
+	orphan := mint(t, m, "viewer", "scope=read")
+
+	// a viewer cannot revoke the token of another admin
+	if w := send(m, http.MethodDelete, outline.BasePath+"/tokens/"+revoked.ID, "", loginAs(t, m, "viewer")); w.Code != http.StatusNotFound {
+		t.Errorf("revoke as another admin: got %v, want 404", w.Code)
+	}
+	if w := send(m, http.MethodDelete, outline.BasePath+"/tokens/"+revoked.ID, "", loginAs(t, m, "operator")); w.Code != http.StatusOK {
+		t.Fatalf("revoke: got %v: %v", w.Code, w.Body)
+	}
+	if w := send(m, http.MethodDelete, outline.BasePath+"/set/admin?user=viewer", "", loginAs(t, m, "owner")); w.Code != http.StatusOK {
+		t.Fatalf("delete admin: got %v: %v", w.Code, w.Body)
+	}
+
+	for name, c := range map[string]struct {
+		token string
+		code  int
+	}{
+		"revoked":          {revoked.Token, http.StatusUnauthorized},
+		"kept":             {kept.Token, http.StatusOK},
+		"of deleted admin": {orphan.Token, http.StatusUnauthorized},
+		"unknown":          {tokenPrefix + "x", http.StatusUnauthorized},
+	} {
+		if w := send(m, http.MethodGet, "/api/v1/servers", "", c.token); w.Code != c.code {
+			t.Errorf("%v token: got %v, want %v", name, w.Code, c.code)
+		}
+	}
+}